@@ -6,14 +6,20 @@ import (
 	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	_ "time/tzdata" // schedules need timezones on hosts without a zoneinfo database
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/websocket"
@@ -53,19 +59,417 @@ type Snapshot struct {
 	Unrealized    float64        `json:"unrealized"`
 	Positions     []Position     `json:"positions"`
 	WorkingOrders []WorkingOrder `json:"workingOrders"`
+	// Connection is the name of the connection server reporting the account
+	Connection string `json:"connection,omitempty"`
+	// Exposure is the money at risk to stops and in reach of targets
+	Exposure *AccountExposure `json:"exposure,omitempty"`
+}
+
+// InstrumentSpec describes a futures contract by master instrument.
+type InstrumentSpec struct {
+	Root       string  `json:"root"`
+	PointValue float64 `json:"pointValue"`
+	// Custom is set for specs added or changed through the API
+	Custom bool `json:"custom,omitempty"`
+}
+
+// defaultInstrumentSpecs holds common CME futures. INSTRUMENT_SPECS and
+// the API can add to or override them.
+var defaultInstrumentSpecs = map[string]InstrumentSpec{
+	"ES": {PointValue: 50}, "MES": {PointValue: 5},
+	"NQ": {PointValue: 20}, "MNQ": {PointValue: 2},
+	"YM": {PointValue: 5}, "MYM": {PointValue: 0.5},
+	"RTY": {PointValue: 50}, "M2K": {PointValue: 5},
+	"CL": {PointValue: 1000}, "MCL": {PointValue: 100},
+	"NG": {PointValue: 10000}, "GC": {PointValue: 100},
+	"MGC": {PointValue: 10}, "SI": {PointValue: 5000},
+	"ZB": {PointValue: 1000}, "ZN": {PointValue: 1000},
+	"ZF": {PointValue: 1000}, "6E": {PointValue: 125000},
+	"6B": {PointValue: 62500}, "6J": {PointValue: 12500000},
+}
+
+// parseInstrumentSpecs parses point values such as "ES=50,XYZ=10" into a map
+// on top of the defaults.
+func parseInstrumentSpecs(spec string) map[string]InstrumentSpec {
+	specs := make(map[string]InstrumentSpec, len(defaultInstrumentSpecs))
+	for root, is := range defaultInstrumentSpecs {
+		is.Root = root
+		specs[root] = is
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("Ignoring malformed INSTRUMENT_SPECS entry %q", entry)
+			continue
+		}
+		root := strings.ToUpper(strings.TrimSpace(parts[0]))
+		pointValue, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || pointValue <= 0 {
+			log.Printf("Ignoring invalid point value in INSTRUMENT_SPECS entry %q", entry)
+			continue
+		}
+		specs[root] = InstrumentSpec{Root: root, PointValue: pointValue}
+	}
+	return specs
+}
+
+// instrumentRoot returns the master instrument of a full NinjaTrader
+// instrument name, e.g. "ES" for "ES 12-26".
+func instrumentRoot(instrument string) string {
+	if i := strings.IndexByte(instrument, ' '); i >= 0 {
+		instrument = instrument[:i]
+	}
+	return strings.ToUpper(instrument)
+}
+
+// PositionExposure is what a position stands to lose if its stops are hit
+// and to gain if its targets are, measured from its average price.
+type PositionExposure struct {
+	Instrument string  `json:"instrument"`
+	Quantity   int     `json:"quantity"`
+	PointValue float64 `json:"pointValue"`
+	// Risk is negative when the stops lock in a profit
+	Risk   float64 `json:"risk"`
+	Reward float64 `json:"reward"`
+	// Unprotected contracts have no stop, so their risk is unbounded;
+	// untargeted ones have no profit target
+	Unprotected int `json:"unprotected"`
+	Untargeted  int `json:"untargeted"`
+	// UnknownSpec is set when the point value is unknown; Risk and Reward
+	// are then zero
+	UnknownSpec bool `json:"unknownSpec,omitempty"`
+}
+
+// AccountExposure sums the exposure of an account's positions.
+type AccountExposure struct {
+	Risk        float64            `json:"risk"`
+	Reward      float64            `json:"reward"`
+	Unprotected int                `json:"unprotected"`
+	UnknownSpec bool               `json:"unknownSpec,omitempty"`
+	Positions   []PositionExposure `json:"positions"`
+}
+
+// add folds other into the totals of e.
+func (e *AccountExposure) add(other AccountExposure) {
+	e.Risk += other.Risk
+	e.Reward += other.Reward
+	e.Unprotected += other.Unprotected
+	e.UnknownSpec = e.UnknownSpec || other.UnknownSpec
 }
 
 type Command struct {
 	Type    string                 `json:"type"`
 	Payload map[string]interface{} `json:"payload"`
 	ID      string                 `json:"id"`
+	// IssuedAt and TTLSeconds let the connection server refuse commands
+	// that reach it too late to be safe; a zero TTL never expires.
+	IssuedAt   time.Time `json:"issuedAt"`
+	TTLSeconds float64   `json:"ttlSeconds,omitempty"`
+}
+
+// expiresAt returns when the command stops being safe to execute, or nil
+// if it never expires.
+func (cmd Command) expiresAt() *time.Time {
+	if cmd.TTLSeconds <= 0 {
+		return nil
+	}
+	t := cmd.IssuedAt.Add(time.Duration(cmd.TTLSeconds * float64(time.Second)))
+	return &t
+}
+
+// defaultCommandTTLs bounds how late each command type may still be
+// executed. Entries and order changes go stale fastest; exits stay useful a
+// little longer. COMMAND_TTLS can add to or override these, and
+// COMMAND_TTL applies to types not listed.
+var defaultCommandTTLs = map[string]time.Duration{
+	"place_order": 10 * time.Second, "place_bracket": 10 * time.Second,
+	"place_atm_order": 10 * time.Second, "reverse_position": 10 * time.Second,
+	"change_order": 10 * time.Second, "nudge_order": 10 * time.Second,
+	"breakeven": 15 * time.Second, "arm_trail": 30 * time.Second,
+	"close_position": 30 * time.Second, "close_strategy": 30 * time.Second,
+	"flatten_account": 30 * time.Second, "flatten_all": 30 * time.Second,
+}
+
+// parseCommandTTLs parses "place_order=5s,flatten_all=1m" into a map on top
+// of the defaults. A TTL of 0 disables expiry for that type.
+func parseCommandTTLs(spec string) map[string]time.Duration {
+	ttls := make(map[string]time.Duration, len(defaultCommandTTLs))
+	for cmdType, ttl := range defaultCommandTTLs {
+		ttls[cmdType] = ttl
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("Ignoring malformed COMMAND_TTLS entry %q", entry)
+			continue
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || ttl < 0 {
+			log.Printf("Ignoring invalid TTL in COMMAND_TTLS entry %q", entry)
+			continue
+		}
+		ttls[strings.TrimSpace(parts[0])] = ttl
+	}
+	return ttls
+}
+
+// PlaceOrderPayload mirrors the connection server's place_order payload so
+// that obviously bad tickets are rejected before they are ever relayed.
+type PlaceOrderPayload struct {
+	Account    string  `json:"account"`
+	Instrument string  `json:"instrument"`
+	Action     string  `json:"action"`
+	Quantity   int     `json:"quantity"`
+	OrderType  string  `json:"orderType"`
+	LimitPrice float64 `json:"limitPrice"`
+	StopPrice  float64 `json:"stopPrice"`
+	TIF        string  `json:"tif"`
+	OcoId      string  `json:"ocoId"`
+	OrderId    string  `json:"orderId"`
+	Strategy   string  `json:"strategy"`
+	StrategyId string  `json:"strategyId"`
+}
+
+func (p *PlaceOrderPayload) validate() error {
+	p.Action = strings.ToUpper(strings.TrimSpace(p.Action))
+	p.OrderType = strings.ToUpper(strings.TrimSpace(p.OrderType))
+	p.TIF = strings.ToUpper(strings.TrimSpace(p.TIF))
+	if p.TIF == "" {
+		p.TIF = "DAY"
+	}
+
+	if p.Account == "" {
+		return fmt.Errorf("account is required")
+	}
+	if p.Instrument == "" {
+		return fmt.Errorf("instrument is required")
+	}
+	if p.Action != "BUY" && p.Action != "SELL" {
+		return fmt.Errorf("invalid action %q: must be BUY or SELL", p.Action)
+	}
+	if p.Quantity <= 0 {
+		return fmt.Errorf("quantity must be positive, got %d", p.Quantity)
+	}
+	switch p.OrderType {
+	case "MARKET":
+	case "LIMIT":
+		if p.LimitPrice <= 0 {
+			return fmt.Errorf("limit price is required for LIMIT orders")
+		}
+	case "STOPMARKET":
+		if p.StopPrice <= 0 {
+			return fmt.Errorf("stop price is required for STOPMARKET orders")
+		}
+	case "STOPLIMIT":
+		if p.LimitPrice <= 0 || p.StopPrice <= 0 {
+			return fmt.Errorf("limit and stop prices are required for STOPLIMIT orders")
+		}
+	default:
+		return fmt.Errorf("invalid order type %q: must be MARKET, LIMIT, STOPMARKET or STOPLIMIT", p.OrderType)
+	}
+	if p.TIF != "DAY" && p.TIF != "GTC" {
+		return fmt.Errorf("invalid TIF %q: must be DAY or GTC", p.TIF)
+	}
+	return nil
+}
+
+type PlaceBracketPayload struct {
+	Account     string  `json:"account"`
+	Instrument  string  `json:"instrument"`
+	Action      string  `json:"action"`
+	Quantity    int     `json:"quantity"`
+	EntryType   string  `json:"entryType"`
+	EntryPrice  float64 `json:"entryPrice"`
+	StopPrice   float64 `json:"stopPrice"`
+	TargetPrice float64 `json:"targetPrice"`
+	TIF         string  `json:"tif"`
+	OcoId       string  `json:"ocoId"`
+}
+
+func (p *PlaceBracketPayload) validate() error {
+	p.Action = strings.ToUpper(strings.TrimSpace(p.Action))
+	p.EntryType = strings.ToUpper(strings.TrimSpace(p.EntryType))
+	if p.EntryType == "" {
+		p.EntryType = "MARKET"
+	}
+	if p.EntryType != "MARKET" && p.EntryType != "LIMIT" {
+		return fmt.Errorf("invalid entry type %q: must be MARKET or LIMIT", p.EntryType)
+	}
+	entry := PlaceOrderPayload{
+		Account:    p.Account,
+		Instrument: p.Instrument,
+		Action:     p.Action,
+		Quantity:   p.Quantity,
+		OrderType:  p.EntryType,
+		TIF:        p.TIF,
+	}
+	if p.EntryType == "LIMIT" {
+		entry.LimitPrice = p.EntryPrice
+	}
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	p.TIF = entry.TIF
+	if p.StopPrice <= 0 || p.TargetPrice <= 0 {
+		return fmt.Errorf("stop and target prices are required")
+	}
+
+	long := p.Action == "BUY"
+	if long && p.StopPrice >= p.TargetPrice || !long && p.StopPrice <= p.TargetPrice {
+		return fmt.Errorf("stop and target are on the wrong sides for a %s bracket", p.Action)
+	}
+	if p.EntryType == "LIMIT" {
+		if long && (p.StopPrice >= p.EntryPrice || p.TargetPrice <= p.EntryPrice) ||
+			!long && (p.StopPrice <= p.EntryPrice || p.TargetPrice >= p.EntryPrice) {
+			return fmt.Errorf("entry price must lie between stop and target")
+		}
+	}
+	return nil
+}
+
+type ChangeOrderPayload struct {
+	Account    string  `json:"account"`
+	OrderId    string  `json:"orderId"`
+	Quantity   int     `json:"quantity"`
+	LimitPrice float64 `json:"limitPrice"`
+	StopPrice  float64 `json:"stopPrice"`
+	StrategyId string  `json:"strategyId"`
+}
+
+func (p *ChangeOrderPayload) validate() error {
+	if p.OrderId == "" {
+		return fmt.Errorf("orderId is required")
+	}
+	if p.Quantity < 0 || p.LimitPrice < 0 || p.StopPrice < 0 {
+		return fmt.Errorf("quantity and prices must not be negative")
+	}
+	if p.Quantity == 0 && p.LimitPrice == 0 && p.StopPrice == 0 {
+		return fmt.Errorf("nothing to change: quantity, limitPrice or stopPrice is required")
+	}
+	return nil
+}
+
+// ATMStrategy records an ATM strategy started from this dashboard so that it
+// can later be closed by its strategy id.
+type ATMStrategy struct {
+	StrategyId string    `json:"strategyId"`
+	Account    string    `json:"account"`
+	Instrument string    `json:"instrument"`
+	Template   string    `json:"template"`
+	CommandID  string    `json:"commandId"`
+	StartedAt  time.Time `json:"startedAt"`
+	// active is set once a position or working order of the strategy's
+	// instrument has been seen
+	active bool
+}
+
+// atmSettleTime is how long an acknowledged ATM strategy may show neither
+// a position nor working orders before it is considered gone.
+const atmSettleTime = 30 * time.Second
+
+// Trail mirrors the trailing stop state reported by connection servers.
+type Trail struct {
+	Account    string    `json:"account"`
+	Instrument string    `json:"instrument"`
+	Mode       string    `json:"mode"`
+	Distance   float64   `json:"distance"`
+	StepTicks  int       `json:"stepTicks"`
+	ArmedAt    time.Time `json:"armedAt"`
+	BestPrice  float64   `json:"bestPrice"`
+	StopPrice  float64   `json:"stopPrice"`
+	LastMoved  time.Time `json:"lastMoved,omitempty"`
+	Status     string    `json:"status"`
+}
+
+// RiskState mirrors an account's daily loss limit standing reported by its
+// connection server.
+type RiskState struct {
+	Account     string     `json:"account"`
+	TradingDay  string     `json:"tradingDay"`
+	DailyPnL    float64    `json:"dailyPnl"`
+	LossLimit   float64    `json:"lossLimit"`
+	Headroom    float64    `json:"headroom"`
+	Breached    bool       `json:"breached"`
+	BreachedAt  *time.Time `json:"breachedAt,omitempty"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+}
+
+// DrawdownState mirrors an account's trailing drawdown tracking reported by
+// its connection server.
+type DrawdownState struct {
+	Account    string    `json:"account"`
+	Mode       string    `json:"mode"`
+	HighWater  float64   `json:"highWater"`
+	Threshold  float64   `json:"threshold"`
+	Equity     float64   `json:"equity"`
+	Distance   float64   `json:"distance"`
+	Buffer     float64   `json:"buffer,omitempty"`
+	TradingDay string    `json:"tradingDay"`
+	DayBalance float64   `json:"dayBalance"`
+	Breached   bool      `json:"breached"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// NakedPosition mirrors a position its connection server found not fully
+// covered by stop orders.
+type NakedPosition struct {
+	Account    string    `json:"account"`
+	Instrument string    `json:"instrument"`
+	Quantity   int       `json:"quantity"`
+	Covered    int       `json:"covered"`
+	Status     string    `json:"status"`
+	Since      time.Time `json:"since"`
+	Alerted    bool      `json:"alerted"`
+	StopPlaced bool      `json:"stopPlaced,omitempty"`
+}
+
+// Alert is an operator-facing warning raised by a connection server.
+type Alert struct {
+	Level      string    `json:"level"`
+	Source     string    `json:"source"`
+	Account    string    `json:"account,omitempty"`
+	Message    string    `json:"message"`
+	Time       time.Time `json:"time"`
+	Connection string    `json:"connection"`
+}
+
+// OrderEvent is an order or position state transition read by a connection
+// server from NinjaTrader's ATI outgoing folder.
+type OrderEvent struct {
+	Kind             string    `json:"kind"`
+	Account          string    `json:"account,omitempty"`
+	Instrument       string    `json:"instrument,omitempty"`
+	OrderId          string    `json:"orderId,omitempty"`
+	State            string    `json:"state,omitempty"`
+	Filled           int       `json:"filled,omitempty"`
+	AverageFillPrice float64   `json:"averageFillPrice,omitempty"`
+	MarketPosition   string    `json:"marketPosition,omitempty"`
+	Quantity         int       `json:"quantity,omitempty"`
+	AveragePrice     float64   `json:"averagePrice,omitempty"`
+	CommandId        string    `json:"commandId,omitempty"`
+	Time             time.Time `json:"time"`
+}
+
+// sseEvent is a message for browsers. Snapshots use the default event name
+// so that the page's onmessage handler keeps receiving them.
+type sseEvent struct {
+	Event string
+	Data  []byte
 }
 
 type CloudDashboard struct {
 	mu              sync.RWMutex
 	latest          map[string]Snapshot
 	webClientsMu    sync.Mutex
-	webClients      map[chan []byte]bool
+	webClients      map[chan sseEvent]bool
 	connectionsMu   sync.Mutex
 	connections     map[*websocket.Conn]*ConnectionClient
 	upgrader        websocket.Upgrader
@@ -76,193 +480,1784 @@ type CloudDashboard struct {
 	csrfAuthKey     []byte
 	sessions        map[string]time.Time
 	sessionsMu      sync.Mutex
+	// ATM strategies
+	atmTemplates    []string
+	atmStrategies   map[string]ATMStrategy
+	// ATM orders sent but not yet acknowledged, keyed by command id
+	pendingATM      map[string]ATMStrategy
+	atmStrategiesMu sync.Mutex
+	// Trailing stops and risk state reported by each connection server,
+	// keyed by connection name
+	trails          map[string][]Trail
+	risk            map[string][]RiskState
+	drawdowns       map[string][]DrawdownState
+	naked           map[string][]NakedPosition
+	// Instrument specs by master instrument; custom ones persist in stateDir
+	specs           map[string]InstrumentSpec
+	specsMu         sync.Mutex
+	// Connection server name owning each account, learned from snapshots
+	accountOwners   map[string]string
+	// Command lifecycle tracking
+	commands        *CommandRegistry
+	ackTimeout      time.Duration
+	commandTTLs     map[string]time.Duration
+	defaultTTL      time.Duration
+	queue           *CommandQueue
+	stateDir        string
+	// Scheduled commands, persisted in stateDir
+	schedules       map[string]*Schedule
+	schedulesMu     sync.Mutex
+	// Conditional rules, persisted in stateDir, and their recent firings
+	rules           map[string]*Rule
+	ruleFirings     []RuleFiring
+	rulesMu         sync.Mutex
+	// Named command sequences, persisted in stateDir, and recent runs
+	macros          map[string]*Macro
+	macroRuns       []*MacroRun
+	macrosMu        sync.Mutex
+	// Accounts locked out of new orders, until when
+	lockouts        map[string]time.Time
+	lockoutsMu      sync.Mutex
+	// Recent alerts from connection servers, oldest first
+	alerts          []Alert
+	alertsMu        sync.Mutex
+	// Recent ATI order and position transitions, oldest first
+	orderEvents     []OrderEvent
+	orderEventsMu   sync.Mutex
 }
 
 type ConnectionClient struct {
 	conn        *websocket.Conn
 	commandChan chan Command
 	id          string
+	// name identifies the connection server across reconnects; it is the
+	// id until the server says hello.
+	name string
 }
 
+// errUnknownAccount rejects commands for accounts no connection server has
+// reported.
+var errUnknownAccount = errors.New("unknown account")
+
 type WebSocketMessage struct {
-	Type string      `json:"type"`
-	Data interface{} `json:"data"`
-	ID   string      `json:"id,omitempty"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data"`
+	ID      string      `json:"id,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Success bool        `json:"success,omitempty"`
+	// Stage distinguishes follow-up acknowledgments, e.g. "verification"
+	Stage    string `json:"stage,omitempty"`
+	Verified bool   `json:"verified,omitempty"`
+	// Simulated marks acks from a connection server in dry-run mode
+	Simulated bool `json:"simulated,omitempty"`
+	// Duplicate marks the replayed result of a command already executed
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Expired marks commands refused because they arrived after their TTL
+	Expired bool `json:"expired,omitempty"`
 }
 
-var loginTpl = template.Must(template.New("login").Parse(`
-<!doctype html>
-<html>
-<head>
-<meta charset="utf-8">
-<title>NinjaTrader Login</title>
-<meta name="viewport" content="width=device-width,initial-scale=1">
-<link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.2/dist/css/bootstrap.min.css" rel="stylesheet">
-<style>
-body { background: #f8f9fa; }
-.login-container { max-width: 400px; margin: 100px auto; }
-.card { box-shadow: 0 4px 6px rgba(0,0,0,0.1); }
-</style>
-</head>
-<body>
-<div class="login-container">
-    <div class="card">
-        <div class="card-body">
-            <h4 class="card-title text-center mb-4">NinjaTrader Dashboard</h4>
-            {{if .Error}}<div class="alert alert-danger">{{.Error}}</div>{{end}}
-            <form method="POST" action="/login">
-                <div class="mb-3">
-                    <label for="username" class="form-label">Username</label>
-                    <input type="text" class="form-control" id="username" name="username" required>
-                </div>
-                <div class="mb-3">
-                    <label for="password" class="form-label">Password</label>
-                    <input type="password" class="form-control" id="password" name="password" required>
-                </div>
-                <button type="submit" class="btn btn-primary w-100">Login</button>
-            </form>
-        </div>
-    </div>
-</div>
-</body>
-</html>
-`))
+// Command lifecycle states tracked by the CommandRegistry.
+const (
+	CommandPending      = "pending"
+	CommandQueued       = "queued"
+	CommandDelivered    = "delivered"
+	CommandTimedOut     = "timed_out"
+	CommandAcknowledged = "acknowledged"
+	CommandFailed       = "failed"
+	CommandVerified     = "verified"
+	CommandNotVerified  = "not_verified"
+	CommandNotConsumed  = "not_consumed"
+	CommandRejected     = "rejected"
+	CommandExpired      = "expired"
+)
 
-var tpl = template.Must(template.New("dash").Parse(`
-<!doctype html>
-<html>
-<head>
-<meta charset="utf-8">
-<title>NT8 Remote Dashboard</title>
-<meta name="viewport" content="width=device-width,initial-scale=1">
-<meta name="csrf-token" content="{{.CSRFToken}}">
-<link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.2/dist/css/bootstrap.min.css" rel="stylesheet">
-<link href="https://cdn.jsdelivr.net/npm/bootstrap-icons@1.11.3/font/bootstrap-icons.min.css" rel="stylesheet">
-<style>
-/* Base Styles */
-body { transition: background-color 0.3s, color 0.3s; }
-.action-btn { cursor: pointer; }
+// commandFailures are the statuses a connection server reports for a
+// command it did not carry out.
+var commandFailures = map[string]bool{
+	CommandFailed:      true,
+	CommandNotVerified: true,
+	CommandNotConsumed: true,
+	CommandExpired:     true,
+}
 
-/* --- Light Mode Styles --- */
-body { background-color: #f8f9fa; }
-.text-label { color: #6c757d !important; }
-.text-normal { color: #212529 !important; }
-.text-pnl-positive { color: #198754 !important; }
-.text-pnl-negative { color: #dc3545 !important; }
-.table-danger-custom { background-color: rgba(220, 53, 69, 0.15) !important; }
-.table-success-custom { background-color: rgba(25, 135, 84, 0.15) !important; }
+// commandStatusRank orders the lifecycle so that late or out-of-order
+// messages never move a command backwards. A late ack still overrides a
+// timeout because it is the better information.
+var commandStatusRank = map[string]int{
+	CommandPending:      0,
+	CommandQueued:       1,
+	CommandDelivered:    2,
+	CommandTimedOut:     3,
+	CommandAcknowledged: 4,
+	CommandFailed:       4,
+	CommandVerified:     5,
+	CommandNotVerified:  5,
+	CommandNotConsumed:  5,
+	CommandRejected:     5,
+	CommandExpired:      5,
+}
 
-/* --- Dark Mode Styles --- */
-body.dark-mode { background-color: #212529; color: #dee2e6; }
-body.dark-mode .card { background-color: #343a40; border-color: #495057; }
-body.dark-mode .card-title, body.dark-mode h3, body.dark-mode h6, body.dark-mode th { color: #f8f9fa; }
-body.dark-mode .text-label { color: #adb5bd !important; }
-body.dark-mode .text-normal, body.dark-mode td { color: #dee2e6 !important; }
-body.dark-mode .text-pnl-positive { color: #52b788 !important; }
-body.dark-mode .text-pnl-negative { color: #e57373 !important; }
-body.dark-mode .table { border-color: #495057; }
-body.dark-mode .table > :not(caption) > * > * { background-color: #343a40; border-color: #495057;}
-body.dark-mode .table-hover > tbody > tr:hover > * { background-color: #495057; color: #f8f9fa; }
-body.dark-mode .form-check-label { color: #dee2e6; }
-body.dark-mode hr { border-top: 1px solid rgba(255, 255, 255, 0.1); }
-body.dark-mode .text-muted { color: #6c757d !important; }
-body.dark-mode .table-danger-custom { background-color: rgba(220, 53, 69, 0.3) !important; }
-body.dark-mode .table-success-custom { background-color: rgba(25, 135, 84, 0.3) !important; }
-</style>
-</head>
-<body>
-<div class="container py-4">
-    <div class="d-flex justify-content-between align-items-center">
-        <h3>NinjaTrader Cloud Dashboard (Railway)</h3>
-        <div class="d-flex align-items-center gap-3">
-            <div class="form-check form-switch"><input class="form-check-input" type="checkbox" role="switch" id="darkModeToggle"><label class="form-check-label" for="darkModeToggle">Dark Mode</label></div>
-            <a href="/logout" class="btn btn-outline-secondary btn-sm">Logout</a>
-        </div>
-    </div>
-    <div id="accounts" class="mt-3"></div>
-    <div class="mt-4"><button id="flattenAll" class="btn btn-danger" data-action="flatten-all">Emergency Flatten (ALL Accounts)</button></div>
-    <p class="text-muted small mt-3">Connected: <span id="status">--</span> | Last Update: <span id="lastUpdate">--</span></p>
-</div>
+type CommandEvent struct {
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	At     time.Time `json:"at"`
+}
 
-<script>
-const darkModeToggle = document.getElementById('darkModeToggle');
-const body = document.body;
-function setDarkMode(isDark) {
-    localStorage.setItem('theme', isDark ? 'dark' : 'light');
-    body.classList.toggle('dark-mode', isDark);
-    darkModeToggle.checked = isDark;
+type CommandRecord struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Payload   map[string]interface{} `json:"payload"`
+	Status    string                 `json:"status"`
+	Error     string                 `json:"error,omitempty"`
+	Simulated bool                   `json:"simulated,omitempty"`
+	ExpiresAt *time.Time             `json:"expiresAt,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+	UpdatedAt time.Time              `json:"updatedAt"`
+	History   []CommandEvent         `json:"history"`
+	// Connections holds, for a command sent to every connection server,
+	// the status each of them reported, keyed by connection name
+	Connections      map[string]string `json:"connections,omitempty"`
+	connectionErrors map[string]string
 }
-darkModeToggle.addEventListener('click', () => setDarkMode(darkModeToggle.checked));
-setDarkMode(localStorage.getItem('theme') === 'dark');
 
-let evt = new EventSource('/events');
-evt.onopen = () => { document.getElementById('status').innerText = 'connected'; };
-evt.onerror = () => { document.getElementById('status').innerText = 'disconnected'; };
-evt.onmessage = function(e){
-    document.getElementById('lastUpdate').innerText = new Date().toLocaleTimeString();
-    try { render(JSON.parse(e.data)); } catch(err) { console.error('Parse error:', err); }
-};
+// CommandRegistry tracks the most recent commands through their lifecycle
+// and notifies onChange of every transition.
+type CommandRegistry struct {
+	mu       sync.Mutex
+	records  map[string]*CommandRecord
+	order    []string
+	max      int
+	onChange func(CommandRecord)
+	// changed is closed and replaced on every transition to wake waiters
+	changed chan struct{}
+}
 
-async function sendCommand(url, body) {
-    const msg = body.account ? 'Action: ' + url + '\nDetails: ' + JSON.stringify(body) : 'FLATTEN EVERYTHING?';
-    if (!confirm('Are you sure?\n\n' + msg)) return;
-    try {
-		const csrfToken = document.querySelector('meta[name="csrf-token"]').getAttribute('content');
-        const resp = await fetch(url, {
-			method: 'POST',
-			headers: {
-				'Content-Type': 'application/json',
-				'X-CSRF-Token': csrfToken
-			},
-			body: JSON.stringify(body)
-		});
-        if (!resp.ok) alert('Failed to send command: ' + resp.statusText);
-    } catch (err) { alert('Error sending command: ' + err.message); }
+func NewCommandRegistry(max int, onChange func(CommandRecord)) *CommandRegistry {
+	return &CommandRegistry{
+		records:  make(map[string]*CommandRecord),
+		max:      max,
+		onChange: onChange,
+		changed:  make(chan struct{}),
+	}
 }
 
-document.addEventListener('click', (e) => {
-    const target = e.target.closest('[data-action]');
-    if (!target) return;
-    const { action, account, instrument, orderId } = target.dataset;
-    switch(action) {
-        case 'flatten-all': sendCommand('/api/flatten', {}); break;
-        case 'flatten-account': sendCommand('/api/flatten_account', { account }); break;
-        case 'close-position': sendCommand('/api/close_position', { account, instrument }); break;
-        case 'cancel-order': sendCommand('/api/cancel_order', { account, orderId }); break;
-    }
-});
-document.getElementById('flattenAll').dataset.action = 'flatten-all';
+func (reg *CommandRegistry) Add(cmd Command) CommandRecord {
+	now := time.Now()
+	created := now
+	if !cmd.IssuedAt.IsZero() {
+		created = cmd.IssuedAt
+	}
+	rec := &CommandRecord{
+		ID:        cmd.ID,
+		Type:      cmd.Type,
+		Payload:   cmd.Payload,
+		Status:    CommandPending,
+		CreatedAt: created,
+		ExpiresAt: cmd.expiresAt(),
+		UpdatedAt: now,
+		History:   []CommandEvent{{Status: CommandPending, At: now}},
+	}
 
-function render(data) {
-    const container = document.getElementById('accounts');
-    container.innerHTML = '';
-    for (const acc of Object.keys(data).sort()) {
-        const snap = data[acc];
-        const card = document.createElement('div');
-        card.className = 'card mb-3';
-        
-        let positionsTable = '<p class="text-label">No open positions.</p>';
-        if (snap.positions && snap.positions.length > 0) {
-            let rows = snap.positions.map(p => {
-                const pnlClass = p.unrealized >= 0 ? 'text-pnl-positive' : 'text-pnl-negative';
-                return '<tr>' +
-                    '<td>' + p.instrument + '</td>' +
-                    '<td>' + p.marketPosition + '</td>' +
-                    '<td>' + p.quantity + '</td>' +
-                    '<td>' + p.averagePrice.toFixed(2) + '</td>' +
-                    '<td>' + (p.currentPrice > 0 ? p.currentPrice.toFixed(2) : '--') + '</td>' +
-                    '<td><strong class="' + pnlClass + '">' + p.unrealized.toFixed(2) + '</strong></td>' +
-                    '<td><i class="bi bi-x-circle-fill text-pnl-negative action-btn" title="Close Position" data-action="close-position" data-account="' + acc + '" data-instrument="' + p.instrument + '"></i></td>' +
-                '</tr>';
-            }).join('');
-            positionsTable = '<h6>Positions</h6><table class="table table-sm table-hover">' +
-                '<thead><tr><th>Instrument</th><th>MP</th><th>Qty</th><th>Avg Price</th><th>Price</th><th>Unrealized</th><th></th></tr></thead>' +
-                '<tbody>' + rows + '</tbody></table>';
-        }
-        
-        let ordersTable = '<p class="text-label">No working orders.</p>';
+	reg.mu.Lock()
+	reg.records[cmd.ID] = rec
+	reg.order = append(reg.order, cmd.ID)
+	for len(reg.order) > reg.max {
+		delete(reg.records, reg.order[0])
+		reg.order = reg.order[1:]
+	}
+	snapshot := reg.copyLocked(rec)
+	reg.mu.Unlock()
+
+	reg.onChange(snapshot)
+	return snapshot
+}
+
+// Update moves a command to status unless that would move it backwards.
+// It reports whether the transition was applied.
+func (reg *CommandRegistry) Update(id, status, errText string) bool {
+	reg.mu.Lock()
+	rec, ok := reg.records[id]
+	if !ok || commandStatusRank[status] <= commandStatusRank[rec.Status] {
+		reg.mu.Unlock()
+		return false
+	}
+	now := time.Now()
+	rec.Status = status
+	rec.Error = errText
+	rec.UpdatedAt = now
+	rec.History = append(rec.History, CommandEvent{Status: status, Error: errText, At: now})
+	snapshot := reg.copyLocked(rec)
+	close(reg.changed)
+	reg.changed = make(chan struct{})
+	reg.mu.Unlock()
+
+	reg.onChange(snapshot)
+	return true
+}
+
+// AddConnections records the connection servers a command without an
+// account was handed to. Connections it already went to keep their status.
+func (reg *CommandRegistry) AddConnections(id string, names []string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	rec, ok := reg.records[id]
+	if !ok {
+		return
+	}
+	if rec.Connections == nil {
+		rec.Connections = make(map[string]string)
+	}
+	for _, name := range names {
+		if _, ok := rec.Connections[name]; !ok {
+			rec.Connections[name] = CommandDelivered
+		}
+	}
+}
+
+// UpdateConnection records the status one connection server reported for
+// a command sent to several, and returns the status the command as a whole
+// moves to: the first failure, or once every connection server has
+// acknowledged it, the least advanced of their statuses. apply is false
+// while some have yet to answer. A command sent to a single connection
+// server moves to status directly.
+func (reg *CommandRegistry) UpdateConnection(id, name, status, errText string) (string, string, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	rec, ok := reg.records[id]
+	if !ok || rec.Connections == nil {
+		return status, errText, true
+	}
+	if commandStatusRank[status] > commandStatusRank[rec.Connections[name]] {
+		rec.Connections[name] = status
+		if errText != "" {
+			if rec.connectionErrors == nil {
+				rec.connectionErrors = make(map[string]string)
+			}
+			rec.connectionErrors[name] = errText
+		}
+	}
+	names := make([]string, 0, len(rec.Connections))
+	for n := range rec.Connections {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	least := ""
+	for _, n := range names {
+		st := rec.Connections[n]
+		if commandFailures[st] {
+			return st, n + ": " + rec.connectionErrors[n], true
+		}
+		if least == "" || commandStatusRank[st] < commandStatusRank[least] {
+			least = st
+		}
+	}
+	return least, "", commandStatusRank[least] >= commandStatusRank[CommandAcknowledged]
+}
+
+// MarkSimulated flags a command as executed by a dry-run connection server.
+// The flag is published with the command's next transition.
+func (reg *CommandRegistry) MarkSimulated(id string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if rec, ok := reg.records[id]; ok {
+		rec.Simulated = true
+	}
+}
+
+func (reg *CommandRegistry) Get(id string) (CommandRecord, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	rec, ok := reg.records[id]
+	if !ok {
+		return CommandRecord{}, false
+	}
+	return reg.copyLocked(rec), true
+}
+
+// List returns the tracked commands, newest first.
+func (reg *CommandRegistry) List() []CommandRecord {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	list := make([]CommandRecord, 0, len(reg.order))
+	for i := len(reg.order) - 1; i >= 0; i-- {
+		list = append(list, reg.copyLocked(reg.records[reg.order[i]]))
+	}
+	return list
+}
+
+// Wait blocks until done reports true for the command or timeout elapses,
+// and returns the command as it then stands.
+func (reg *CommandRegistry) Wait(id string, timeout time.Duration, done func(CommandRecord) bool) CommandRecord {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		reg.mu.Lock()
+		rec, ok := reg.records[id]
+		if !ok {
+			reg.mu.Unlock()
+			return CommandRecord{ID: id}
+		}
+		snapshot := reg.copyLocked(rec)
+		changed := reg.changed
+		reg.mu.Unlock()
+		if done(snapshot) {
+			return snapshot
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return snapshot
+		}
+	}
+}
+
+// ExpirePending marks commands that have not been acknowledged within
+// timeout as timed out. Queued commands wait for a connection server and
+// expire by their TTL instead.
+func (reg *CommandRegistry) ExpirePending(timeout time.Duration) {
+	var expired []string
+	reg.mu.Lock()
+	for _, rec := range reg.records {
+		if rec.Status == CommandQueued {
+			continue
+		}
+		if commandStatusRank[rec.Status] < commandStatusRank[CommandTimedOut] && time.Since(rec.CreatedAt) > timeout {
+			expired = append(expired, rec.ID)
+		}
+	}
+	reg.mu.Unlock()
+
+	for _, id := range expired {
+		reg.Update(id, CommandTimedOut, fmt.Sprintf("no acknowledgment within %v", timeout))
+	}
+}
+
+func (reg *CommandRegistry) copyLocked(rec *CommandRecord) CommandRecord {
+	c := *rec
+	c.History = append([]CommandEvent(nil), rec.History...)
+	if rec.Connections != nil {
+		c.Connections = make(map[string]string, len(rec.Connections))
+		for name, status := range rec.Connections {
+			c.Connections[name] = status
+		}
+	}
+	c.connectionErrors = nil
+	return c
+}
+
+// CommandQueue holds commands until a connection server acknowledges them,
+// so that commands issued while no connection server is connected are
+// delivered when one reconnects. It is persisted to survive restarts.
+type CommandQueue struct {
+	mu       sync.Mutex
+	path     string
+	max      int
+	commands []Command
+}
+
+func NewCommandQueue(path string, max int) (*CommandQueue, error) {
+	q := &CommandQueue{path: path, max: max}
+	return q, readJSONFile(path, &q.commands)
+}
+
+func (q *CommandQueue) Push(cmd Command) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.commands) >= q.max {
+		return fmt.Errorf("command queue is full (%d commands waiting)", len(q.commands))
+	}
+	q.commands = append(q.commands, cmd)
+	if err := writeJSONFile(q.path, q.commands); err != nil {
+		q.commands = q.commands[:len(q.commands)-1]
+		return fmt.Errorf("failed to persist command queue: %w", err)
+	}
+	return nil
+}
+
+// Remove drops the command with id and reports whether it was queued.
+func (q *CommandQueue) Remove(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, cmd := range q.commands {
+		if cmd.ID == id {
+			q.commands = append(q.commands[:i], q.commands[i+1:]...)
+			if err := writeJSONFile(q.path, q.commands); err != nil {
+				log.Printf("Failed to persist command queue: %v", err)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the queued commands, oldest first.
+func (q *CommandQueue) List() []Command {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]Command(nil), q.commands...)
+}
+
+// Schedule dispatches a command at a wall-clock time in a timezone, either
+// once on Date or on every listed weekday.
+type Schedule struct {
+	ID       string                 `json:"id"`
+	Name     string                 `json:"name"`
+	Type     string                 `json:"type"`
+	Payload  map[string]interface{} `json:"payload"`
+	Time     string                 `json:"time"`
+	Timezone string                 `json:"timezone"`
+	Days     []string               `json:"days,omitempty"`
+	Date     string                 `json:"date,omitempty"`
+	Enabled  bool                   `json:"enabled"`
+	NextRun  *time.Time             `json:"nextRun,omitempty"`
+	LastRun  *time.Time             `json:"lastRun,omitempty"`
+	// LastCommandID links the last dispatch to the command log
+	LastCommandID string `json:"lastCommandId,omitempty"`
+}
+
+// automatedCommands lists the command types schedules and rules may issue
+// and whether they need an account.
+var automatedCommands = map[string]bool{
+	"flatten_all":       false,
+	"flatten_account":   true,
+	"close_position":    true,
+	"cancel_all_orders": true,
+	"disarm_trail":      true,
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// scheduleMissedGrace is how late a schedule may still fire, e.g. after a
+// dashboard restart. Older runs are skipped rather than executed late.
+const scheduleMissedGrace = 2 * time.Minute
+
+func (sc *Schedule) validate() error {
+	sc.Name = strings.TrimSpace(sc.Name)
+	if sc.Payload == nil {
+		sc.Payload = make(map[string]interface{})
+	}
+	needsAccount, ok := automatedCommands[sc.Type]
+	if !ok {
+		return fmt.Errorf("command type %q cannot be scheduled", sc.Type)
+	}
+	if account, _ := sc.Payload["account"].(string); needsAccount && account == "" {
+		return fmt.Errorf("account is required for %s", sc.Type)
+	}
+	if instrument, _ := sc.Payload["instrument"].(string); (sc.Type == "close_position" || sc.Type == "disarm_trail") && instrument == "" {
+		return fmt.Errorf("instrument is required for %s", sc.Type)
+	}
+	if sc.Timezone == "" {
+		sc.Timezone = "America/Chicago"
+	}
+	if _, err := time.LoadLocation(sc.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q", sc.Timezone)
+	}
+	if _, err := time.Parse("15:04", sc.Time); err != nil {
+		return fmt.Errorf("invalid time %q: must be HH:MM", sc.Time)
+	}
+	if sc.Date == "" && len(sc.Days) == 0 {
+		return fmt.Errorf("a date or at least one weekday is required")
+	}
+	if sc.Date != "" {
+		if _, err := time.Parse("2006-01-02", sc.Date); err != nil {
+			return fmt.Errorf("invalid date %q: must be YYYY-MM-DD", sc.Date)
+		}
+	}
+	for i, day := range sc.Days {
+		key := strings.ToLower(strings.TrimSpace(day))
+		if len(key) > 3 {
+			key = key[:3]
+		}
+		if _, ok := weekdays[key]; !ok {
+			return fmt.Errorf("invalid weekday %q", day)
+		}
+		sc.Days[i] = strings.ToUpper(key[:1]) + key[1:]
+	}
+	return nil
+}
+
+// next returns the first run strictly after after, or nil if the schedule
+// will not run again. validate must have been called first.
+func (sc *Schedule) next(after time.Time) *time.Time {
+	loc, err := time.LoadLocation(sc.Timezone)
+	if err != nil {
+		return nil
+	}
+	clock, _ := time.Parse("15:04", sc.Time)
+	at := func(y int, m time.Month, d int) time.Time {
+		t := time.Date(y, m, d, clock.Hour(), clock.Minute(), 0, 0, loc)
+		// A time skipped when clocks go forward may come back on the
+		// wall clock before the change; run it after the change instead.
+		wall := time.Date(y, m, d, clock.Hour(), clock.Minute(), 0, 0, time.UTC)
+		got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+		if early := wall.Sub(got); early > 0 {
+			t = t.Add(early)
+		}
+		return t
+	}
+	if sc.Date != "" {
+		date, _ := time.Parse("2006-01-02", sc.Date)
+		t := at(date.Date())
+		if !t.After(after) {
+			return nil
+		}
+		return &t
+	}
+	local := after.In(loc)
+	for i := 0; i <= 7; i++ {
+		day := local.AddDate(0, 0, i)
+		t := at(day.Date())
+		if !t.After(after) {
+			continue
+		}
+		for _, name := range sc.Days {
+			if weekdays[strings.ToLower(name)] == t.Weekday() {
+				return &t
+			}
+		}
+	}
+	return nil
+}
+
+// Rule issues a command when a condition over an account's snapshot becomes
+// true. Conditions are clauses joined by "and", each "<field> <op> <number>"
+// where op is one of < <= > >= == != or "crosses", e.g.
+// "unrealized < -800" or "position.currentPrice crosses 6000". A rule fires
+// when its condition turns true; a repeating rule fires again only after the
+// condition has been false in between, a one-shot rule disarms itself.
+type Rule struct {
+	ID         string                 `json:"id"`
+	Name       string                 `json:"name"`
+	Account    string                 `json:"account"`
+	Instrument string                 `json:"instrument,omitempty"`
+	Condition  string                 `json:"condition"`
+	Type       string                 `json:"type"`
+	Payload    map[string]interface{} `json:"payload"`
+	Armed      bool                   `json:"armed"`
+	Repeat     bool                   `json:"repeat"`
+	LastFired  *time.Time             `json:"lastFired,omitempty"`
+	FireCount  int                    `json:"fireCount"`
+
+	clauses []ruleClause
+	prev    map[string]float64
+	active  bool
+}
+
+type ruleClause struct {
+	field string
+	op    string
+	value float64
+}
+
+// RuleFiring records one time a rule fired.
+type RuleFiring struct {
+	RuleID    string    `json:"ruleId"`
+	Name      string    `json:"name"`
+	Account   string    `json:"account"`
+	Condition string    `json:"condition"`
+	Values    string    `json:"values"`
+	CommandID string    `json:"commandId"`
+	Time      time.Time `json:"time"`
+}
+
+// ruleFields maps the lower-cased field names a condition may use to their
+// canonical spelling. position.* fields refer to the rule's instrument.
+var ruleFields = map[string]string{
+	"balance":               "balance",
+	"realized":              "realized",
+	"unrealized":            "unrealized",
+	"position.quantity":     "position.quantity",
+	"position.averageprice": "position.averagePrice",
+	"position.unrealized":   "position.unrealized",
+	"position.currentprice": "position.currentPrice",
+}
+
+var ruleOps = map[string]bool{"<": true, "<=": true, ">": true, ">=": true, "==": true, "!=": true, "crosses": true}
+
+// ruleEpsilon is how close a value must be to a clause's number for == and
+// != to treat them as equal, since P/L and prices arrive as sums of floats.
+const ruleEpsilon = 1e-6
+
+// maxRuleFirings is how many rule firings are kept.
+const maxRuleFirings = 100
+
+func parseCondition(expr string) ([]ruleClause, error) {
+	var clauses []ruleClause
+	var current []string
+	flush := func() error {
+		if len(current) != 3 {
+			return fmt.Errorf("invalid clause %q: expected <field> <op> <number>", strings.Join(current, " "))
+		}
+		field, ok := ruleFields[strings.ToLower(current[0])]
+		if !ok {
+			return fmt.Errorf("unknown field %q", current[0])
+		}
+		op := strings.ToLower(current[1])
+		if !ruleOps[op] {
+			return fmt.Errorf("unknown operator %q", current[1])
+		}
+		value, err := strconv.ParseFloat(current[2], 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", current[2])
+		}
+		clauses = append(clauses, ruleClause{field: field, op: op, value: value})
+		current = nil
+		return nil
+	}
+	for _, tok := range strings.Fields(expr) {
+		if strings.EqualFold(tok, "and") {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		current = append(current, tok)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return clauses, nil
+}
+
+func (ru *Rule) validate() error {
+	ru.Name = strings.TrimSpace(ru.Name)
+	ru.Account = strings.TrimSpace(ru.Account)
+	ru.Instrument = strings.TrimSpace(ru.Instrument)
+	if ru.Account == "" {
+		return fmt.Errorf("account is required")
+	}
+	clauses, err := parseCondition(ru.Condition)
+	if err != nil {
+		return err
+	}
+	for _, c := range clauses {
+		if strings.HasPrefix(c.field, "position.") && ru.Instrument == "" {
+			return fmt.Errorf("instrument is required for %s", c.field)
+		}
+	}
+	if ru.Payload == nil {
+		ru.Payload = make(map[string]interface{})
+	}
+	needsAccount, ok := automatedCommands[ru.Type]
+	if !ok {
+		return fmt.Errorf("command type %q cannot be triggered by a rule", ru.Type)
+	}
+	if account, _ := ru.Payload["account"].(string); needsAccount && account == "" {
+		ru.Payload["account"] = ru.Account
+	}
+	if instrument, _ := ru.Payload["instrument"].(string); (ru.Type == "close_position" || ru.Type == "disarm_trail") && instrument == "" {
+		if ru.Instrument == "" {
+			return fmt.Errorf("instrument is required for %s", ru.Type)
+		}
+		ru.Payload["instrument"] = ru.Instrument
+	}
+	ru.clauses = clauses
+	ru.prev = nil
+	ru.active = false
+	return nil
+}
+
+// ruleValues returns the fields a condition can refer to. position.* fields
+// are missing when there is no open position in instrument.
+func ruleValues(snap Snapshot, instrument string) map[string]float64 {
+	values := map[string]float64{
+		"balance":    snap.Balance,
+		"realized":   snap.Realized,
+		"unrealized": snap.Unrealized,
+	}
+	for _, p := range snap.Positions {
+		if p.Instrument == instrument && p.MarketPosition != "Flat" && p.Quantity > 0 {
+			values["position.quantity"] = float64(p.Quantity)
+			values["position.averagePrice"] = p.AveragePrice
+			values["position.unrealized"] = p.Unrealized
+			values["position.currentPrice"] = p.CurrentPrice
+		}
+	}
+	return values
+}
+
+// evaluate reports whether the rule should fire for values, and remembers
+// them for crossing checks and edge detection.
+func (ru *Rule) evaluate(values map[string]float64) bool {
+	result := true
+	for _, c := range ru.clauses {
+		v, ok := values[c.field]
+		prev, hadPrev := ru.prev[c.field]
+		var holds bool
+		switch c.op {
+		case "<":
+			holds = ok && v < c.value
+		case "<=":
+			holds = ok && v <= c.value
+		case ">":
+			holds = ok && v > c.value
+		case ">=":
+			holds = ok && v >= c.value
+		case "==":
+			holds = ok && math.Abs(v-c.value) < ruleEpsilon
+		case "!=":
+			holds = ok && math.Abs(v-c.value) >= ruleEpsilon
+		case "crosses":
+			holds = ok && hadPrev && (prev < c.value && v >= c.value || prev > c.value && v <= c.value)
+		}
+		result = result && holds
+	}
+	ru.prev = values
+
+	fire := result && !ru.active
+	ru.active = result
+	return fire
+}
+
+// describeValues renders the values a rule's clauses refer to for the log.
+func (ru *Rule) describeValues(values map[string]float64) string {
+	var parts []string
+	for _, c := range ru.clauses {
+		if v, ok := values[c.field]; ok {
+			parts = append(parts, c.field+"="+strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Macro is a named sequence of steps run in order against one account.
+// Each command step waits for the connection server's acknowledgment (or
+// verification) and the macro stops at the first step that fails.
+type Macro struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Steps       []MacroStep `json:"steps"`
+}
+
+// MacroStep issues a command of Type, or with Type "lockout" blocks new
+// orders on the account for Duration. WaitFor is "acknowledged" (default)
+// or "verified" for commands whose effect the connection server verifies.
+type MacroStep struct {
+	Type     string                 `json:"type"`
+	Payload  map[string]interface{} `json:"payload,omitempty"`
+	WaitFor  string                 `json:"waitFor,omitempty"`
+	Duration string                 `json:"duration,omitempty"`
+}
+
+// MacroRun tracks one execution of a macro.
+type MacroRun struct {
+	ID         string         `json:"id"`
+	Macro      string         `json:"macro"`
+	Account    string         `json:"account"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	Steps      []MacroRunStep `json:"steps"`
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt *time.Time     `json:"finishedAt,omitempty"`
+}
+
+type MacroRunStep struct {
+	Type      string `json:"type"`
+	CommandID string `json:"commandId,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// orderEntryCommands are the commands a lockout blocks.
+var orderEntryCommands = map[string]bool{
+	"place_order":      true,
+	"place_bracket":    true,
+	"place_atm_order":  true,
+	"reverse_position": true,
+}
+
+// errLockedOut rejects new orders on an account under a lockout.
+var errLockedOut = errors.New("locked out")
+
+// verifiedCommands are the command types the connection server verifies
+// against later snapshots.
+var verifiedCommands = map[string]bool{
+	"flatten_account":   true,
+	"close_position":    true,
+	"cancel_order":      true,
+	"cancel_all_orders": true,
+}
+
+func (m *Macro) validate() error {
+	m.Name = strings.TrimSpace(m.Name)
+	if m.Name == "" || strings.Contains(m.Name, "/") {
+		return fmt.Errorf("a name without '/' is required")
+	}
+	if len(m.Steps) == 0 {
+		return fmt.Errorf("at least one step is required")
+	}
+	for i := range m.Steps {
+		step := &m.Steps[i]
+		if step.Type == "lockout" {
+			d, err := time.ParseDuration(step.Duration)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("step %d: lockout needs a positive duration such as 10m", i+1)
+			}
+			continue
+		}
+		if _, ok := automatedCommands[step.Type]; !ok {
+			return fmt.Errorf("step %d: command type %q cannot be used in a macro", i+1, step.Type)
+		}
+		switch step.WaitFor {
+		case "":
+			step.WaitFor = CommandAcknowledged
+		case CommandAcknowledged:
+		case CommandVerified:
+			if !verifiedCommands[step.Type] {
+				return fmt.Errorf("step %d: %s is not verified by the connection server", i+1, step.Type)
+			}
+		default:
+			return fmt.Errorf("step %d: waitFor must be acknowledged or verified", i+1)
+		}
+	}
+	return nil
+}
+
+var loginTpl = template.Must(template.New("login").Parse(`
+<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>NinjaTrader Login</title>
+<meta name="viewport" content="width=device-width,initial-scale=1">
+<link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.2/dist/css/bootstrap.min.css" rel="stylesheet">
+<style>
+body { background: #f8f9fa; }
+.login-container { max-width: 400px; margin: 100px auto; }
+.card { box-shadow: 0 4px 6px rgba(0,0,0,0.1); }
+</style>
+</head>
+<body>
+<div class="login-container">
+    <div class="card">
+        <div class="card-body">
+            <h4 class="card-title text-center mb-4">NinjaTrader Dashboard</h4>
+            {{if .Error}}<div class="alert alert-danger">{{.Error}}</div>{{end}}
+            <form method="POST" action="/login">
+                <div class="mb-3">
+                    <label for="username" class="form-label">Username</label>
+                    <input type="text" class="form-control" id="username" name="username" required>
+                </div>
+                <div class="mb-3">
+                    <label for="password" class="form-label">Password</label>
+                    <input type="password" class="form-control" id="password" name="password" required>
+                </div>
+                <button type="submit" class="btn btn-primary w-100">Login</button>
+            </form>
+        </div>
+    </div>
+</div>
+</body>
+</html>
+`))
+
+var tpl = template.Must(template.New("dash").Parse(`
+<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>NT8 Remote Dashboard</title>
+<meta name="viewport" content="width=device-width,initial-scale=1">
+<meta name="csrf-token" content="{{.CSRFToken}}">
+<link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.2/dist/css/bootstrap.min.css" rel="stylesheet">
+<link href="https://cdn.jsdelivr.net/npm/bootstrap-icons@1.11.3/font/bootstrap-icons.min.css" rel="stylesheet">
+<style>
+/* Base Styles */
+body { transition: background-color 0.3s, color 0.3s; }
+.action-btn { cursor: pointer; }
+
+/* --- Light Mode Styles --- */
+body { background-color: #f8f9fa; }
+.text-label { color: #6c757d !important; }
+.text-normal { color: #212529 !important; }
+.text-pnl-positive { color: #198754 !important; }
+.text-pnl-negative { color: #dc3545 !important; }
+.table-danger-custom { background-color: rgba(220, 53, 69, 0.15) !important; }
+.table-success-custom { background-color: rgba(25, 135, 84, 0.15) !important; }
+
+/* --- Dark Mode Styles --- */
+body.dark-mode { background-color: #212529; color: #dee2e6; }
+body.dark-mode .card { background-color: #343a40; border-color: #495057; }
+body.dark-mode .card-title, body.dark-mode h3, body.dark-mode h6, body.dark-mode th { color: #f8f9fa; }
+body.dark-mode .text-label { color: #adb5bd !important; }
+body.dark-mode .text-normal, body.dark-mode td { color: #dee2e6 !important; }
+body.dark-mode .text-pnl-positive { color: #52b788 !important; }
+body.dark-mode .text-pnl-negative { color: #e57373 !important; }
+body.dark-mode .table { border-color: #495057; }
+body.dark-mode .table > :not(caption) > * > * { background-color: #343a40; border-color: #495057;}
+body.dark-mode .table-hover > tbody > tr:hover > * { background-color: #495057; color: #f8f9fa; }
+body.dark-mode .form-check-label { color: #dee2e6; }
+body.dark-mode hr { border-top: 1px solid rgba(255, 255, 255, 0.1); }
+body.dark-mode .text-muted { color: #6c757d !important; }
+body.dark-mode .table-danger-custom { background-color: rgba(220, 53, 69, 0.3) !important; }
+body.dark-mode .table-success-custom { background-color: rgba(25, 135, 84, 0.3) !important; }
+</style>
+</head>
+<body>
+<div class="container py-4">
+    <div class="d-flex justify-content-between align-items-center">
+        <h3>NinjaTrader Cloud Dashboard (Railway)</h3>
+        <div class="d-flex align-items-center gap-3">
+            <div class="form-check form-switch"><input class="form-check-input" type="checkbox" role="switch" id="darkModeToggle"><label class="form-check-label" for="darkModeToggle">Dark Mode</label></div>
+            <a href="/logout" class="btn btn-outline-secondary btn-sm">Logout</a>
+        </div>
+    </div>
+    <div id="alerts" class="mt-3"></div>
+    <div id="commandQueue" class="alert alert-warning py-2 mb-2 small d-none"></div>
+    <div class="card mt-3">
+        <div class="card-body">
+            <h6 class="card-title">Order Ticket</h6>
+            <form id="orderTicket" class="row g-2 align-items-end">
+                <div class="col-6 col-md-3"><label class="form-label small text-label" for="otAccount">Account</label><select class="form-select form-select-sm" id="otAccount" required></select></div>
+                <div class="col-6 col-md-3"><label class="form-label small text-label" for="otInstrument">Instrument</label><input class="form-control form-control-sm" id="otInstrument" placeholder="ES 12-26" required></div>
+                <div class="col-4 col-md-2"><label class="form-label small text-label" for="otAction">Action</label><select class="form-select form-select-sm" id="otAction"><option>BUY</option><option>SELL</option></select></div>
+                <div class="col-4 col-md-2"><label class="form-label small text-label" for="otQuantity">Qty</label><input class="form-control form-control-sm" id="otQuantity" type="number" min="1" step="1" value="1" required></div>
+                <div class="col-4 col-md-2"><label class="form-label small text-label" for="otType">Type</label><select class="form-select form-select-sm" id="otType"><option value="MARKET">Market</option><option value="LIMIT">Limit</option><option value="STOPMARKET">Stop Market</option><option value="STOPLIMIT">Stop Limit</option></select></div>
+                <div class="col-4 col-md-2"><label class="form-label small text-label" for="otLimit">Limit</label><input class="form-control form-control-sm" id="otLimit" type="number" step="any"></div>
+                <div class="col-4 col-md-2"><label class="form-label small text-label" for="otStop">Stop</label><input class="form-control form-control-sm" id="otStop" type="number" step="any"></div>
+                <div class="col-4 col-md-2"><label class="form-label small text-label" for="otTif">TIF</label><select class="form-select form-select-sm" id="otTif"><option>DAY</option><option>GTC</option></select></div>
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="otOco">OCO</label><input class="form-control form-control-sm" id="otOco"></div>
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="otStrategy">ATM Template</label><select class="form-select form-select-sm" id="otStrategy"><option value="">(none)</option>{{range .ATMTemplates}}<option>{{.}}</option>{{end}}</select></div>
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="otStopLoss">Stop Loss</label><input class="form-control form-control-sm" id="otStopLoss" type="number" step="any"></div>
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="otTarget">Target</label><input class="form-control form-control-sm" id="otTarget" type="number" step="any"></div>
+                <div class="col-6 col-md-2"><button type="submit" value="order" class="btn btn-primary btn-sm w-100">Place Order</button></div>
+                <div class="col-6 col-md-2"><button type="submit" value="bracket" class="btn btn-outline-primary btn-sm w-100" title="Entry (Market or Limit) with OCO stop loss and target">Place Bracket</button></div>
+            </form>
+        </div>
+    </div>
+    <div class="card mt-3">
+        <div class="card-body">
+            <h6 class="card-title">ATM Strategies</h6>
+            <div id="atmStrategies"><p class="text-label small mb-2">No ATM strategies started from this dashboard.</p></div>
+            <form id="closeStrategyForm" class="row g-2 align-items-end">
+                <div class="col-8 col-md-4"><input class="form-control form-control-sm" id="csStrategyId" placeholder="Strategy ID" required></div>
+                <div class="col-4 col-md-2"><button type="submit" class="btn btn-outline-danger btn-sm w-100">Close Strategy</button></div>
+            </form>
+        </div>
+    </div>
+    <div class="card mt-3">
+        <div class="card-body">
+            <h6 class="card-title">Scheduled Commands</h6>
+            <div id="schedules"><p class="text-label small mb-2">No scheduled commands.</p></div>
+            <form id="scheduleForm" class="row g-2 align-items-end">
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="schName">Name</label><input class="form-control form-control-sm" id="schName" placeholder="Flat before close"></div>
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="schType">Command</label><select class="form-select form-select-sm" id="schType"><option value="flatten_account">Flatten account</option><option value="cancel_all_orders">Cancel orders</option><option value="close_position">Close position</option><option value="flatten_all">Flatten ALL</option></select></div>
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="schAccount">Account</label><select class="form-select form-select-sm" id="schAccount"></select></div>
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="schInstrument">Instrument</label><input class="form-control form-control-sm" id="schInstrument" placeholder="(all)"></div>
+                <div class="col-4 col-md-1"><label class="form-label small text-label" for="schTime">Time</label><input class="form-control form-control-sm" id="schTime" type="time" value="15:55" required></div>
+                <div class="col-8 col-md-3"><label class="form-label small text-label" for="schTimezone">Timezone</label><input class="form-control form-control-sm" id="schTimezone" value="America/Chicago" required></div>
+                <div class="col-6 col-md-3"><label class="form-label small text-label" for="schDays">Weekdays</label><input class="form-control form-control-sm" id="schDays" value="Mon,Tue,Wed,Thu,Fri"></div>
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="schDate">Or once on</label><input class="form-control form-control-sm" id="schDate" type="date"></div>
+                <div class="col-6 col-md-2"><button type="submit" class="btn btn-outline-primary btn-sm w-100">Add Schedule</button></div>
+            </form>
+        </div>
+    </div>
+    <div class="card mt-3">
+        <div class="card-body">
+            <h6 class="card-title">Rules</h6>
+            <div id="rules"><p class="text-label small mb-2">No rules defined.</p></div>
+            <form id="ruleForm" class="row g-2 align-items-end">
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="ruName">Name</label><input class="form-control form-control-sm" id="ruName" placeholder="Max loss"></div>
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="ruAccount">Account</label><select class="form-select form-select-sm" id="ruAccount" required></select></div>
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="ruInstrument">Instrument</label><input class="form-control form-control-sm" id="ruInstrument" placeholder="ES 12-26"></div>
+                <div class="col-6 col-md-3"><label class="form-label small text-label" for="ruCondition">Condition</label><input class="form-control form-control-sm" id="ruCondition" placeholder="unrealized < -800" title="Clauses joined by 'and': balance, realized, unrealized, position.quantity, position.averagePrice, position.unrealized, position.currentPrice; operators &lt; &lt;= &gt; &gt;= == != crosses" required></div>
+                <div class="col-6 col-md-2"><label class="form-label small text-label" for="ruType">Then</label><select class="form-select form-select-sm" id="ruType"><option value="flatten_account">Flatten account</option><option value="close_position">Close position</option><option value="cancel_all_orders">Cancel orders</option><option value="flatten_all">Flatten ALL</option></select></div>
+                <div class="col-3 col-md-1"><div class="form-check"><input class="form-check-input" type="checkbox" id="ruRepeat"><label class="form-check-label small" for="ruRepeat">Repeat</label></div></div>
+                <div class="col-6 col-md-2"><button type="submit" class="btn btn-outline-primary btn-sm w-100">Add Rule</button></div>
+            </form>
+            <div id="ruleFirings" class="small mt-2"></div>
+        </div>
+    </div>
+    <div class="card mt-3">
+        <div class="card-body">
+            <h6 class="card-title">Macros</h6>
+            <div id="macros"><p class="text-label small mb-2">No macros defined.</p></div>
+            <form id="macroRunForm" class="row g-2 align-items-end mb-2">
+                <div class="col-6 col-md-3"><label class="form-label small text-label" for="maName">Macro</label><select class="form-select form-select-sm" id="maName" required></select></div>
+                <div class="col-6 col-md-3"><label class="form-label small text-label" for="maAccount">Account</label><select class="form-select form-select-sm" id="maAccount" required></select></div>
+                <div class="col-6 col-md-2"><button type="submit" class="btn btn-outline-danger btn-sm w-100">Run Macro</button></div>
+            </form>
+            <details>
+                <summary class="small text-label">Define macro</summary>
+                <form id="macroForm" class="mt-2">
+                    <textarea class="form-control form-control-sm font-monospace" id="maDefinition" rows="6" required>{"name": "flat-and-lock", "description": "Cancel orders, flatten and lock out for 30 minutes", "steps": [{"type": "cancel_all_orders"}, {"type": "flatten_account", "waitFor": "verified"}, {"type": "lockout", "duration": "30m"}]}</textarea>
+                    <button type="submit" class="btn btn-outline-primary btn-sm mt-2">Save Macro</button>
+                </form>
+            </details>
+            <div id="macroRuns" class="small mt-2"></div>
+        </div>
+    </div>
+    <div class="d-flex justify-content-end align-items-center gap-2 mt-3">
+        <span id="totalExposure" class="small me-auto"></span>
+        <label class="small text-label" for="nudgeTicks">Nudge ticks</label>
+        <input class="form-control form-control-sm" id="nudgeTicks" type="number" min="1" step="1" value="1" style="width: 5rem">
+    </div>
+    <div id="accounts" class="mt-2"></div>
+    <div class="card mt-3">
+        <div class="card-body">
+            <h6 class="card-title">Command Log</h6>
+            <div id="commandLog"><p class="text-label small mb-0">No commands sent yet.</p></div>
+        </div>
+    </div>
+    <div class="card mt-3">
+        <div class="card-body">
+            <h6 class="card-title">Order Events <span class="text-label small">(NinjaTrader ATI)</span></h6>
+            <div id="orderEvents"><p class="text-label small mb-0">No order events yet.</p></div>
+        </div>
+    </div>
+    <div class="mt-4"><button id="flattenAll" class="btn btn-danger" data-action="flatten-all">Emergency Flatten (ALL Accounts)</button></div>
+    <p class="text-muted small mt-3">Connected: <span id="status">--</span> | Last Update: <span id="lastUpdate">--</span></p>
+</div>
+
+<script>
+const darkModeToggle = document.getElementById('darkModeToggle');
+const body = document.body;
+function setDarkMode(isDark) {
+    localStorage.setItem('theme', isDark ? 'dark' : 'light');
+    body.classList.toggle('dark-mode', isDark);
+    darkModeToggle.checked = isDark;
+}
+darkModeToggle.addEventListener('click', () => setDarkMode(darkModeToggle.checked));
+setDarkMode(localStorage.getItem('theme') === 'dark');
+
+let evt = new EventSource('/events');
+evt.onopen = () => { document.getElementById('status').innerText = 'connected'; };
+evt.onerror = () => { document.getElementById('status').innerText = 'disconnected'; };
+evt.onmessage = function(e){
+    document.getElementById('lastUpdate').innerText = new Date().toLocaleTimeString();
+    try { render(JSON.parse(e.data)); } catch(err) { console.error('Parse error:', err); }
+};
+
+const commandLog = new Map();
+const commandBadges = {
+    pending: 'text-bg-secondary', queued: 'text-bg-warning', delivered: 'text-bg-info', acknowledged: 'text-bg-success',
+    failed: 'text-bg-danger', timed_out: 'text-bg-warning',
+    verified: 'text-bg-success', not_verified: 'text-bg-danger', not_consumed: 'text-bg-danger',
+    rejected: 'text-bg-danger', expired: 'text-bg-warning'
+};
+
+const alertClasses = { error: 'alert-danger', warning: 'alert-warning', info: 'alert-info' };
+let alerts = [];
+evt.addEventListener('alert', (e) => {
+    try { alerts.push(JSON.parse(e.data)); renderAlerts(); } catch(err) { console.error('Parse error:', err); }
+});
+
+async function loadAlerts() {
+    try {
+        const resp = await fetch('/api/alerts');
+        if (!resp.ok) return;
+        alerts = await resp.json();
+        renderAlerts();
+    } catch (err) { console.error('Failed to load alerts:', err); }
+}
+loadAlerts();
+
+function renderAlerts() {
+    const recent = alerts.filter(a => !a.dismissed).slice(-5).reverse();
+    document.getElementById('alerts').innerHTML = recent.map(a =>
+        '<div class="alert ' + (alertClasses[a.level] || 'alert-secondary') + ' alert-dismissible py-2 mb-2 small">' +
+            '<strong>' + new Date(a.time).toLocaleTimeString() + ' ' + a.source + (a.account ? ' ' + a.account : '') + ':</strong> ' + a.message +
+            '<button type="button" class="btn-close py-2" data-action="dismiss-alert" data-time="' + a.time + '" data-message="' + encodeURIComponent(a.message) + '"></button>' +
+        '</div>').join('');
+}
+evt.addEventListener('command', (e) => {
+    try { upsertCommand(JSON.parse(e.data)); } catch(err) { console.error('Parse error:', err); }
+});
+
+function upsertCommand(rec) {
+    commandLog.set(rec.id, rec);
+    renderCommandLog();
+}
+
+async function loadCommands() {
+    try {
+        const resp = await fetch('/api/commands');
+        if (!resp.ok) return;
+        for (const rec of (await resp.json()).reverse()) commandLog.set(rec.id, rec);
+        renderCommandLog();
+    } catch (err) { console.error('Failed to load commands:', err); }
+}
+loadCommands();
+
+function renderCommandQueue() {
+    const queued = Array.from(commandLog.values()).filter(r => r.status === 'queued');
+    const el = document.getElementById('commandQueue');
+    el.classList.toggle('d-none', queued.length === 0);
+    el.innerHTML = '<strong>' + queued.length + ' command(s) waiting for a connection server:</strong> ' +
+        queued.map(r => r.type + (r.expiresAt ? ' (expires ' + new Date(r.expiresAt).toLocaleTimeString() + ')' : '')).join(', ');
+}
+
+function renderCommandLog() {
+    renderCommandQueue();
+    const container = document.getElementById('commandLog');
+    const recs = Array.from(commandLog.values()).sort((a, b) => new Date(b.createdAt) - new Date(a.createdAt)).slice(0, 25);
+    if (recs.length === 0) return;
+    container.innerHTML = '<table class="table table-sm table-hover mb-0"><thead><tr><th>Time</th><th>Command</th><th>Target</th><th>Status</th><th>Details</th></tr></thead><tbody>' +
+        recs.map(r => {
+            const p = r.payload || {};
+            const target = [p.account, p.instrument, p.orderId, p.strategyId].filter(Boolean).join(' ');
+            return '<tr>' +
+                '<td>' + new Date(r.createdAt).toLocaleTimeString() + '</td>' +
+                '<td>' + r.type + '</td>' +
+                '<td>' + (target || 'ALL') + '</td>' +
+                '<td><span class="badge ' + (commandBadges[r.status] || 'text-bg-secondary') + '">' + r.status.replace('_', ' ') + '</span>' +
+                    (r.simulated ? ' <span class="badge text-bg-warning">simulated</span>' : '') + '</td>' +
+                '<td class="small">' + (r.error || Object.entries(r.connections || {}).map(([name, status]) => name + ': ' + status.replace('_', ' ')).join(', ')) + '</td>' +
+            '</tr>';
+        }).join('') + '</tbody></table>';
+}
+
+let orderEvents = [];
+evt.addEventListener('order_event', (e) => {
+    try { orderEvents.push(JSON.parse(e.data)); renderOrderEvents(); } catch(err) { console.error('Parse error:', err); }
+});
+
+async function loadOrderEvents() {
+    try {
+        const resp = await fetch('/api/order_events');
+        if (!resp.ok) return;
+        orderEvents = await resp.json();
+        renderOrderEvents();
+    } catch (err) { console.error('Failed to load order events:', err); }
+}
+loadOrderEvents();
+
+function renderOrderEvents() {
+    const recent = orderEvents.slice(-20).reverse();
+    if (recent.length === 0) return;
+    document.getElementById('orderEvents').innerHTML = '<table class="table table-sm table-hover mb-0"><thead><tr><th>Time</th><th>Account</th><th>Order / Instrument</th><th>State</th><th>Qty</th><th>Price</th></tr></thead><tbody>' +
+        recent.map(ev => {
+            const isOrder = ev.kind === 'order';
+            const state = isOrder ? ev.state : ev.marketPosition;
+            const rowClass = /REJECTED/i.test(state) ? 'table-danger-custom' : (/FILLED/i.test(state) ? 'table-success-custom' : '');
+            const price = isOrder ? ev.averageFillPrice : ev.averagePrice;
+            return '<tr class="' + rowClass + '">' +
+                '<td>' + new Date(ev.time).toLocaleTimeString() + '</td>' +
+                '<td>' + (ev.account || '--') + '</td>' +
+                '<td>' + (isOrder ? ev.orderId : ev.instrument) + '</td>' +
+                '<td>' + state + '</td>' +
+                '<td>' + ((isOrder ? ev.filled : ev.quantity) || 0) + '</td>' +
+                '<td>' + (price ? price.toFixed(2) : '--') + '</td>' +
+            '</tr>';
+        }).join('') + '</tbody></table>';
+}
+
+let lastData = {};
+let trails = {};
+evt.addEventListener('trails', (e) => {
+    try {
+        trails = {};
+        for (const t of JSON.parse(e.data)) trails[t.account + '|' + t.instrument] = t;
+        render(lastData);
+    } catch(err) { console.error('Parse error:', err); }
+});
+
+let risk = {};
+evt.addEventListener('risk', (e) => {
+    try {
+        risk = {};
+        for (const r of JSON.parse(e.data)) risk[r.account] = r;
+        render(lastData);
+    } catch(err) { console.error('Parse error:', err); }
+});
+
+// riskBadge shows an account's headroom to its daily loss limit, or the
+// lockout once the limit has been breached.
+function riskBadge(acc) {
+    const r = risk[acc];
+    if (!r) return '';
+    if (r.breached) {
+        return ' <span class="badge text-bg-danger fs-6" title="Daily loss limit ' + r.lossLimit.toFixed(2) + ' breached; new orders are refused">Loss limit hit, locked until ' +
+            new Date(r.lockedUntil).toLocaleString() + '</span>';
+    }
+    const cls = r.headroom < r.lossLimit * 0.25 ? 'text-bg-warning' : 'text-bg-secondary';
+    return ' <span class="badge ' + cls + ' fs-6" title="Daily P/L ' + r.dailyPnl.toFixed(2) + ' against a loss limit of ' + r.lossLimit.toFixed(2) + '">Headroom ' + r.headroom.toFixed(2) + '</span>';
+}
+
+let drawdowns = {};
+evt.addEventListener('drawdown', (e) => {
+    try {
+        drawdowns = {};
+        for (const d of JSON.parse(e.data)) drawdowns[d.account] = d;
+        render(lastData);
+    } catch(err) { console.error('Parse error:', err); }
+});
+
+// drawdownLine shows how far an account's equity is above its trailing
+// drawdown threshold.
+function drawdownLine(acc) {
+    const d = drawdowns[acc];
+    if (!d) return '';
+    let cls = 'text-normal';
+    if (d.breached || d.distance <= 0) cls = 'text-pnl-negative';
+    else if (d.buffer && d.distance <= d.buffer * 2) cls = 'text-warning';
+    return '<p class="card-text small">' +
+        '<span class="text-label">Trailing DD (' + d.mode + '): </span>' +
+        '<span class="text-label">High-water </span><strong class="text-normal">' + d.highWater.toFixed(2) + '</strong> | ' +
+        '<span class="text-label">Threshold </span><strong class="text-normal">' + d.threshold.toFixed(2) + '</strong> | ' +
+        '<span class="text-label">Distance </span><strong class="' + cls + '">' + d.distance.toFixed(2) + '</strong>' +
+        (d.buffer ? ' <span class="text-label">(flattens at ' + d.buffer.toFixed(2) + ')</span>' : '') +
+        (d.breached ? ' <span class="badge text-bg-danger">breached</span>' : '') +
+    '</p>';
+}
+
+let naked = {};
+evt.addEventListener('protection', (e) => {
+    try {
+        naked = {};
+        for (const n of JSON.parse(e.data)) naked[n.account + '|' + n.instrument] = n;
+        render(lastData);
+    } catch(err) { console.error('Parse error:', err); }
+});
+
+// nakedBadge flags a position whose stops do not cover its quantity.
+function nakedBadge(acc, p) {
+    const n = naked[acc + '|' + p.instrument];
+    if (!n) return '';
+    const label = n.status === 'partial' ? 'Stop covers ' + n.covered + '/' + n.quantity : 'No stop';
+    const title = 'Uncovered since ' + new Date(n.since).toLocaleTimeString() + (n.stopPlaced ? '; a protective stop was placed' : '');
+    return ' <span class="badge ' + (n.status === 'partial' ? 'text-bg-warning' : 'text-bg-danger') + '" title="' + title + '">' + label + '</span>';
+}
+
+// exposureText formats the money at risk to stops and in reach of targets;
+// contracts without a stop make the risk unbounded.
+function exposureText(e) {
+    const risk = e.risk >= 0 ? e.risk.toFixed(2) : 'locked ' + (-e.risk).toFixed(2);
+    return '<span class="text-label">Risk: </span><strong class="' + (e.unprotected > 0 || e.risk > 0 ? 'text-pnl-negative' : 'text-pnl-positive') + '">' + risk + '</strong>' +
+        (e.unprotected > 0 ? ' <span class="badge text-bg-danger" title="Contracts without a stop">+' + e.unprotected + ' unprotected</span>' : '') +
+        (e.unknownSpec ? ' <span class="badge text-bg-warning" title="Add the instrument\'s point value under /api/instruments">spec missing</span>' : '') + ' | ' +
+        '<span class="text-label">Reward: </span><strong class="text-pnl-positive">' + e.reward.toFixed(2) + '</strong>';
+}
+
+function renderTotalExposure(data) {
+    const total = { risk: 0, reward: 0, unprotected: 0, unknownSpec: false };
+    let any = false;
+    for (const snap of Object.values(data)) {
+        const e = snap.exposure;
+        if (!e || e.positions.length === 0) continue;
+        any = true;
+        total.risk += e.risk;
+        total.reward += e.reward;
+        total.unprotected += e.unprotected;
+        total.unknownSpec = total.unknownSpec || e.unknownSpec;
+    }
+    document.getElementById('totalExposure').innerHTML = any ? '<span class="text-label">All accounts: </span>' + exposureText(total) : '';
+}
+
+async function sendCommand(url, body) {
+    const msg = body.account ? 'Action: ' + url + '\nDetails: ' + JSON.stringify(body) : 'FLATTEN EVERYTHING?';
+    if (!confirm('Are you sure?\n\n' + msg)) return;
+    try {
+		const csrfToken = document.querySelector('meta[name="csrf-token"]').getAttribute('content');
+        const resp = await fetch(url, {
+			method: 'POST',
+			headers: {
+				'Content-Type': 'application/json',
+				'X-CSRF-Token': csrfToken
+			},
+			body: JSON.stringify(body)
+		});
+        if (!resp.ok) {
+            let text = (await resp.text()).trim();
+            try { text = JSON.parse(text).error || text; } catch (_) {}
+            alert('Failed to send command: ' + (text || resp.statusText));
+            return false;
+        }
+        const result = await resp.json();
+        if (result.id && !commandLog.has(result.id)) loadCommands();
+        return true;
+    } catch (err) { alert('Error sending command: ' + err.message); }
+    return false;
+}
+
+document.addEventListener('click', (e) => {
+    const target = e.target.closest('[data-action]');
+    if (!target) return;
+    const { action, account, instrument, orderId } = target.dataset;
+    switch(action) {
+        case 'flatten-all': sendCommand('/api/flatten', {}); break;
+        case 'flatten-account': sendCommand('/api/flatten_account', { account }); break;
+        case 'close-position': sendCommand('/api/close_position', { account, instrument }); break;
+        case 'cancel-order': sendCommand('/api/cancel_order', { account, orderId }); break;
+        case 'cancel-all-orders': sendCommand('/api/cancel_all_orders', instrument ? { account, instrument } : { account }); break;
+        case 'reverse-position': sendCommand('/api/reverse_position', { account, instrument }); break;
+        case 'breakeven': {
+            const offset = prompt('Breakeven offset in ticks (0 = exactly at average price)', '0');
+            if (offset === null) break;
+            sendCommand('/api/breakeven', { account, instrument, offsetTicks: parseInt(offset, 10) || 0 });
+            break;
+        }
+        case 'arm-trail': {
+            const dist = prompt('Trail distance: ticks (e.g. 8) or percent (e.g. 0.5%)', '8');
+            if (dist === null) break;
+            const mode = dist.trim().endsWith('%') ? 'percent' : 'ticks';
+            const distance = parseFloat(dist);
+            if (!(distance > 0)) { alert('Trail distance must be positive.'); break; }
+            const step = prompt('Minimum stop move in ticks', '1');
+            if (step === null) break;
+            sendCommand('/api/arm_trail', { account, instrument, mode, distance, stepTicks: Math.max(1, parseInt(step, 10) || 1) });
+            break;
+        }
+        case 'dismiss-alert':
+            for (const a of alerts) if (a.time === target.dataset.time && encodeURIComponent(a.message) === target.dataset.message) a.dismissed = true;
+            renderAlerts();
+            break;
+        case 'disarm-trail': sendCommand('/api/disarm_trail', { account, instrument }); break;
+        case 'nudge-order': {
+            const step = Math.max(1, parseInt(document.getElementById('nudgeTicks').value, 10) || 1);
+            sendCommand('/api/nudge_order', { account, orderId, ticks: step * parseInt(target.dataset.direction, 10) });
+            break;
+        }
+        case 'change-order': changeOrder(target.dataset); break;
+        case 'close-strategy': sendCommand('/api/close_strategy', { account, strategyId: target.dataset.strategyId }).then(ok => ok && loadStrategies()); break;
+        case 'toggle-schedule': {
+            const sc = schedules.find(s => s.id === target.dataset.scheduleId);
+            if (sc) apiRequest('PUT', '/api/schedules/' + sc.id, Object.assign({}, sc, { enabled: target.checked }));
+            break;
+        }
+        case 'delete-schedule':
+            if (confirm('Delete this schedule?')) apiRequest('DELETE', '/api/schedules/' + target.dataset.scheduleId);
+            break;
+        case 'toggle-rule': {
+            const ru = rules.find(r => r.id === target.dataset.ruleId);
+            if (ru) apiRequest('PUT', '/api/rules/' + ru.id, Object.assign({}, ru, { armed: target.checked }));
+            break;
+        }
+        case 'delete-rule':
+            if (confirm('Delete this rule?')) apiRequest('DELETE', '/api/rules/' + target.dataset.ruleId);
+            break;
+        case 'delete-macro':
+            if (confirm('Delete this macro?')) apiRequest('DELETE', '/api/macros/' + encodeURIComponent(target.dataset.macro));
+            break;
+    }
+});
+
+// apiRequest sends a JSON request with the CSRF token and alerts on failure.
+async function apiRequest(method, url, body) {
+    try {
+        const csrfToken = document.querySelector('meta[name="csrf-token"]').getAttribute('content');
+        const resp = await fetch(url, {
+            method,
+            headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+            body: body === undefined ? undefined : JSON.stringify(body)
+        });
+        if (!resp.ok) { alert('Request failed: ' + ((await resp.text()).trim() || resp.statusText)); return null; }
+        return resp;
+    } catch (err) { alert('Request failed: ' + err.message); }
+    return null;
+}
+
+let schedules = [];
+evt.addEventListener('schedules', (e) => {
+    try { schedules = JSON.parse(e.data); renderSchedules(); } catch(err) { console.error('Parse error:', err); }
+});
+
+async function loadSchedules() {
+    try {
+        const resp = await fetch('/api/schedules');
+        if (!resp.ok) return;
+        schedules = await resp.json();
+        renderSchedules();
+    } catch (err) { console.error('Failed to load schedules:', err); }
+}
+loadSchedules();
+
+function renderSchedules() {
+    const container = document.getElementById('schedules');
+    if (schedules.length === 0) {
+        container.innerHTML = '<p class="text-label small mb-2">No scheduled commands.</p>';
+        return;
+    }
+    const fmt = t => t ? new Date(t).toLocaleString() : '--';
+    container.innerHTML = '<table class="table table-sm table-hover"><thead><tr><th>Name</th><th>Command</th><th>Target</th><th>When</th><th>Next Run</th><th>Last Run</th><th>Enabled</th><th></th></tr></thead><tbody>' +
+        schedules.map(sc => {
+            const p = sc.payload || {};
+            const when = sc.time + ' ' + sc.timezone + ' ' + (sc.date || (sc.days || []).join(','));
+            return '<tr>' +
+                '<td>' + (sc.name || '') + '</td>' +
+                '<td>' + sc.type + '</td>' +
+                '<td>' + ([p.account, p.instrument].filter(Boolean).join(' ') || 'ALL') + '</td>' +
+                '<td>' + when + '</td>' +
+                '<td>' + fmt(sc.nextRun) + '</td>' +
+                '<td>' + fmt(sc.lastRun) + '</td>' +
+                '<td><input class="form-check-input" type="checkbox" data-action="toggle-schedule" data-schedule-id="' + sc.id + '"' + (sc.enabled ? ' checked' : '') + '></td>' +
+                '<td><i class="bi bi-trash text-label action-btn" title="Delete Schedule" data-action="delete-schedule" data-schedule-id="' + sc.id + '"></i></td>' +
+            '</tr>';
+        }).join('') + '</tbody></table>';
+}
+
+let rules = [];
+let ruleFirings = [];
+evt.addEventListener('rules', (e) => {
+    try { rules = JSON.parse(e.data); renderRules(); } catch(err) { console.error('Parse error:', err); }
+});
+evt.addEventListener('rule_fired', (e) => {
+    try { ruleFirings.push(JSON.parse(e.data)); renderRules(); } catch(err) { console.error('Parse error:', err); }
+});
+
+async function loadRules() {
+    try {
+        const [r, f] = await Promise.all([fetch('/api/rules'), fetch('/api/rule_firings')]);
+        if (!r.ok || !f.ok) return;
+        rules = await r.json();
+        ruleFirings = await f.json();
+        renderRules();
+    } catch (err) { console.error('Failed to load rules:', err); }
+}
+loadRules();
+
+function renderRules() {
+    const container = document.getElementById('rules');
+    if (rules.length === 0) {
+        container.innerHTML = '<p class="text-label small mb-2">No rules defined.</p>';
+    } else {
+        container.innerHTML = '<table class="table table-sm table-hover"><thead><tr><th>Name</th><th>Account</th><th>Condition</th><th>Then</th><th>Mode</th><th>Last Fired</th><th>Armed</th><th></th></tr></thead><tbody>' +
+            rules.map(ru => '<tr>' +
+                '<td>' + (ru.name || '') + '</td>' +
+                '<td>' + [ru.account, ru.instrument].filter(Boolean).join(' ') + '</td>' +
+                '<td><code>' + ru.condition + '</code></td>' +
+                '<td>' + ru.type + '</td>' +
+                '<td>' + (ru.repeat ? 'repeat' : 'once') + '</td>' +
+                '<td>' + (ru.lastFired ? new Date(ru.lastFired).toLocaleString() + ' (' + ru.fireCount + 'x)' : '--') + '</td>' +
+                '<td><input class="form-check-input" type="checkbox" data-action="toggle-rule" data-rule-id="' + ru.id + '"' + (ru.armed ? ' checked' : '') + '></td>' +
+                '<td><i class="bi bi-trash text-label action-btn" title="Delete Rule" data-action="delete-rule" data-rule-id="' + ru.id + '"></i></td>' +
+            '</tr>').join('') + '</tbody></table>';
+    }
+    document.getElementById('ruleFirings').innerHTML = ruleFirings.slice(-5).reverse().map(f =>
+        '<div><span class="text-label">' + new Date(f.time).toLocaleTimeString() + '</span> ' + f.name + ' fired on ' + f.account + ': <code>' + f.condition + '</code> (' + f.values + ')</div>').join('');
+}
+
+document.getElementById('ruleForm').addEventListener('submit', (e) => {
+    e.preventDefault();
+    const val = id => document.getElementById(id).value.trim();
+    const type = val('ruType');
+    apiRequest('POST', '/api/rules', {
+        name: val('ruName') || val('ruCondition'),
+        account: val('ruAccount'),
+        instrument: val('ruInstrument'),
+        condition: val('ruCondition'),
+        type,
+        payload: type === 'flatten_all' ? {} : { account: val('ruAccount') },
+        repeat: document.getElementById('ruRepeat').checked,
+        armed: true
+    });
+});
+
+let macros = [];
+let macroRuns = [];
+let lockouts = {};
+evt.addEventListener('macros', (e) => {
+    try { macros = JSON.parse(e.data); renderMacros(); } catch(err) { console.error('Parse error:', err); }
+});
+evt.addEventListener('macro_run', (e) => {
+    try {
+        const run = JSON.parse(e.data);
+        const i = macroRuns.findIndex(r => r.id === run.id);
+        if (i >= 0) macroRuns[i] = run; else macroRuns.push(run);
+        renderMacros();
+    } catch(err) { console.error('Parse error:', err); }
+});
+evt.addEventListener('lockouts', (e) => {
+    try { lockouts = JSON.parse(e.data); render(lastData); } catch(err) { console.error('Parse error:', err); }
+});
+
+async function loadMacros() {
+    try {
+        const [m, r, l] = await Promise.all([fetch('/api/macros'), fetch('/api/macro_runs'), fetch('/api/lockouts')]);
+        if (!m.ok || !r.ok || !l.ok) return;
+        macros = await m.json();
+        macroRuns = (await r.json()) || [];
+        lockouts = await l.json();
+        renderMacros();
+    } catch (err) { console.error('Failed to load macros:', err); }
+}
+loadMacros();
+
+const macroRunBadges = { running: 'text-bg-info', succeeded: 'text-bg-success', failed: 'text-bg-danger' };
+
+function renderMacros() {
+    const container = document.getElementById('macros');
+    if (macros.length === 0) {
+        container.innerHTML = '<p class="text-label small mb-2">No macros defined.</p>';
+    } else {
+        container.innerHTML = '<table class="table table-sm table-hover"><thead><tr><th>Name</th><th>Description</th><th>Steps</th><th></th></tr></thead><tbody>' +
+            macros.map(m => '<tr>' +
+                '<td>' + m.name + '</td>' +
+                '<td>' + (m.description || '') + '</td>' +
+                '<td>' + m.steps.map(st => st.type === 'lockout' ? 'lockout ' + st.duration : st.type + (st.waitFor === 'verified' ? ' (verified)' : '')).join(' &rarr; ') + '</td>' +
+                '<td><i class="bi bi-trash text-label action-btn" title="Delete Macro" data-action="delete-macro" data-macro="' + m.name + '"></i></td>' +
+            '</tr>').join('') + '</tbody></table>';
+    }
+    const select = document.getElementById('maName');
+    const current = select.value;
+    select.innerHTML = macros.map(m => '<option>' + m.name + '</option>').join('');
+    if (macros.some(m => m.name === current)) select.value = current;
+    document.getElementById('macroRuns').innerHTML = macroRuns.slice(-5).reverse().map(r =>
+        '<div><span class="text-label">' + new Date(r.startedAt).toLocaleTimeString() + '</span> ' + r.macro + ' on ' + r.account +
+        ' <span class="badge ' + (macroRunBadges[r.status] || 'text-bg-secondary') + '">' + r.status + '</span> ' +
+        (r.steps || []).map(st => st.type + ': ' + st.status.replace('_', ' ')).join(', ') +
+        (r.error ? ' <span class="text-danger">' + r.error + '</span>' : '') + '</div>').join('');
+}
+
+document.getElementById('macroForm').addEventListener('submit', (e) => {
+    e.preventDefault();
+    let macro;
+    try { macro = JSON.parse(document.getElementById('maDefinition').value); } catch (err) { alert('Invalid JSON: ' + err.message); return; }
+    apiRequest('POST', '/api/macros', macro);
+});
+
+document.getElementById('macroRunForm').addEventListener('submit', (e) => {
+    e.preventDefault();
+    const name = document.getElementById('maName').value;
+    const account = document.getElementById('maAccount').value;
+    if (!name || !confirm('Run macro ' + name + ' on ' + account + '?')) return;
+    apiRequest('POST', '/api/macros/' + encodeURIComponent(name) + '/run', { account });
+});
+
+document.getElementById('scheduleForm').addEventListener('submit', (e) => {
+    e.preventDefault();
+    const val = id => document.getElementById(id).value.trim();
+    const type = val('schType');
+    const payload = {};
+    if (type !== 'flatten_all') payload.account = val('schAccount');
+    if (val('schInstrument') && type !== 'flatten_all' && type !== 'flatten_account') payload.instrument = val('schInstrument');
+    const date = val('schDate');
+    apiRequest('POST', '/api/schedules', {
+        name: val('schName') || type,
+        type,
+        payload,
+        time: val('schTime'),
+        timezone: val('schTimezone'),
+        days: date ? [] : val('schDays').split(',').map(d => d.trim()).filter(Boolean),
+        date,
+        enabled: true
+    });
+});
+
+// changeOrder prompts for the fields that apply to the order type and sends
+// only the ones that were actually edited; zero means "leave unchanged".
+function changeOrder(d) {
+    const ask = (label, current) => {
+        const v = prompt(label, current);
+        if (v === null) return null;
+        const n = parseFloat(v);
+        return (isNaN(n) || n === parseFloat(current)) ? 0 : n;
+    };
+    const change = { account: d.account, orderId: d.orderId, quantity: 0, limitPrice: 0, stopPrice: 0 };
+    const type = d.orderType || '';
+    if (type.includes('Stop')) {
+        const stop = ask('New stop price', d.stopPrice);
+        if (stop === null) return;
+        change.stopPrice = stop;
+    }
+    if (type.includes('Limit')) {
+        const limit = ask('New limit price', d.limitPrice);
+        if (limit === null) return;
+        change.limitPrice = limit;
+    }
+    const qty = ask('New quantity', d.quantity);
+    if (qty === null) return;
+    change.quantity = Math.floor(qty);
+    if (change.quantity < 0 || change.limitPrice < 0 || change.stopPrice < 0) { alert('Quantity and prices must not be negative.'); return; }
+    if (!change.quantity && !change.limitPrice && !change.stopPrice) { alert('Nothing to change.'); return; }
+    sendCommand('/api/change_order', change);
+}
+document.getElementById('flattenAll').dataset.action = 'flatten-all';
+
+document.getElementById('orderTicket').addEventListener('submit', (e) => {
+    e.preventDefault();
+    const val = (id) => document.getElementById(id).value.trim();
+    const order = {
+        account: val('otAccount'),
+        instrument: val('otInstrument'),
+        action: val('otAction'),
+        quantity: parseInt(val('otQuantity'), 10) || 0,
+        orderType: val('otType'),
+        limitPrice: parseFloat(val('otLimit')) || 0,
+        stopPrice: parseFloat(val('otStop')) || 0,
+        tif: val('otTif'),
+        ocoId: val('otOco'),
+        strategy: val('otStrategy')
+    };
+    if (e.submitter && e.submitter.value === 'bracket') {
+        const bracket = {
+            account: order.account,
+            instrument: order.instrument,
+            action: order.action,
+            quantity: order.quantity,
+            entryType: order.orderType,
+            entryPrice: order.limitPrice,
+            stopPrice: parseFloat(val('otStopLoss')) || 0,
+            targetPrice: parseFloat(val('otTarget')) || 0,
+            tif: order.tif,
+            ocoId: order.ocoId
+        };
+        const err = validateBracket(bracket);
+        if (err) { alert(err); return; }
+        sendCommand('/api/place_bracket', bracket);
+        return;
+    }
+    const err = validateOrder(order);
+    if (err) { alert(err); return; }
+    if (order.strategy) {
+        sendCommand('/api/place_atm_order', order).then(ok => ok && loadStrategies());
+        return;
+    }
+    sendCommand('/api/place_order', order);
+});
+
+document.getElementById('closeStrategyForm').addEventListener('submit', (e) => {
+    e.preventDefault();
+    const strategyId = document.getElementById('csStrategyId').value.trim();
+    if (!strategyId) return;
+    sendCommand('/api/close_strategy', { strategyId }).then(ok => ok && loadStrategies());
+});
+
+async function loadStrategies() {
+    try {
+        const resp = await fetch('/api/atm_strategies');
+        if (!resp.ok) return;
+        renderStrategies(await resp.json());
+    } catch (err) { console.error('Failed to load ATM strategies:', err); }
+}
+
+function renderStrategies(list) {
+    const container = document.getElementById('atmStrategies');
+    if (!list || list.length === 0) {
+        container.innerHTML = '<p class="text-label small mb-2">No ATM strategies started from this dashboard.</p>';
+        return;
+    }
+    container.innerHTML = '<table class="table table-sm table-hover"><thead><tr><th>Strategy ID</th><th>Template</th><th>Account</th><th>Instrument</th><th>Started</th><th></th></tr></thead><tbody>' +
+        list.map(s => '<tr>' +
+            '<td>' + s.strategyId + '</td>' +
+            '<td>' + s.template + '</td>' +
+            '<td>' + s.account + '</td>' +
+            '<td>' + s.instrument + '</td>' +
+            '<td>' + new Date(s.startedAt).toLocaleTimeString() + '</td>' +
+            '<td><i class="bi bi-x-circle-fill text-pnl-negative action-btn" title="Close Strategy" data-action="close-strategy" data-account="' + s.account + '" data-strategy-id="' + s.strategyId + '"></i></td>' +
+        '</tr>').join('') + '</tbody></table>';
+}
+loadStrategies();
+evt.addEventListener('atm_strategies', (e) => {
+    try { renderStrategies(JSON.parse(e.data)); } catch(err) { console.error('Parse error:', err); }
+});
+
+function validateBracket(b) {
+    if (b.entryType !== 'MARKET' && b.entryType !== 'LIMIT') return 'Bracket entries must be Market or Limit orders.';
+    const err = validateOrder({ account: b.account, instrument: b.instrument, quantity: b.quantity, orderType: b.entryType, limitPrice: b.entryPrice });
+    if (err) return err;
+    if (b.stopPrice <= 0 || b.targetPrice <= 0) return 'Stop loss and target are required for a bracket.';
+    const long = b.action === 'BUY';
+    if (long ? b.stopPrice >= b.targetPrice : b.stopPrice <= b.targetPrice) return 'Stop loss and target are on the wrong sides for a ' + b.action + ' bracket.';
+    if (b.entryType === 'LIMIT' && (long ? (b.stopPrice >= b.entryPrice || b.targetPrice <= b.entryPrice) : (b.stopPrice <= b.entryPrice || b.targetPrice >= b.entryPrice))) return 'Entry price must lie between stop loss and target.';
+    return '';
+}
+
+// groupOrders collects the orders of each bracket (the OCO stop/target pair
+// plus its entry, whose order id is "<oco>_entry") so they render together.
+function groupOrders(orders) {
+    const groups = new Map();
+    const singles = [];
+    for (const o of orders) {
+        let key = o.oco;
+        if (!key && o.orderId && o.orderId.endsWith('_entry')) key = o.orderId.slice(0, -'_entry'.length);
+        if (!key) { singles.push(o); continue; }
+        if (!groups.has(key)) groups.set(key, []);
+        groups.get(key).push(o);
+    }
+    for (const [key, list] of groups) {
+        if (list.length < 2) { singles.push(...list); groups.delete(key); }
+    }
+    return { groups, singles };
+}
+
+function bracketSummary(oco, orders, positions) {
+    const stop = orders.find(o => o.oco === oco && (o.isStopLoss || o.orderType.includes('Stop')));
+    const target = orders.find(o => o.oco === oco && (o.isProfitTarget || o.orderType === 'Limit'));
+    const entryOrder = orders.find(o => o.oco !== oco);
+    const pos = (positions || []).find(p => p.instrument === orders[0].instrument && p.marketPosition !== 'Flat');
+    let entry = pos ? pos.averagePrice : 0;
+    if (!entry && entryOrder) entry = entryOrder.limitPrice || entryOrder.stopPrice;
+    let text = 'Bracket ' + oco;
+    if (entry && stop && target) {
+        const risk = Math.abs(entry - stop.stopPrice);
+        const reward = Math.abs(target.limitPrice - entry);
+        text += ' | Entry ' + entry.toFixed(2) + ' | Risk ' + risk.toFixed(2) + ' pts | Reward ' + reward.toFixed(2) + ' pts' +
+            (risk > 0 ? ' | R:R 1:' + (reward / risk).toFixed(2) : '');
+    }
+    return text;
+}
+
+function validateOrder(o) {
+    if (!o.account) return 'Select an account.';
+    if (!o.instrument) return 'Instrument is required.';
+    if (o.quantity <= 0) return 'Quantity must be positive.';
+    if ((o.orderType === 'LIMIT' || o.orderType === 'STOPLIMIT') && o.limitPrice <= 0) return 'Limit price is required for ' + o.orderType + ' orders.';
+    if ((o.orderType === 'STOPMARKET' || o.orderType === 'STOPLIMIT') && o.stopPrice <= 0) return 'Stop price is required for ' + o.orderType + ' orders.';
+    return '';
+}
+
+function updateTicketAccounts(accounts) {
+    for (const id of ['otAccount', 'schAccount', 'ruAccount', 'maAccount']) {
+        const select = document.getElementById(id);
+        const current = select.value;
+        select.innerHTML = accounts.map(a => '<option>' + a + '</option>').join('');
+        if (accounts.includes(current)) select.value = current;
+    }
+}
+
+function trailCell(acc, p) {
+    const t = trails[acc + '|' + p.instrument];
+    if (!t) return '<i class="bi bi-graph-up-arrow text-label action-btn me-2" title="Arm Trailing Stop" data-action="arm-trail" data-account="' + acc + '" data-instrument="' + p.instrument + '"></i>';
+    const dist = t.mode === 'percent' ? t.distance + '%' : t.distance + 't';
+    return '<span class="badge text-bg-info me-1" title="Status: ' + t.status + ' | Best: ' + t.bestPrice.toFixed(2) + '">Trail ' + dist +
+        (t.stopPrice > 0 ? ' @ ' + t.stopPrice.toFixed(2) : '') + '</span>' +
+        '<i class="bi bi-x-lg text-label action-btn me-2" title="Disarm Trailing Stop" data-action="disarm-trail" data-account="' + acc + '" data-instrument="' + p.instrument + '"></i>';
+}
+
+function render(data) {
+    lastData = data;
+    renderTotalExposure(data);
+    const container = document.getElementById('accounts');
+    container.innerHTML = '';
+    updateTicketAccounts(Object.keys(data).sort());
+    for (const acc of Object.keys(data).sort()) {
+        const snap = data[acc];
+        const card = document.createElement('div');
+        card.className = 'card mb-3';
+        
+        let positionsTable = '<p class="text-label">No open positions.</p>';
+        if (snap.positions && snap.positions.length > 0) {
+            let rows = snap.positions.map(p => {
+                const pnlClass = p.unrealized >= 0 ? 'text-pnl-positive' : 'text-pnl-negative';
+                const n = naked[acc + '|' + p.instrument];
+                return '<tr class="' + (n ? (n.status === 'partial' ? 'table-warning' : 'table-danger') : '') + '">' +
+                    '<td>' + p.instrument + nakedBadge(acc, p) + '</td>' +
+                    '<td>' + p.marketPosition + '</td>' +
+                    '<td>' + p.quantity + '</td>' +
+                    '<td>' + p.averagePrice.toFixed(2) + '</td>' +
+                    '<td>' + (p.currentPrice > 0 ? p.currentPrice.toFixed(2) : '--') + '</td>' +
+                    '<td><strong class="' + pnlClass + '">' + p.unrealized.toFixed(2) + '</strong></td>' +
+                    '<td class="text-nowrap">' +
+                        trailCell(acc, p) +
+                        '<i class="bi bi-shield-check text-label action-btn me-2" title="Move Stop to Breakeven" data-action="breakeven" data-account="' + acc + '" data-instrument="' + p.instrument + '"></i>' +
+                        '<i class="bi bi-arrow-left-right text-label action-btn me-2" title="Reverse Position" data-action="reverse-position" data-account="' + acc + '" data-instrument="' + p.instrument + '"></i>' +
+                        '<i class="bi bi-slash-circle text-label action-btn me-2" title="Cancel Orders for ' + p.instrument + '" data-action="cancel-all-orders" data-account="' + acc + '" data-instrument="' + p.instrument + '"></i>' +
+                        '<i class="bi bi-x-circle-fill text-pnl-negative action-btn" title="Close Position" data-action="close-position" data-account="' + acc + '" data-instrument="' + p.instrument + '"></i>' +
+                    '</td>' +
+                '</tr>';
+            }).join('');
+            positionsTable = '<h6>Positions</h6><table class="table table-sm table-hover">' +
+                '<thead><tr><th>Instrument</th><th>MP</th><th>Qty</th><th>Avg Price</th><th>Price</th><th>Unrealized</th><th></th></tr></thead>' +
+                '<tbody>' + rows + '</tbody></table>';
+        }
+        
+        let ordersTable = '<p class="text-label">No working orders.</p>';
         if (snap.workingOrders && snap.workingOrders.length > 0) {
-            let rows = snap.workingOrders.map(o => {
+            const orderRow = o => {
                 let price = '';
                 if (o.orderType === 'Limit' || o.isProfitTarget) price = o.limitPrice.toFixed(2);
                 else if (o.orderType.includes('Stop') || o.isStopLoss) price = o.stopPrice.toFixed(2);
@@ -274,9 +2269,22 @@ function render(data) {
                     '<td>' + o.quantity + '</td>' +
                     '<td>' + price + '</td>' +
                     '<td>' + o.state + '</td>' +
-                    '<td><i class="bi bi-x-circle-fill text-pnl-negative action-btn" title="Cancel Order" data-action="cancel-order" data-account="' + acc + '" data-order-id="' + o.orderId + '"></i></td>' +
+                    '<td class="text-nowrap">' +
+                        ((o.stopPrice > 0 || o.limitPrice > 0) ?
+                            '<i class="bi bi-dash-square text-label action-btn me-1" title="Nudge Down" data-action="nudge-order" data-direction="-1" data-account="' + acc + '" data-order-id="' + o.orderId + '"></i>' +
+                            '<i class="bi bi-plus-square text-label action-btn me-2" title="Nudge Up" data-action="nudge-order" data-direction="1" data-account="' + acc + '" data-order-id="' + o.orderId + '"></i>' : '') +
+                        '<i class="bi bi-pencil-square text-label action-btn me-2" title="Modify Order" data-action="change-order" data-account="' + acc + '" data-order-id="' + o.orderId + '" data-order-type="' + o.orderType + '" data-quantity="' + o.quantity + '" data-limit-price="' + o.limitPrice + '" data-stop-price="' + o.stopPrice + '"></i>' +
+                        '<i class="bi bi-x-circle-fill text-pnl-negative action-btn" title="Cancel Order" data-action="cancel-order" data-account="' + acc + '" data-order-id="' + o.orderId + '"></i>' +
+                    '</td>' +
                 '</tr>';
-            }).join('');
+            };
+            const { groups, singles } = groupOrders(snap.workingOrders);
+            let rows = '';
+            for (const [oco, list] of groups) {
+                rows += '<tr class="table-active"><td colspan="7" class="small"><i class="bi bi-diagram-3 me-1"></i>' + bracketSummary(oco, list, snap.positions) + '</td></tr>';
+                rows += list.map(orderRow).join('');
+            }
+            rows += singles.map(orderRow).join('');
             ordersTable = '<h6>Working Orders</h6><table class="table table-sm table-hover">' +
                 '<thead><tr><th>Instrument</th><th>Type</th><th>Action</th><th>Qty</th><th>Price</th><th>State</th><th></th></tr></thead>' +
                 '<tbody>' + rows + '</tbody></table>';
@@ -285,428 +2293,1845 @@ function render(data) {
         const unrealizedCls = snap.unrealized >= 0 ? 'text-pnl-positive' : 'text-pnl-negative';
         card.innerHTML = '<div class="card-body">' +
             '<div class="d-flex justify-content-between align-items-center mb-2">' +
-                '<h5 class="card-title mb-0">' + acc + '</h5>' +
-                '<button class="btn btn-sm btn-warning" data-action="flatten-account" data-account="' + acc + '">Flatten ' + acc + '</button>' +
+                '<h5 class="card-title mb-0">' + acc + (snap.connection ? ' <small class="text-label fs-6">via ' + snap.connection + '</small>' : '') +
+                    (lockouts[acc] && new Date(lockouts[acc]) > new Date() ? ' <span class="badge text-bg-danger fs-6" title="New orders are blocked">Locked out until ' + new Date(lockouts[acc]).toLocaleTimeString() + '</span>' : '') + riskBadge(acc) + '</h5>' +
+                '<div class="d-flex gap-2">' +
+                    '<button class="btn btn-sm btn-outline-secondary" data-action="cancel-all-orders" data-account="' + acc + '">Cancel Orders</button>' +
+                    '<button class="btn btn-sm btn-warning" data-action="flatten-account" data-account="' + acc + '">Flatten ' + acc + '</button>' +
+                '</div>' +
             '</div>' +
             '<p class="card-text small">' +
                 '<span class="text-label">Balance: </span><strong class="text-normal">' + snap.balance.toFixed(2) + '</strong> | ' +
                 '<span class="text-label">Realized P/L: </span><strong class="text-normal">' + snap.realized.toFixed(2) + '</strong> | ' +
                 '<span class="text-label">Unrealized P/L: </span><strong class="' + unrealizedCls + '">' + snap.unrealized.toFixed(2) + '</strong> | ' +
+                (snap.exposure && snap.exposure.positions.length > 0 ? exposureText(snap.exposure) + ' | ' : '') +
                 '<span class="text-label">Updated: </span><span class="text-normal">' + new Date(snap.timestamp).toLocaleTimeString() + '</span>' +
-            '</p><hr>' + positionsTable + ordersTable + '</div>';
+            '</p>' + drawdownLine(acc) + '<hr>' + positionsTable + ordersTable + '</div>';
         container.appendChild(card);
     }
 }
-</script>
-</body>
-</html>
-`))
+</script>
+</body>
+</html>
+`))
+
+func NewCloudDashboard() *CloudDashboard {
+	// Get auth credentials from environment
+	csrfKey := []byte(os.Getenv("CSRF_AUTH_KEY"))
+	if len(csrfKey) != 32 {
+		log.Println("WARNING: CSRF_AUTH_KEY is not set or not 32 bytes. Generating a random key for this session.")
+		csrfKey = make([]byte, 32)
+		rand.Read(csrfKey)
+	}
+
+	dashUser := os.Getenv("DASHBOARD_USER")
+	if dashUser == "" {
+		dashUser = "admin"
+	}
+	dashPass := os.Getenv("DASHBOARD_PASS")
+	if dashPass == "" {
+		log.Fatal("FATAL: DASHBOARD_PASS environment variable is not set. Please set a strong password for the dashboard user.")
+	}
+	apiSecretToken := os.Getenv("API_SECRET_TOKEN")
+	if apiSecretToken == "" {
+		apiSecretToken = generateRandomKey()
+		log.Printf("Generated API Secret Token: %s", apiSecretToken)
+		log.Printf("Set API_SECRET_TOKEN environment variable to this value for the connection-server.")
+	}
+
+	var atmTemplates []string
+	for _, name := range strings.Split(os.Getenv("ATM_TEMPLATES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			atmTemplates = append(atmTemplates, name)
+		}
+	}
+
+	ackTimeout := 30 * time.Second
+	if v := os.Getenv("COMMAND_ACK_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			ackTimeout = d
+		} else {
+			log.Printf("Ignoring invalid COMMAND_ACK_TIMEOUT %q", v)
+		}
+	}
+
+	defaultTTL := 60 * time.Second
+	if v := os.Getenv("COMMAND_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			defaultTTL = d
+		} else {
+			log.Printf("Ignoring invalid COMMAND_TTL %q", v)
+		}
+	}
+
+	cd := &CloudDashboard{
+		latest:        make(map[string]Snapshot),
+		webClients:    make(map[chan sseEvent]bool),
+		connections:   make(map[*websocket.Conn]*ConnectionClient),
+		sessions:      make(map[string]time.Time),
+		dashboardUser: dashUser,
+		dashboardPass: dashPass,
+		apiSecretToken: apiSecretToken,
+		csrfAuthKey:   csrfKey,
+		atmTemplates:  atmTemplates,
+		atmStrategies: make(map[string]ATMStrategy),
+		pendingATM:    make(map[string]ATMStrategy),
+		trails:        make(map[string][]Trail),
+		risk:          make(map[string][]RiskState),
+		drawdowns:     make(map[string][]DrawdownState),
+		naked:         make(map[string][]NakedPosition),
+		accountOwners: make(map[string]string),
+		ackTimeout:    ackTimeout,
+		commandTTLs:   parseCommandTTLs(os.Getenv("COMMAND_TTLS")),
+		specs:         parseInstrumentSpecs(os.Getenv("INSTRUMENT_SPECS")),
+		defaultTTL:    defaultTTL,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true // Allow all origins
+			},
+		},
+	}
+	cd.commands = NewCommandRegistry(500, cd.broadcastCommand)
+
+	stateDir := os.Getenv("STATE_DIR")
+	if stateDir == "" {
+		stateDir = "state"
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		log.Printf("Warning: cannot create state directory %s: %v", stateDir, err)
+	}
+	queue, err := NewCommandQueue(filepath.Join(stateDir, "queue.json"), 100)
+	if err != nil {
+		log.Printf("Failed to load command queue: %v", err)
+	}
+	cd.queue = queue
+	for _, cmd := range queue.List() {
+		cd.commands.Add(cmd)
+		cd.commands.Update(cmd.ID, CommandQueued, "restored after dashboard restart")
+	}
+	if n := len(queue.List()); n > 0 {
+		log.Printf("Restored %d queued command(s)", n)
+	}
+	cd.stateDir = stateDir
+	cd.schedules = make(map[string]*Schedule)
+	cd.loadSchedules()
+	cd.rules = make(map[string]*Rule)
+	cd.loadRules()
+	cd.macros = make(map[string]*Macro)
+	cd.loadMacros()
+	cd.lockouts = make(map[string]time.Time)
+	cd.loadLockouts()
+	cd.loadInstrumentSpecs()
+	return cd
+}
+
+// newCommandID returns a unique command id. The connection server uses it
+// to recognize redelivered commands, so it must never repeat.
+func newCommandID() string {
+	return newID("cmd")
+}
+
+// newID returns a unique id with the given prefix. The random part keeps
+// ids made in the same nanosecond, or on another machine, apart.
+func newID(prefix string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%s_%d_%x", prefix, time.Now().UnixNano(), b)
+}
+
+func generateRandomKey() string {
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	return base64.URLEncoding.EncodeToString(bytes)
+}
+
+func (cd *CloudDashboard) Start() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8081"
+	}
+
+	go cd.cleanupExpiredSessions(1 * time.Hour)
+	go cd.expireCommands()
+	go cd.runSchedules()
+
+	mux := http.NewServeMux()
+	// Authentication routes
+	mux.HandleFunc("/login", cd.loginHandler)
+	mux.HandleFunc("/logout", cd.logoutHandler)
+
+	// Protected routes
+	mux.HandleFunc("/", cd.requireAuth(cd.dashboardHandler))
+	mux.HandleFunc("/events", cd.requireAuth(cd.eventsHandler))
+	mux.HandleFunc("/api/flatten", cd.requireAuth(cd.commandHandler("flatten_all")))
+	mux.HandleFunc("/api/flatten_account", cd.requireAuth(cd.accountCommandHandler("flatten_account")))
+	mux.HandleFunc("/api/close_position", cd.requireAuth(cd.instrumentCommandHandler("close_position")))
+	mux.HandleFunc("/api/cancel_order", cd.requireAuth(cd.orderCommandHandler("cancel_order")))
+	mux.HandleFunc("/api/cancel_all_orders", cd.requireAuth(cd.instrumentCommandHandler("cancel_all_orders")))
+	mux.HandleFunc("/api/reverse_position", cd.requireAuth(cd.instrumentCommandHandler("reverse_position")))
+	mux.HandleFunc("/api/place_order", cd.requireAuth(cd.placeOrderHandler("place_order")))
+	mux.HandleFunc("/api/place_bracket", cd.requireAuth(cd.placeBracketHandler("place_bracket")))
+	mux.HandleFunc("/api/place_atm_order", cd.requireAuth(cd.placeATMOrderHandler("place_atm_order")))
+	mux.HandleFunc("/api/close_strategy", cd.requireAuth(cd.closeStrategyHandler("close_strategy")))
+	mux.HandleFunc("/api/atm_strategies", cd.requireAuth(cd.atmStrategiesHandler))
+	mux.HandleFunc("/api/alerts", cd.requireAuth(cd.alertsHandler))
+	mux.HandleFunc("/api/risk", cd.requireAuth(cd.riskHandler))
+	mux.HandleFunc("/api/drawdown", cd.requireAuth(cd.drawdownHandler))
+	mux.HandleFunc("/api/protection", cd.requireAuth(cd.protectionHandler))
+	mux.HandleFunc("/api/exposure", cd.requireAuth(cd.exposureHandler))
+	mux.HandleFunc("/api/instruments", cd.requireAuth(cd.instrumentsHandler))
+	mux.HandleFunc("/api/instruments/", cd.requireAuth(cd.instrumentsHandler))
+	mux.HandleFunc("/api/order_events", cd.requireAuth(cd.orderEventsHandler))
+	mux.HandleFunc("/api/commands", cd.requireAuth(cd.commandsHandler))
+	mux.HandleFunc("/api/commands/", cd.requireAuth(cd.commandsHandler))
+	mux.HandleFunc("/api/schedules", cd.requireAuth(cd.schedulesHandler))
+	mux.HandleFunc("/api/schedules/", cd.requireAuth(cd.schedulesHandler))
+	mux.HandleFunc("/api/rules", cd.requireAuth(cd.rulesHandler))
+	mux.HandleFunc("/api/rules/", cd.requireAuth(cd.rulesHandler))
+	mux.HandleFunc("/api/rule_firings", cd.requireAuth(cd.ruleFiringsHandler))
+	mux.HandleFunc("/api/macros", cd.requireAuth(cd.macrosHandler))
+	mux.HandleFunc("/api/macros/", cd.requireAuth(cd.macrosHandler))
+	mux.HandleFunc("/api/macro_runs", cd.requireAuth(cd.macroRunsHandler))
+	mux.HandleFunc("/api/lockouts", cd.requireAuth(cd.lockoutsHandler))
+	mux.HandleFunc("/api/change_order", cd.requireAuth(cd.changeOrderHandler("change_order")))
+	mux.HandleFunc("/api/breakeven", cd.requireAuth(cd.breakevenHandler("breakeven")))
+	mux.HandleFunc("/api/nudge_order", cd.requireAuth(cd.nudgeOrderHandler("nudge_order")))
+	mux.HandleFunc("/api/arm_trail", cd.requireAuth(cd.armTrailHandler("arm_trail")))
+	mux.HandleFunc("/api/disarm_trail", cd.requireAuth(cd.instrumentCommandHandler("disarm_trail")))
+
+	// WebSocket with API key auth (CSRF protection is not needed for WebSockets)
+	mux.HandleFunc("/ws", cd.websocketHandler)
+
+	// CSRF Middleware
+	isSecure := os.Getenv("ENV") == "production" // A simple way to detect production
+	csrfMiddleware := csrf.Protect(cd.csrfAuthKey, csrf.Secure(isSecure))
+
+	log.Printf("Starting Cloud Dashboard on :%s", port)
+	log.Printf("Dashboard: http://localhost:%s", port)
+	log.Printf("Default login: %s / %s", cd.dashboardUser, cd.dashboardPass)
+	log.Fatal(http.ListenAndServe("0.0.0.0:"+port, csrfMiddleware(mux)))
+}
+
+func (cd *CloudDashboard) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	tpl.Execute(w, map[string]interface{}{
+		"CSRFToken":    csrf.Token(r),
+		"ATMTemplates": cd.atmTemplates,
+	})
+}
+
+func (cd *CloudDashboard) cleanupExpiredSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		cd.sessionsMu.Lock()
+		for sessionID, creationTime := range cd.sessions {
+			if time.Since(creationTime) > 24*time.Hour {
+				delete(cd.sessions, sessionID)
+			}
+		}
+		cd.sessionsMu.Unlock()
+		log.Println("Cleaned up expired sessions.")
+	}
+}
+
+// Authentication middleware
+func (cd *CloudDashboard) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionCookie, err := r.Cookie("session")
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		cd.sessionsMu.Lock()
+		sessionTime, exists := cd.sessions[sessionCookie.Value]
+		cd.sessionsMu.Unlock()
+
+		if !exists || time.Since(sessionTime) > 24*time.Hour {
+			// Session expired
+			cd.sessionsMu.Lock()
+			delete(cd.sessions, sessionCookie.Value)
+			cd.sessionsMu.Unlock()
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		// Update session time
+		cd.sessionsMu.Lock()
+		cd.sessions[sessionCookie.Value] = time.Now()
+		cd.sessionsMu.Unlock()
+
+		next(w, r)
+	}
+}
+
+func (cd *CloudDashboard) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		loginTpl.Execute(w, nil)
+		return
+	}
+
+	if r.Method == "POST" {
+		username := r.FormValue("username")
+		password := r.FormValue("password")
+
+		// Constant-time comparison to prevent timing attacks
+		usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(cd.dashboardUser)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(cd.dashboardPass)) == 1
+
+		if usernameOK && passwordOK {
+			// Create session
+			sessionID := generateRandomKey()
+			cd.sessionsMu.Lock()
+			cd.sessions[sessionID] = time.Now()
+			cd.sessionsMu.Unlock()
+
+			// Set cookie
+			http.SetCookie(w, &http.Cookie{
+				Name:     "session",
+				Value:    sessionID,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   strings.HasPrefix(r.Header.Get("X-Forwarded-Proto"), "https"),
+				SameSite: http.SameSiteLaxMode,
+			})
+
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		// Invalid credentials
+		loginTpl.Execute(w, map[string]string{"Error": "Invalid username or password"})
+		return
+	}
+}
+
+func (cd *CloudDashboard) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	sessionCookie, err := r.Cookie("session")
+	if err == nil {
+		cd.sessionsMu.Lock()
+		delete(cd.sessions, sessionCookie.Value)
+		cd.sessionsMu.Unlock()
+	}
+
+	// Clear cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Now().Add(-time.Hour),
+		HttpOnly: true,
+	})
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (cd *CloudDashboard) websocketHandler(w http.ResponseWriter, r *http.Request) {
+	// Check API key for WebSocket connections (connection servers)
+	authHeader := r.Header.Get("Authorization")
+	expectedHeader := "Bearer " + cd.apiSecretToken
+	if subtle.ConstantTimeCompare([]byte(authHeader), []byte(expectedHeader)) != 1 {
+		// To prevent token leakage, log a generic unauthorized message.
+		log.Printf("WebSocket unauthorized: Invalid token.")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	conn, err := cd.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+
+	client := &ConnectionClient{
+		conn:        conn,
+		commandChan: make(chan Command, 10),
+		id:          newID("conn"),
+	}
+	client.name = client.id
+
+	cd.connectionsMu.Lock()
+	cd.connections[conn] = client
+	cd.connectionsMu.Unlock()
+
+	log.Printf("Connection server connected: %s", client.id)
+
+	// Send initial snapshot if available
+	cd.mu.RLock()
+	if len(cd.latest) > 0 {
+		data, _ := json.Marshal(WebSocketMessage{
+			Type: "snapshot",
+			Data: cd.latest,
+		})
+		cd.mu.RUnlock()
+		conn.WriteMessage(websocket.TextMessage, data)
+	} else {
+		cd.mu.RUnlock()
+	}
+
+	// Start goroutines for this connection
+	go cd.handleConnection(client)
+	go cd.sendCommands(client)
+}
+
+func (cd *CloudDashboard) handleConnection(client *ConnectionClient) {
+	defer func() {
+		cd.connectionsMu.Lock()
+		delete(cd.connections, client.conn)
+		cd.connectionsMu.Unlock()
+		close(client.commandChan)
+		client.conn.Close()
+		log.Printf("Connection server disconnected: %s", client.id)
+
+		// The connection server re-reports its trails and risk state when
+		// it reconnects, possibly before this connection is found dead
+		name := cd.connectionName(client)
+		if !cd.connected(name) {
+			cd.mu.Lock()
+			delete(cd.trails, name)
+			delete(cd.risk, name)
+			delete(cd.drawdowns, name)
+			delete(cd.naked, name)
+			cd.mu.Unlock()
+		}
+		cd.broadcastTrails()
+		cd.broadcastEvent("risk", cd.riskJSON())
+		cd.broadcastEvent("drawdown", cd.drawdownJSON())
+		cd.broadcastEvent("protection", cd.protectionJSON())
+	}()
+
+	for {
+		_, message, err := client.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("WebSocket error: %v", err)
+			}
+			break
+		}
+
+		var msg WebSocketMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			log.Printf("Invalid WebSocket message: %v", err)
+			continue
+		}
+
+		switch msg.Type {
+		case "hello":
+			var hello struct {
+				Name string `json:"name"`
+			}
+			if b, err := json.Marshal(msg.Data); err == nil && json.Unmarshal(b, &hello) == nil && hello.Name != "" {
+				cd.connectionsMu.Lock()
+				for _, other := range cd.connections {
+					if other != client && other.name == hello.Name {
+						log.Printf("Warning: two connection servers are both named %q", hello.Name)
+					}
+				}
+				client.name = hello.Name
+				cd.connectionsMu.Unlock()
+				log.Printf("Connection server %s identified as %q", client.id, hello.Name)
+				cd.mu.Lock()
+				delete(cd.trails, client.id)
+				delete(cd.risk, client.id)
+				delete(cd.drawdowns, client.id)
+				delete(cd.naked, client.id)
+				cd.mu.Unlock()
+			}
+			// Redeliver everything not yet acknowledged; the connection
+			// server ignores commands it has already executed.
+			cd.flushQueue(true)
+		case "snapshot":
+			if dataMap, ok := msg.Data.(map[string]interface{}); ok {
+				name := cd.connectionName(client)
+				var received []Snapshot
+				cd.mu.Lock()
+				for account, snapData := range dataMap {
+					if snapBytes, err := json.Marshal(snapData); err == nil {
+						var snap Snapshot
+						if err := json.Unmarshal(snapBytes, &snap); err == nil {
+							snap.Connection = name
+							exposure := cd.exposure(snap)
+							snap.Exposure = &exposure
+							cd.latest[account] = snap
+							received = append(received, snap)
+							if owner := cd.accountOwners[account]; owner != name {
+								if owner != "" {
+									log.Printf("Account %s moved from connection server %q to %q", account, owner, name)
+								}
+								cd.accountOwners[account] = name
+							}
+						}
+					}
+				}
+				broadcastData, _ := json.Marshal(cd.latest)
+				cd.mu.Unlock()
+				cd.broadcast(broadcastData)
+				for _, snap := range received {
+					cd.evaluateRules(snap)
+					cd.pruneATMStrategies(snap)
+				}
+			}
+		case "command_ack":
+			if msg.Duplicate {
+				log.Printf("Command %s was already executed; connection server replayed its result", msg.ID)
+			} else {
+				log.Printf("Command acknowledged: %s", msg.ID)
+			}
+			cd.queue.Remove(msg.ID)
+			if msg.Simulated {
+				cd.commands.MarkSimulated(msg.ID)
+			}
+			if msg.Stage == "" {
+				cd.resolveATMStrategy(msg.ID, msg.Error == "" && !msg.Expired)
+			}
+			status, errText := CommandAcknowledged, ""
+			if msg.Stage == "consumption" {
+				status, errText = CommandNotConsumed, msg.Error
+			} else if msg.Stage == "verification" {
+				if msg.Verified {
+					status = CommandVerified
+				} else {
+					status, errText = CommandNotVerified, msg.Error
+				}
+			} else if msg.Expired {
+				status, errText = CommandExpired, msg.Error
+			} else if msg.Error != "" {
+				status, errText = CommandFailed, msg.Error
+			}
+			// A command sent to every connection server settles once
+			// each of them has answered.
+			if status, errText, ok := cd.commands.UpdateConnection(msg.ID, cd.connectionName(client), status, errText); ok {
+				cd.commands.Update(msg.ID, status, errText)
+			}
+		case "alert":
+			var alert Alert
+			if b, err := json.Marshal(msg.Data); err == nil && json.Unmarshal(b, &alert) == nil {
+				alert.Connection = cd.connectionName(client)
+				cd.addAlert(alert)
+			}
+		case "order_state", "position_state":
+			var event OrderEvent
+			if b, err := json.Marshal(msg.Data); err == nil && json.Unmarshal(b, &event) == nil {
+				event.Kind = strings.TrimSuffix(msg.Type, "_state")
+				cd.addOrderEvent(event)
+			}
+		case "trail_state":
+			var trails []Trail
+			if b, err := json.Marshal(msg.Data); err == nil && json.Unmarshal(b, &trails) == nil {
+				cd.mu.Lock()
+				cd.trails[cd.connectionName(client)] = trails
+				cd.mu.Unlock()
+				cd.broadcastTrails()
+			}
+		case "risk_state":
+			var states []RiskState
+			if b, err := json.Marshal(msg.Data); err == nil && json.Unmarshal(b, &states) == nil {
+				cd.mu.Lock()
+				cd.risk[cd.connectionName(client)] = states
+				cd.mu.Unlock()
+				cd.broadcastEvent("risk", cd.riskJSON())
+			}
+		case "drawdown_state":
+			var states []DrawdownState
+			if b, err := json.Marshal(msg.Data); err == nil && json.Unmarshal(b, &states) == nil {
+				cd.mu.Lock()
+				cd.drawdowns[cd.connectionName(client)] = states
+				cd.mu.Unlock()
+				cd.broadcastEvent("drawdown", cd.drawdownJSON())
+			}
+		case "protection_state":
+			var naked []NakedPosition
+			if b, err := json.Marshal(msg.Data); err == nil && json.Unmarshal(b, &naked) == nil {
+				cd.mu.Lock()
+				cd.naked[cd.connectionName(client)] = naked
+				cd.mu.Unlock()
+				cd.broadcastEvent("protection", cd.protectionJSON())
+			}
+		default:
+			log.Printf("Unknown message type: %s", msg.Type)
+		}
+	}
+}
+
+func (cd *CloudDashboard) sendCommands(client *ConnectionClient) {
+	for cmd := range client.commandChan {
+		data, _ := json.Marshal(cmd)
+		if err := client.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			log.Printf("Failed to send command to connection server: %v", err)
+			return
+		}
+		cd.commands.Update(cmd.ID, CommandDelivered, "")
+	}
+}
+
+func (cd *CloudDashboard) commandHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cmd := Command{
+			Type:    cmdType,
+			Payload: make(map[string]interface{}),
+			ID:      newCommandID(),
+		}
+		
+		cd.dispatchCommand(w, cmd)
+	}
+}
+
+func (cd *CloudDashboard) accountCommandHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p struct {
+			Account string `json:"account"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		cmd := Command{
+			Type: cmdType,
+			Payload: map[string]interface{}{
+				"account": p.Account,
+			},
+			ID: newCommandID(),
+		}
+
+		cd.dispatchCommand(w, cmd)
+	}
+}
+
+func (cd *CloudDashboard) instrumentCommandHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p struct {
+			Account    string `json:"account"`
+			Instrument string `json:"instrument"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		cmd := Command{
+			Type: cmdType,
+			Payload: map[string]interface{}{
+				"account":    p.Account,
+				"instrument": p.Instrument,
+			},
+			ID: newCommandID(),
+		}
+
+		cd.dispatchCommand(w, cmd)
+	}
+}
 
-func NewCloudDashboard() *CloudDashboard {
-	// Get auth credentials from environment
-	csrfKey := []byte(os.Getenv("CSRF_AUTH_KEY"))
-	if len(csrfKey) != 32 {
-		log.Println("WARNING: CSRF_AUTH_KEY is not set or not 32 bytes. Generating a random key for this session.")
-		csrfKey = make([]byte, 32)
-		rand.Read(csrfKey)
+func (cd *CloudDashboard) orderCommandHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p struct {
+			Account string `json:"account"`
+			OrderId string `json:"orderId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		cmd := Command{
+			Type: cmdType,
+			Payload: map[string]interface{}{
+				"account": p.Account,
+				"orderId": p.OrderId,
+			},
+			ID: newCommandID(),
+		}
+
+		cd.dispatchCommand(w, cmd)
 	}
+}
 
-	dashUser := os.Getenv("DASHBOARD_USER")
-	if dashUser == "" {
-		dashUser = "admin"
+func (cd *CloudDashboard) placeOrderHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p PlaceOrderPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if p.Strategy != "" {
+			// An order naming a template starts an ATM strategy, which
+			// is tracked like one placed through the ATM ticket.
+			cd.placeATMOrder(w, "place_atm_order", p)
+			return
+		}
+		if err := p.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cmd := Command{
+			Type: cmdType,
+			Payload: map[string]interface{}{
+				"account":    p.Account,
+				"instrument": p.Instrument,
+				"action":     p.Action,
+				"quantity":   p.Quantity,
+				"orderType":  p.OrderType,
+				"limitPrice": p.LimitPrice,
+				"stopPrice":  p.StopPrice,
+				"tif":        p.TIF,
+				"ocoId":      p.OcoId,
+				"orderId":    p.OrderId,
+			},
+			ID: newCommandID(),
+		}
+
+		cd.dispatchCommand(w, cmd)
 	}
-	dashPass := os.Getenv("DASHBOARD_PASS")
-	if dashPass == "" {
-		log.Fatal("FATAL: DASHBOARD_PASS environment variable is not set. Please set a strong password for the dashboard user.")
+}
+
+func (cd *CloudDashboard) placeBracketHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p PlaceBracketPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := p.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cmd := Command{
+			Type: cmdType,
+			Payload: map[string]interface{}{
+				"account":     p.Account,
+				"instrument":  p.Instrument,
+				"action":      p.Action,
+				"quantity":    p.Quantity,
+				"entryType":   p.EntryType,
+				"entryPrice":  p.EntryPrice,
+				"stopPrice":   p.StopPrice,
+				"targetPrice": p.TargetPrice,
+				"tif":         p.TIF,
+				"ocoId":       p.OcoId,
+			},
+			ID: newCommandID(),
+		}
+
+		cd.dispatchCommand(w, cmd)
 	}
-	apiSecretToken := os.Getenv("API_SECRET_TOKEN")
-	if apiSecretToken == "" {
-		apiSecretToken = generateRandomKey()
-		log.Printf("Generated API Secret Token: %s", apiSecretToken)
-		log.Printf("Set API_SECRET_TOKEN environment variable to this value for the connection-server.")
+}
+
+func (cd *CloudDashboard) isATMTemplate(name string) bool {
+	// Without a configured list any template name is passed through.
+	if len(cd.atmTemplates) == 0 {
+		return true
 	}
+	for _, t := range cd.atmTemplates {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
 
-	return &CloudDashboard{
-		latest:        make(map[string]Snapshot),
-		webClients:    make(map[chan []byte]bool),
-		connections:   make(map[*websocket.Conn]*ConnectionClient),
-		sessions:      make(map[string]time.Time),
-		dashboardUser: dashUser,
-		dashboardPass: dashPass,
-		apiSecretToken: apiSecretToken,
-		csrfAuthKey:   csrfKey,
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true // Allow all origins
-			},
+func (cd *CloudDashboard) placeATMOrderHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p PlaceOrderPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		cd.placeATMOrder(w, cmdType, p)
+	}
+}
+
+// placeATMOrder dispatches an order that starts an ATM strategy. The
+// strategy id is generated here, never by the connection server, so that
+// the strategy can be tracked from the moment it is sent.
+func (cd *CloudDashboard) placeATMOrder(w http.ResponseWriter, cmdType string, p PlaceOrderPayload) {
+	if p.Strategy == "" {
+		http.Error(w, "ATM strategy template is required", http.StatusBadRequest)
+		return
+	}
+	if !cd.isATMTemplate(p.Strategy) {
+		http.Error(w, fmt.Sprintf("unknown ATM strategy template %q", p.Strategy), http.StatusBadRequest)
+		return
+	}
+	if err := p.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.StrategyId == "" {
+		p.StrategyId = newID("atm")
+	}
+
+	cmd := Command{
+		Type: cmdType,
+		Payload: map[string]interface{}{
+			"account":    p.Account,
+			"instrument": p.Instrument,
+			"action":     p.Action,
+			"quantity":   p.Quantity,
+			"orderType":  p.OrderType,
+			"limitPrice": p.LimitPrice,
+			"stopPrice":  p.StopPrice,
+			"tif":        p.TIF,
+			"ocoId":      p.OcoId,
+			"orderId":    p.OrderId,
+			"strategy":   p.Strategy,
+			"strategyId": p.StrategyId,
 		},
+		ID: newCommandID(),
+	}
+
+	cd.atmStrategiesMu.Lock()
+	cd.pendingATM[cmd.ID] = ATMStrategy{
+		StrategyId: p.StrategyId,
+		Account:    p.Account,
+		Instrument: p.Instrument,
+		Template:   p.Strategy,
+		CommandID:  cmd.ID,
+		StartedAt:  time.Now(),
 	}
+	cd.atmStrategiesMu.Unlock()
+
+	cd.dispatchCommand(w, cmd)
 }
 
-func generateRandomKey() string {
-	bytes := make([]byte, 32)
-	rand.Read(bytes)
-	return base64.URLEncoding.EncodeToString(bytes)
+func (cd *CloudDashboard) closeStrategyHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p struct {
+			Account    string `json:"account"`
+			StrategyId string `json:"strategyId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.StrategyId == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		cmd := Command{
+			Type: cmdType,
+			Payload: map[string]interface{}{
+				"account":    p.Account,
+				"strategyId": p.StrategyId,
+			},
+			ID: newCommandID(),
+		}
+
+		cd.atmStrategiesMu.Lock()
+		delete(cd.atmStrategies, p.StrategyId)
+		cd.atmStrategiesMu.Unlock()
+		cd.broadcastATMStrategies()
+
+		cd.dispatchCommand(w, cmd)
+	}
 }
 
-func (cd *CloudDashboard) Start() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8081"
+// resolveATMStrategy moves the strategy started by command id into the
+// list once the connection server acknowledges it, or drops it when the
+// command failed.
+func (cd *CloudDashboard) resolveATMStrategy(id string, started bool) {
+	cd.atmStrategiesMu.Lock()
+	s, ok := cd.pendingATM[id]
+	delete(cd.pendingATM, id)
+	if ok && started {
+		s.StartedAt = time.Now()
+		cd.atmStrategies[s.StrategyId] = s
 	}
+	cd.atmStrategiesMu.Unlock()
+	if ok && started {
+		cd.broadcastATMStrategies()
+	}
+}
 
-	go cd.cleanupExpiredSessions(1 * time.Hour)
+// pruneATMStrategies drops the strategies on snap's account whose
+// instrument has neither a position nor working orders any more, and ATM
+// orders that were never acknowledged.
+func (cd *CloudDashboard) pruneATMStrategies(snap Snapshot) {
+	active := make(map[string]bool)
+	for _, pos := range snap.Positions {
+		if pos.MarketPosition != "Flat" && pos.Quantity > 0 {
+			active[pos.Instrument] = true
+		}
+	}
+	for _, o := range snap.WorkingOrders {
+		active[o.Instrument] = true
+	}
 
-	mux := http.NewServeMux()
-	// Authentication routes
-	mux.HandleFunc("/login", cd.loginHandler)
-	mux.HandleFunc("/logout", cd.logoutHandler)
+	changed := false
+	cd.atmStrategiesMu.Lock()
+	for id, s := range cd.atmStrategies {
+		if s.Account != snap.Account {
+			continue
+		}
+		if active[s.Instrument] {
+			if !s.active {
+				s.active = true
+				cd.atmStrategies[id] = s
+			}
+		} else if s.active || time.Since(s.StartedAt) > atmSettleTime {
+			delete(cd.atmStrategies, id)
+			changed = true
+		}
+	}
+	for id, s := range cd.pendingATM {
+		if time.Since(s.StartedAt) > 24*time.Hour {
+			delete(cd.pendingATM, id)
+		}
+	}
+	cd.atmStrategiesMu.Unlock()
+	if changed {
+		cd.broadcastATMStrategies()
+	}
+}
 
-	// Protected routes
-	mux.HandleFunc("/", cd.requireAuth(cd.dashboardHandler))
-	mux.HandleFunc("/events", cd.requireAuth(cd.eventsHandler))
-	mux.HandleFunc("/api/flatten", cd.requireAuth(cd.commandHandler("flatten_all")))
-	mux.HandleFunc("/api/flatten_account", cd.requireAuth(cd.accountCommandHandler("flatten_account")))
-	mux.HandleFunc("/api/close_position", cd.requireAuth(cd.instrumentCommandHandler("close_position")))
-	mux.HandleFunc("/api/cancel_order", cd.requireAuth(cd.orderCommandHandler("cancel_order")))
+func (cd *CloudDashboard) atmStrategyList() []ATMStrategy {
+	cd.atmStrategiesMu.Lock()
+	list := make([]ATMStrategy, 0, len(cd.atmStrategies))
+	for _, s := range cd.atmStrategies {
+		list = append(list, s)
+	}
+	cd.atmStrategiesMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+func (cd *CloudDashboard) broadcastATMStrategies() {
+	b, _ := json.Marshal(cd.atmStrategyList())
+	cd.broadcastEvent("atm_strategies", b)
+}
+
+func (cd *CloudDashboard) atmStrategiesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cd.atmStrategyList())
+}
+
+func (cd *CloudDashboard) breakevenHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p struct {
+			Account     string `json:"account"`
+			Instrument  string `json:"instrument"`
+			OffsetTicks int    `json:"offsetTicks"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.Account == "" || p.Instrument == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		cmd := Command{
+			Type: cmdType,
+			Payload: map[string]interface{}{
+				"account":     p.Account,
+				"instrument":  p.Instrument,
+				"offsetTicks": p.OffsetTicks,
+			},
+			ID: newCommandID(),
+		}
+
+		cd.dispatchCommand(w, cmd)
+	}
+}
+
+func (cd *CloudDashboard) nudgeOrderHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p struct {
+			Account string `json:"account"`
+			OrderId string `json:"orderId"`
+			Ticks   int    `json:"ticks"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.OrderId == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if p.Ticks == 0 {
+			http.Error(w, "ticks must not be zero", http.StatusBadRequest)
+			return
+		}
+
+		cmd := Command{
+			Type: cmdType,
+			Payload: map[string]interface{}{
+				"account": p.Account,
+				"orderId": p.OrderId,
+				"ticks":   p.Ticks,
+			},
+			ID: newCommandID(),
+		}
+
+		cd.dispatchCommand(w, cmd)
+	}
+}
+
+func (cd *CloudDashboard) armTrailHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p struct {
+			Account    string  `json:"account"`
+			Instrument string  `json:"instrument"`
+			Mode       string  `json:"mode"`
+			Distance   float64 `json:"distance"`
+			StepTicks  int     `json:"stepTicks"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.Account == "" || p.Instrument == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if p.Mode != "ticks" && p.Mode != "percent" {
+			http.Error(w, "trail mode must be ticks or percent", http.StatusBadRequest)
+			return
+		}
+		if p.Distance <= 0 || p.StepTicks < 0 {
+			http.Error(w, "trail distance must be positive", http.StatusBadRequest)
+			return
+		}
+
+		cmd := Command{
+			Type: cmdType,
+			Payload: map[string]interface{}{
+				"account":    p.Account,
+				"instrument": p.Instrument,
+				"mode":       p.Mode,
+				"distance":   p.Distance,
+				"stepTicks":  p.StepTicks,
+			},
+			ID: newCommandID(),
+		}
+
+		cd.dispatchCommand(w, cmd)
+	}
+}
+
+func (cd *CloudDashboard) changeOrderHandler(cmdType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p ChangeOrderPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := p.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cmd := Command{
+			Type: cmdType,
+			Payload: map[string]interface{}{
+				"account":    p.Account,
+				"orderId":    p.OrderId,
+				"quantity":   p.Quantity,
+				"limitPrice": p.LimitPrice,
+				"stopPrice":  p.StopPrice,
+				"strategyId": p.StrategyId,
+			},
+			ID: newCommandID(),
+		}
+
+		cd.dispatchCommand(w, cmd)
+	}
+}
 
-	// WebSocket with API key auth (CSRF protection is not needed for WebSockets)
-	mux.HandleFunc("/ws", cd.websocketHandler)
+// submitCommand registers cmd with the command registry, queues it durably
+// and relays it to the connection servers. It returns once the command is
+// delivered, queued for a connection server, or rejected.
+func (cd *CloudDashboard) submitCommand(cmd Command) (CommandRecord, error) {
+	ttl, ok := cd.commandTTLs[cmd.Type]
+	if !ok {
+		ttl = cd.defaultTTL
+	}
+	cmd.IssuedAt = time.Now()
+	cmd.TTLSeconds = ttl.Seconds()
+	rec := cd.commands.Add(cmd)
 
-	// CSRF Middleware
-	isSecure := os.Getenv("ENV") == "production" // A simple way to detect production
-	csrfMiddleware := csrf.Protect(cd.csrfAuthKey, csrf.Secure(isSecure))
+	account := commandAccount(cmd)
+	owner := cd.accountOwner(account)
+	var err error
+	if account != "" && owner == "" {
+		err = fmt.Errorf("%w %s: no connection server has reported it", errUnknownAccount, account)
+	} else if until, locked := cd.lockedUntil(account); locked && orderEntryCommands[cmd.Type] {
+		err = fmt.Errorf("%w: account %s is locked out of new orders until %s", errLockedOut, account, until.Format(time.RFC3339))
+	} else {
+		err = cd.queue.Push(cmd)
+	}
+	if err != nil {
+		cd.commands.Update(cmd.ID, CommandRejected, err.Error())
+		rec, _ = cd.commands.Get(cmd.ID)
+		return rec, err
+	}
+	if !cd.sendCommandToConnections(cmd) {
+		waiting := "waiting for a connection server"
+		if owner != "" {
+			waiting = fmt.Sprintf("waiting for connection server %q", owner)
+		}
+		cd.commands.Update(cmd.ID, CommandQueued, waiting)
+	}
+	return cd.commands.Wait(cmd.ID, 2*time.Second, func(r CommandRecord) bool {
+		return r.Status != CommandPending
+	}), nil
+}
 
-	log.Printf("Starting Cloud Dashboard on :%s", port)
-	log.Printf("Dashboard: http://localhost:%s", port)
-	log.Printf("Default login: %s / %s", cd.dashboardUser, cd.dashboardPass)
-	log.Fatal(http.ListenAndServe("0.0.0.0:"+port, csrfMiddleware(mux)))
+// dispatchCommand submits cmd and tells the caller which id to follow in the
+// command log and whether the command was delivered, queued or rejected.
+func (cd *CloudDashboard) dispatchCommand(w http.ResponseWriter, cmd Command) {
+	rec, err := cd.submitCommand(cmd)
+	resp := map[string]string{
+		"id":     rec.ID,
+		"status": rec.Status,
+	}
+	code := http.StatusOK
+	if errors.Is(err, errUnknownAccount) {
+		resp["error"] = err.Error()
+		code = http.StatusBadRequest
+	} else if errors.Is(err, errLockedOut) {
+		resp["error"] = err.Error()
+		code = http.StatusForbidden
+	} else if err != nil {
+		resp["error"] = err.Error()
+		code = http.StatusServiceUnavailable
+	} else if rec.Status == CommandQueued {
+		code = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
 }
 
-func (cd *CloudDashboard) dashboardHandler(w http.ResponseWriter, r *http.Request) {
-	tpl.Execute(w, map[string]interface{}{
-		"CSRFToken": csrf.Token(r),
-	})
+// flushQueue retries queued commands and expires those past their TTL. With
+// all set, as when a connection server connects, every unacknowledged
+// command is redelivered rather than only those still waiting.
+func (cd *CloudDashboard) flushQueue(all bool) {
+	for _, cmd := range cd.queue.List() {
+		if exp := cmd.expiresAt(); exp != nil && time.Now().After(*exp) {
+			cd.queue.Remove(cmd.ID)
+			cd.commands.Update(cmd.ID, CommandExpired, "expired before it could be delivered")
+			continue
+		}
+		rec, ok := cd.commands.Get(cmd.ID)
+		if all || !ok || rec.Status == CommandQueued {
+			cd.sendCommandToConnections(cmd)
+		}
+	}
 }
 
-func (cd *CloudDashboard) cleanupExpiredSessions(interval time.Duration) {
-	ticker := time.NewTicker(interval)
+func (cd *CloudDashboard) expireCommands() {
+	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
+	for range ticker.C {
+		cd.commands.ExpirePending(cd.ackTimeout)
+		cd.flushQueue(false)
+	}
+}
 
-	for {
-		<-ticker.C
-		cd.sessionsMu.Lock()
-		for sessionID, creationTime := range cd.sessions {
-			if time.Since(creationTime) > 24*time.Hour {
-				delete(cd.sessions, sessionID)
-			}
-		}
-		cd.sessionsMu.Unlock()
-		log.Println("Cleaned up expired sessions.")
+// commandsHandler serves GET /api/commands and GET /api/commands/{id}.
+func (cd *CloudDashboard) commandsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/commands"), "/")
+	if id == "" {
+		json.NewEncoder(w).Encode(cd.commands.List())
+		return
+	}
+	rec, ok := cd.commands.Get(id)
+	if !ok {
+		http.Error(w, "command not found", http.StatusNotFound)
+		return
 	}
+	json.NewEncoder(w).Encode(rec)
 }
 
-// Authentication middleware
-func (cd *CloudDashboard) requireAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		sessionCookie, err := r.Cookie("session")
-		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
+func (cd *CloudDashboard) schedulesPath() string {
+	return filepath.Join(cd.stateDir, "schedules.json")
+}
 
-		cd.sessionsMu.Lock()
-		sessionTime, exists := cd.sessions[sessionCookie.Value]
-		cd.sessionsMu.Unlock()
+func (cd *CloudDashboard) loadSchedules() {
+	var schedules []*Schedule
+	if err := readJSONFile(cd.schedulesPath(), &schedules); err != nil {
+		log.Printf("Failed to load schedules: %v", err)
+		return
+	}
+	cd.schedulesMu.Lock()
+	for _, sc := range schedules {
+		cd.schedules[sc.ID] = sc
+	}
+	cd.schedulesMu.Unlock()
+	if len(schedules) > 0 {
+		log.Printf("Restored %d schedule(s)", len(schedules))
+	}
+}
 
-		if !exists || time.Since(sessionTime) > 24*time.Hour {
-			// Session expired
-			cd.sessionsMu.Lock()
-			delete(cd.sessions, sessionCookie.Value)
-			cd.sessionsMu.Unlock()
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
+// scheduleListLocked returns the schedules ordered by next run, disabled
+// ones last. schedulesMu must be held.
+func (cd *CloudDashboard) scheduleListLocked() []Schedule {
+	list := make([]Schedule, 0, len(cd.schedules))
+	for _, sc := range cd.schedules {
+		list = append(list, *sc)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].NextRun, list[j].NextRun
+		if a == nil || b == nil {
+			return a != nil || (b == nil && list[i].ID < list[j].ID)
 		}
+		return a.Before(*b)
+	})
+	return list
+}
 
-		// Update session time
-		cd.sessionsMu.Lock()
-		cd.sessions[sessionCookie.Value] = time.Now()
-		cd.sessionsMu.Unlock()
+// saveSchedulesLocked persists the schedules and pushes them to the
+// browsers. schedulesMu must be held.
+func (cd *CloudDashboard) saveSchedulesLocked() {
+	list := cd.scheduleListLocked()
+	if err := writeJSONFile(cd.schedulesPath(), list); err != nil {
+		log.Printf("Failed to save schedules: %v", err)
+	}
+	if b, err := json.Marshal(list); err == nil {
+		cd.broadcastEvent("schedules", b)
+	}
+}
 
-		next(w, r)
+// runSchedules dispatches due schedules through the normal command path.
+func (cd *CloudDashboard) runSchedules() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		cd.runDueSchedules(time.Now())
 	}
 }
 
-func (cd *CloudDashboard) loginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		loginTpl.Execute(w, nil)
-		return
+func (cd *CloudDashboard) runDueSchedules(now time.Time) {
+	var due []Schedule
+	cd.schedulesMu.Lock()
+	changed := false
+	for _, sc := range cd.schedules {
+		if !sc.Enabled || sc.NextRun == nil || now.Before(*sc.NextRun) {
+			continue
+		}
+		if now.Sub(*sc.NextRun) > scheduleMissedGrace {
+			cd.addAlert(Alert{Level: "warning", Source: "scheduler", Message: fmt.Sprintf(
+				"Skipped schedule %q due at %s; the dashboard was not running", sc.Name, sc.NextRun.Format(time.RFC3339))})
+		} else {
+			due = append(due, *sc)
+			ran := now
+			sc.LastRun = &ran
+		}
+		sc.NextRun = sc.next(now)
+		if sc.NextRun == nil {
+			sc.Enabled = false
+		}
+		changed = true
 	}
+	if changed {
+		cd.saveSchedulesLocked()
+	}
+	cd.schedulesMu.Unlock()
 
-	if r.Method == "POST" {
-		username := r.FormValue("username")
-		password := r.FormValue("password")
+	for _, sc := range due {
+		payload := make(map[string]interface{}, len(sc.Payload))
+		for k, v := range sc.Payload {
+			payload[k] = v
+		}
+		cmd := Command{Type: sc.Type, Payload: payload, ID: newCommandID()}
+		log.Printf("Running schedule %q: %s", sc.Name, sc.Type)
+		if _, err := cd.submitCommand(cmd); err != nil {
+			cd.addAlert(Alert{Level: "error", Source: "scheduler", Message: fmt.Sprintf("Schedule %q failed: %v", sc.Name, err)})
+		}
+		cd.schedulesMu.Lock()
+		if stored, ok := cd.schedules[sc.ID]; ok {
+			stored.LastCommandID = cmd.ID
+			cd.saveSchedulesLocked()
+		}
+		cd.schedulesMu.Unlock()
+	}
+}
 
-		// Constant-time comparison to prevent timing attacks
-		usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(cd.dashboardUser)) == 1
-		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(cd.dashboardPass)) == 1
+// schedulesHandler serves GET and POST /api/schedules and GET, PUT and
+// DELETE /api/schedules/{id}.
+func (cd *CloudDashboard) schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/schedules"), "/")
 
-		if usernameOK && passwordOK {
-			// Create session
-			sessionID := generateRandomKey()
-			cd.sessionsMu.Lock()
-			cd.sessions[sessionID] = time.Now()
-			cd.sessionsMu.Unlock()
+	cd.schedulesMu.Lock()
+	defer cd.schedulesMu.Unlock()
 
-			// Set cookie
-			http.SetCookie(w, &http.Cookie{
-				Name:     "session",
-				Value:    sessionID,
-				Path:     "/",
-				HttpOnly: true,
-				Secure:   strings.HasPrefix(r.Header.Get("X-Forwarded-Proto"), "https"),
-				SameSite: http.SameSiteLaxMode,
-			})
+	existing, found := cd.schedules[id]
+	if id != "" && !found {
+		http.Error(w, "schedule not found", http.StatusNotFound)
+		return
+	}
 
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		json.NewEncoder(w).Encode(cd.scheduleListLocked())
+	case r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(existing)
+	case r.Method == http.MethodPost && id == "", r.Method == http.MethodPut && id != "":
+		var sc Schedule
+		if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
 			return
 		}
-
-		// Invalid credentials
-		loginTpl.Execute(w, map[string]string{"Error": "Invalid username or password"})
-		return
+		if err := sc.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if id == "" {
+			sc.ID = newID("sched")
+		} else {
+			sc.ID = id
+			sc.LastRun, sc.LastCommandID = existing.LastRun, existing.LastCommandID
+		}
+		sc.NextRun = sc.next(time.Now())
+		// A finished one-shot schedule may still be renamed or disabled;
+		// only a newly set date in the past is refused.
+		rescheduled := !found || sc.Date != existing.Date || sc.Time != existing.Time || sc.Timezone != existing.Timezone
+		if sc.NextRun == nil && sc.Enabled && rescheduled {
+			http.Error(w, "schedule would never run: the date is in the past", http.StatusBadRequest)
+			return
+		}
+		cd.schedules[sc.ID] = &sc
+		cd.saveSchedulesLocked()
+		json.NewEncoder(w).Encode(sc)
+	case r.Method == http.MethodDelete && id != "":
+		delete(cd.schedules, id)
+		cd.saveSchedulesLocked()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (cd *CloudDashboard) logoutHandler(w http.ResponseWriter, r *http.Request) {
-	sessionCookie, err := r.Cookie("session")
-	if err == nil {
-		cd.sessionsMu.Lock()
-		delete(cd.sessions, sessionCookie.Value)
-		cd.sessionsMu.Unlock()
-	}
-
-	// Clear cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    "",
-		Path:     "/",
-		Expires:  time.Now().Add(-time.Hour),
-		HttpOnly: true,
-	})
-
-	http.Redirect(w, r, "/login", http.StatusSeeOther)
+func (cd *CloudDashboard) rulesPath() string {
+	return filepath.Join(cd.stateDir, "rules.json")
 }
 
-func (cd *CloudDashboard) websocketHandler(w http.ResponseWriter, r *http.Request) {
-	// Check API key for WebSocket connections (connection servers)
-	authHeader := r.Header.Get("Authorization")
-	expectedHeader := "Bearer " + cd.apiSecretToken
-	if subtle.ConstantTimeCompare([]byte(authHeader), []byte(expectedHeader)) != 1 {
-		// To prevent token leakage, log a generic unauthorized message.
-		log.Printf("WebSocket unauthorized: Invalid token.")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+func (cd *CloudDashboard) loadRules() {
+	var rules []*Rule
+	if err := readJSONFile(cd.rulesPath(), &rules); err != nil {
+		log.Printf("Failed to load rules: %v", err)
 		return
 	}
-	conn, err := cd.upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
+	cd.rulesMu.Lock()
+	for _, ru := range rules {
+		if err := ru.validate(); err != nil {
+			log.Printf("Dropping invalid rule %q: %v", ru.Name, err)
+			continue
+		}
+		cd.rules[ru.ID] = ru
 	}
-
-	client := &ConnectionClient{
-		conn:        conn,
-		commandChan: make(chan Command, 10),
-		id:          fmt.Sprintf("conn_%d", time.Now().UnixNano()),
+	cd.rulesMu.Unlock()
+	if len(rules) > 0 {
+		log.Printf("Restored %d rule(s)", len(rules))
 	}
 
-	cd.connectionsMu.Lock()
-	cd.connections[conn] = client
-	cd.connectionsMu.Unlock()
+	var firings []RuleFiring
+	if err := readJSONFile(cd.ruleFiringsPath(), &firings); err != nil {
+		log.Printf("Failed to load rule firings: %v", err)
+		return
+	}
+	if len(firings) > maxRuleFirings {
+		firings = firings[len(firings)-maxRuleFirings:]
+	}
+	cd.rulesMu.Lock()
+	cd.ruleFirings = firings
+	cd.rulesMu.Unlock()
+}
 
-	log.Printf("Connection server connected: %s", client.id)
+func (cd *CloudDashboard) ruleFiringsPath() string {
+	return filepath.Join(cd.stateDir, "rule_firings.json")
+}
 
-	// Send initial snapshot if available
-	cd.mu.RLock()
-	if len(cd.latest) > 0 {
-		data, _ := json.Marshal(WebSocketMessage{
-			Type: "snapshot",
-			Data: cd.latest,
-		})
-		cd.mu.RUnlock()
-		conn.WriteMessage(websocket.TextMessage, data)
-	} else {
-		cd.mu.RUnlock()
+// ruleListLocked returns the rules ordered by name. rulesMu must be held.
+func (cd *CloudDashboard) ruleListLocked() []Rule {
+	list := make([]Rule, 0, len(cd.rules))
+	for _, ru := range cd.rules {
+		list = append(list, *ru)
 	}
-
-	// Start goroutines for this connection
-	go cd.handleConnection(client)
-	go cd.sendCommands(client)
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
 }
 
-func (cd *CloudDashboard) handleConnection(client *ConnectionClient) {
-	defer func() {
-		cd.connectionsMu.Lock()
-		delete(cd.connections, client.conn)
-		cd.connectionsMu.Unlock()
-		close(client.commandChan)
-		client.conn.Close()
-		log.Printf("Connection server disconnected: %s", client.id)
-	}()
+// saveRulesLocked persists the rules and pushes them to the browsers.
+// rulesMu must be held.
+func (cd *CloudDashboard) saveRulesLocked() {
+	list := cd.ruleListLocked()
+	if err := writeJSONFile(cd.rulesPath(), list); err != nil {
+		log.Printf("Failed to save rules: %v", err)
+	}
+	if b, err := json.Marshal(list); err == nil {
+		cd.broadcastEvent("rules", b)
+	}
+}
 
-	for {
-		_, message, err := client.conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
-			}
-			break
+// evaluateRules checks the armed rules for snap's account and dispatches the
+// commands of those that fire.
+func (cd *CloudDashboard) evaluateRules(snap Snapshot) {
+	var fired []RuleFiring
+	var commands []Command
+	cd.rulesMu.Lock()
+	for _, ru := range cd.rules {
+		if !ru.Armed || ru.Account != snap.Account {
+			continue
 		}
-
-		var msg WebSocketMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("Invalid WebSocket message: %v", err)
+		values := ruleValues(snap, ru.Instrument)
+		if !ru.evaluate(values) {
 			continue
 		}
+		now := time.Now()
+		ru.LastFired = &now
+		ru.FireCount++
+		if !ru.Repeat {
+			ru.Armed = false
+		}
+		payload := make(map[string]interface{}, len(ru.Payload))
+		for k, v := range ru.Payload {
+			payload[k] = v
+		}
+		cmd := Command{Type: ru.Type, Payload: payload, ID: newCommandID()}
+		commands = append(commands, cmd)
+		fired = append(fired, RuleFiring{
+			RuleID:    ru.ID,
+			Name:      ru.Name,
+			Account:   ru.Account,
+			Condition: ru.Condition,
+			Values:    ru.describeValues(values),
+			CommandID: cmd.ID,
+			Time:      now,
+		})
+	}
+	if len(fired) > 0 {
+		cd.ruleFirings = append(cd.ruleFirings, fired...)
+		if len(cd.ruleFirings) > maxRuleFirings {
+			cd.ruleFirings = cd.ruleFirings[len(cd.ruleFirings)-maxRuleFirings:]
+		}
+		if err := writeJSONFile(cd.ruleFiringsPath(), cd.ruleFirings); err != nil {
+			log.Printf("Failed to save rule firings: %v", err)
+		}
+		cd.saveRulesLocked()
+	}
+	cd.rulesMu.Unlock()
 
-		switch msg.Type {
-		case "snapshot":
-			if dataMap, ok := msg.Data.(map[string]interface{}); ok {
-				cd.mu.Lock()
-				for account, snapData := range dataMap {
-					if snapBytes, err := json.Marshal(snapData); err == nil {
-						var snap Snapshot
-						if err := json.Unmarshal(snapBytes, &snap); err == nil {
-							cd.latest[account] = snap
-						}
-					}
-				}
-				broadcastData, _ := json.Marshal(cd.latest)
-				cd.mu.Unlock()
-				cd.broadcast(broadcastData)
+	for i, f := range fired {
+		cd.addAlert(Alert{Level: "warning", Source: "rule", Account: f.Account, Message: fmt.Sprintf(
+			"Rule %q fired on %s (%s): %s", f.Name, f.Condition, f.Values, commands[i].Type)})
+		if b, err := json.Marshal(f); err == nil {
+			cd.broadcastEvent("rule_fired", b)
+		}
+		// Dispatch off the connection's read loop, which has to keep
+		// reading for the acknowledgment submitCommand waits for.
+		go func(cmd Command, name string) {
+			if _, err := cd.submitCommand(cmd); err != nil {
+				cd.addAlert(Alert{Level: "error", Source: "rule", Message: fmt.Sprintf("Rule %q failed: %v", name, err)})
 			}
-		case "command_ack":
-			log.Printf("Command acknowledged: %s", msg.ID)
-		default:
-			log.Printf("Unknown message type: %s", msg.Type)
+		}(commands[i], f.Name)
+	}
+}
+
+// rulesHandler serves GET and POST /api/rules and GET, PUT and DELETE
+// /api/rules/{id}.
+func (cd *CloudDashboard) rulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/rules"), "/")
+
+	cd.rulesMu.Lock()
+	defer cd.rulesMu.Unlock()
+
+	existing, found := cd.rules[id]
+	if id != "" && !found {
+		http.Error(w, "rule not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		json.NewEncoder(w).Encode(cd.ruleListLocked())
+	case r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(existing)
+	case r.Method == http.MethodPost && id == "", r.Method == http.MethodPut && id != "":
+		var ru Rule
+		if err := json.NewDecoder(r.Body).Decode(&ru); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
 		}
+		if err := ru.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if id == "" {
+			ru.ID = newID("rule")
+			ru.LastFired, ru.FireCount = nil, 0
+		} else {
+			ru.ID = id
+			ru.LastFired, ru.FireCount = existing.LastFired, existing.FireCount
+		}
+		cd.rules[ru.ID] = &ru
+		cd.saveRulesLocked()
+		json.NewEncoder(w).Encode(ru)
+	case r.Method == http.MethodDelete && id != "":
+		delete(cd.rules, id)
+		cd.saveRulesLocked()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (cd *CloudDashboard) ruleFiringsHandler(w http.ResponseWriter, r *http.Request) {
+	cd.rulesMu.Lock()
+	firings := append([]RuleFiring{}, cd.ruleFirings...)
+	cd.rulesMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(firings)
+}
+
+func (cd *CloudDashboard) macrosPath() string {
+	return filepath.Join(cd.stateDir, "macros.json")
+}
+
+func (cd *CloudDashboard) loadMacros() {
+	var macros []*Macro
+	if err := readJSONFile(cd.macrosPath(), &macros); err != nil {
+		log.Printf("Failed to load macros: %v", err)
+		return
+	}
+	cd.macrosMu.Lock()
+	for _, m := range macros {
+		cd.macros[m.Name] = m
 	}
+	cd.macrosMu.Unlock()
 }
 
-func (cd *CloudDashboard) sendCommands(client *ConnectionClient) {
-	for cmd := range client.commandChan {
-		data, _ := json.Marshal(cmd)
-		if err := client.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-			log.Printf("Failed to send command to connection server: %v", err)
-			return
-		}
+// macroListLocked returns the macros ordered by name. macrosMu must be held.
+func (cd *CloudDashboard) macroListLocked() []Macro {
+	list := make([]Macro, 0, len(cd.macros))
+	for _, m := range cd.macros {
+		list = append(list, *m)
 	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
 }
 
-func (cd *CloudDashboard) commandHandler(cmdType string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		cmd := Command{
-			Type:    cmdType,
-			Payload: make(map[string]interface{}),
-			ID:      fmt.Sprintf("cmd_%d", time.Now().UnixNano()),
+// macrosHandler serves GET and POST /api/macros, GET and DELETE
+// /api/macros/{name} and POST /api/macros/{name}/run. POST /api/macros
+// creates or replaces the macro with the given name.
+func (cd *CloudDashboard) macrosHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/macros"), "/")
+	if strings.HasSuffix(name, "/run") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-		
-		cd.sendCommandToConnections(cmd)
-		w.WriteHeader(http.StatusOK)
+		cd.runMacroHandler(w, r, strings.TrimSuffix(name, "/run"))
+		return
 	}
-}
 
-func (cd *CloudDashboard) accountCommandHandler(cmdType string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var p struct {
-			Account string `json:"account"`
+	cd.macrosMu.Lock()
+	defer cd.macrosMu.Unlock()
+
+	existing, found := cd.macros[name]
+	if name != "" && !found {
+		http.Error(w, "macro not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		json.NewEncoder(w).Encode(cd.macroListLocked())
+	case r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(existing)
+	case r.Method == http.MethodPost && name == "":
+		var m Macro
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
 		}
-		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
+		if err := m.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		cd.macros[m.Name] = &m
+		cd.saveMacrosLocked()
+		json.NewEncoder(w).Encode(m)
+	case r.Method == http.MethodDelete && name != "":
+		delete(cd.macros, name)
+		cd.saveMacrosLocked()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-		cmd := Command{
-			Type: cmdType,
-			Payload: map[string]interface{}{
-				"account": p.Account,
-			},
-			ID: fmt.Sprintf("cmd_%d", time.Now().UnixNano()),
-		}
+// saveMacrosLocked persists the macros and pushes them to the browsers.
+// macrosMu must be held.
+func (cd *CloudDashboard) saveMacrosLocked() {
+	list := cd.macroListLocked()
+	if err := writeJSONFile(cd.macrosPath(), list); err != nil {
+		log.Printf("Failed to save macros: %v", err)
+	}
+	if b, err := json.Marshal(list); err == nil {
+		cd.broadcastEvent("macros", b)
+	}
+}
+
+func (cd *CloudDashboard) runMacroHandler(w http.ResponseWriter, r *http.Request, name string) {
+	var p struct {
+		Account string `json:"account"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.Account == "" {
+		http.Error(w, "account is required", http.StatusBadRequest)
+		return
+	}
+	if cd.accountOwner(p.Account) == "" {
+		http.Error(w, fmt.Sprintf("%v %s: no connection server has reported it", errUnknownAccount, p.Account), http.StatusBadRequest)
+		return
+	}
 
-		cd.sendCommandToConnections(cmd)
-		w.WriteHeader(http.StatusOK)
+	cd.macrosMu.Lock()
+	m, ok := cd.macros[name]
+	var macro Macro
+	if ok {
+		macro = *m
 	}
+	run := &MacroRun{
+		ID:        newID("macro"),
+		Macro:     name,
+		Account:   p.Account,
+		Status:    "running",
+		StartedAt: time.Now(),
+	}
+	if ok {
+		cd.macroRuns = append(cd.macroRuns, run)
+		if len(cd.macroRuns) > 50 {
+			cd.macroRuns = cd.macroRuns[len(cd.macroRuns)-50:]
+		}
+	}
+	cd.macrosMu.Unlock()
+	if !ok {
+		http.Error(w, "macro not found", http.StatusNotFound)
+		return
+	}
+
+	go cd.runMacro(macro, run)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"id": run.ID, "status": run.Status})
 }
 
-func (cd *CloudDashboard) instrumentCommandHandler(cmdType string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var p struct {
-			Account    string `json:"account"`
-			Instrument string `json:"instrument"`
+// runMacro executes the steps of m in order, waiting for each command's
+// acknowledgment, and stops at the first failure.
+func (cd *CloudDashboard) runMacro(m Macro, run *MacroRun) {
+	log.Printf("Running macro %q on %s", m.Name, run.Account)
+	fail := func(i int, err string) {
+		cd.updateMacroRun(run, func() {
+			run.Steps[i].Status = "failed"
+			run.Steps[i].Error = err
+			run.Status = "failed"
+			run.Error = fmt.Sprintf("step %d (%s): %s", i+1, run.Steps[i].Type, err)
+		})
+	}
+
+	cd.updateMacroRun(run, func() {
+		for _, step := range m.Steps {
+			run.Steps = append(run.Steps, MacroRunStep{Type: step.Type, Status: "waiting"})
 		}
-		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
+	})
+	for i, step := range m.Steps {
+		if step.Type == "lockout" {
+			d, _ := time.ParseDuration(step.Duration)
+			cd.lockAccount(run.Account, time.Now().Add(d))
+			cd.updateMacroRun(run, func() { run.Steps[i].Status = "done" })
+			continue
+		}
+
+		payload := map[string]interface{}{}
+		for k, v := range step.Payload {
+			payload[k] = v
+		}
+		if automatedCommands[step.Type] {
+			payload["account"] = run.Account
+		}
+		cmd := Command{Type: step.Type, Payload: payload, ID: newCommandID()}
+		cd.updateMacroRun(run, func() {
+			run.Steps[i].CommandID = cmd.ID
+			run.Steps[i].Status = "running"
+		})
+		if _, err := cd.submitCommand(cmd); err != nil {
+			fail(i, err.Error())
 			return
 		}
 
-		cmd := Command{
-			Type: cmdType,
-			Payload: map[string]interface{}{
-				"account":    p.Account,
-				"instrument": p.Instrument,
-			},
-			ID: fmt.Sprintf("cmd_%d", time.Now().UnixNano()),
+		timeout := cd.ackTimeout
+		if step.WaitFor == CommandVerified {
+			timeout += time.Minute
+		}
+		rec := cd.commands.Wait(cmd.ID, timeout, func(r CommandRecord) bool {
+			if step.WaitFor == CommandVerified {
+				return commandStatusRank[r.Status] >= commandStatusRank[CommandVerified] || r.Status == CommandFailed
+			}
+			return commandStatusRank[r.Status] >= commandStatusRank[CommandAcknowledged]
+		})
+		if rec.Status != step.WaitFor && !(step.WaitFor == CommandAcknowledged && rec.Status == CommandVerified) {
+			reason := rec.Error
+			if reason == "" {
+				reason = "command is " + strings.ReplaceAll(rec.Status, "_", " ")
+			}
+			fail(i, reason)
+			return
 		}
+		cd.updateMacroRun(run, func() { run.Steps[i].Status = rec.Status })
+	}
+	cd.updateMacroRun(run, func() { run.Status = "succeeded" })
+}
 
-		cd.sendCommandToConnections(cmd)
-		w.WriteHeader(http.StatusOK)
+// updateMacroRun applies change to run, stamps it finished once it is no
+// longer running and pushes it to the browsers.
+func (cd *CloudDashboard) updateMacroRun(run *MacroRun, change func()) {
+	cd.macrosMu.Lock()
+	change()
+	if run.Status != "running" && run.FinishedAt == nil {
+		now := time.Now()
+		run.FinishedAt = &now
+		log.Printf("Macro %q on %s %s %s", run.Macro, run.Account, run.Status, run.Error)
+	}
+	b, err := json.Marshal(run)
+	cd.macrosMu.Unlock()
+	if err == nil {
+		cd.broadcastEvent("macro_run", b)
 	}
 }
 
-func (cd *CloudDashboard) orderCommandHandler(cmdType string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var p struct {
-			Account string `json:"account"`
-			OrderId string `json:"orderId"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
-			return
+func (cd *CloudDashboard) macroRunsHandler(w http.ResponseWriter, r *http.Request) {
+	cd.macrosMu.Lock()
+	b, err := json.Marshal(cd.macroRuns)
+	cd.macrosMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (cd *CloudDashboard) lockoutsPath() string {
+	return filepath.Join(cd.stateDir, "lockouts.json")
+}
+
+func (cd *CloudDashboard) loadLockouts() {
+	if err := readJSONFile(cd.lockoutsPath(), &cd.lockouts); err != nil {
+		log.Printf("Failed to load lockouts: %v", err)
+	}
+}
+
+// lockAccount blocks new orders on account until until, extending but never
+// shortening an existing lockout.
+func (cd *CloudDashboard) lockAccount(account string, until time.Time) {
+	cd.lockoutsMu.Lock()
+	if until.After(cd.lockouts[account]) {
+		cd.lockouts[account] = until
+	}
+	for acc, t := range cd.lockouts {
+		if time.Now().After(t) {
+			delete(cd.lockouts, acc)
 		}
+	}
+	if err := writeJSONFile(cd.lockoutsPath(), cd.lockouts); err != nil {
+		log.Printf("Failed to save lockouts: %v", err)
+	}
+	b, _ := json.Marshal(cd.lockouts)
+	cd.lockoutsMu.Unlock()
+	log.Printf("Account %s locked out of new orders until %s", account, until.Format(time.RFC3339))
+	cd.broadcastEvent("lockouts", b)
+}
 
-		cmd := Command{
-			Type: cmdType,
-			Payload: map[string]interface{}{
-				"account": p.Account,
-				"orderId": p.OrderId,
-			},
-			ID: fmt.Sprintf("cmd_%d", time.Now().UnixNano()),
+func (cd *CloudDashboard) lockedUntil(account string) (time.Time, bool) {
+	cd.lockoutsMu.Lock()
+	defer cd.lockoutsMu.Unlock()
+	until, ok := cd.lockouts[account]
+	return until, ok && time.Now().Before(until)
+}
+
+func (cd *CloudDashboard) lockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	cd.lockoutsMu.Lock()
+	active := make(map[string]time.Time)
+	for account, until := range cd.lockouts {
+		if time.Now().Before(until) {
+			active[account] = until
 		}
+	}
+	cd.lockoutsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(active)
+}
+
+// commandAccount returns the account a command is scoped to, or "" for
+// commands that apply to every connection server.
+func commandAccount(cmd Command) string {
+	account, _ := cmd.Payload["account"].(string)
+	return account
+}
+
+// accountOwner returns the name of the connection server that last reported
+// account, or "" if none has.
+func (cd *CloudDashboard) accountOwner(account string) string {
+	cd.mu.RLock()
+	defer cd.mu.RUnlock()
+	return cd.accountOwners[account]
+}
+
+func (cd *CloudDashboard) connectionName(client *ConnectionClient) string {
+	cd.connectionsMu.Lock()
+	defer cd.connectionsMu.Unlock()
+	return client.name
+}
 
-		cd.sendCommandToConnections(cmd)
-		w.WriteHeader(http.StatusOK)
+// connected reports whether a connection server named name is connected.
+func (cd *CloudDashboard) connected(name string) bool {
+	cd.connectionsMu.Lock()
+	defer cd.connectionsMu.Unlock()
+	for _, client := range cd.connections {
+		if client.name == name {
+			return true
+		}
 	}
+	return false
 }
 
-func (cd *CloudDashboard) sendCommandToConnections(cmd Command) {
+// sendCommandToConnections hands cmd to the connection server that owns its
+// account, or to every connection server for commands without an account
+// such as flatten_all. It reports whether any accepted it.
+func (cd *CloudDashboard) sendCommandToConnections(cmd Command) bool {
+	owner := ""
+	if account := commandAccount(cmd); account != "" {
+		if owner = cd.accountOwner(account); owner == "" {
+			return false
+		}
+	}
+
 	cd.connectionsMu.Lock()
 	defer cd.connectionsMu.Unlock()
 
+	var sent []string
 	for _, client := range cd.connections {
+		if owner != "" && client.name != owner {
+			continue
+		}
 		select {
 		case client.commandChan <- cmd:
+			sent = append(sent, client.name)
 		default:
 			log.Printf("Command channel full for connection %s", client.id)
 		}
 	}
+	if owner == "" && len(sent) > 0 {
+		cd.commands.AddConnections(cmd.ID, sent)
+	}
+	return len(sent) > 0
 }
 
 func (cd *CloudDashboard) eventsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	ch := make(chan []byte, 10)
+	ch := make(chan sseEvent, 10)
 	
 	cd.webClientsMu.Lock()
 	cd.webClients[ch] = true
@@ -723,6 +4148,10 @@ func (cd *CloudDashboard) eventsHandler(w http.ResponseWriter, r *http.Request)
 	b, _ := json.Marshal(cd.latest)
 	cd.mu.RUnlock()
 	fmt.Fprintf(w, "data: %s\n\n", b)
+	fmt.Fprintf(w, "event: trails\ndata: %s\n\n", cd.trailsJSON())
+	fmt.Fprintf(w, "event: risk\ndata: %s\n\n", cd.riskJSON())
+	fmt.Fprintf(w, "event: drawdown\ndata: %s\n\n", cd.drawdownJSON())
+	fmt.Fprintf(w, "event: protection\ndata: %s\n\n", cd.protectionJSON())
 	w.(http.Flusher).Flush()
 
 	ticker := time.NewTicker(20 * time.Second)
@@ -731,7 +4160,10 @@ func (cd *CloudDashboard) eventsHandler(w http.ResponseWriter, r *http.Request)
 	for {
 		select {
 		case msg := <-ch:
-			fmt.Fprintf(w, "data: %s\n\n", msg)
+			if msg.Event != "" {
+				fmt.Fprintf(w, "event: %s\n", msg.Event)
+			}
+			fmt.Fprintf(w, "data: %s\n\n", msg.Data)
 			if f, ok := w.(http.Flusher); ok {
 				f.Flush()
 			}
@@ -747,17 +4179,359 @@ func (cd *CloudDashboard) eventsHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (cd *CloudDashboard) broadcast(b []byte) {
+	cd.broadcastEvent("", b)
+}
+
+func (cd *CloudDashboard) broadcastEvent(event string, b []byte) {
 	cd.webClientsMu.Lock()
 	defer cd.webClientsMu.Unlock()
 	for ch := range cd.webClients {
 		select {
-		case ch <- b:
+		case ch <- sseEvent{Event: event, Data: b}:
+		default:
+		}
+	}
+}
+
+func (cd *CloudDashboard) trailsJSON() []byte {
+	cd.mu.RLock()
+	all := []Trail{}
+	for _, trails := range cd.trails {
+		all = append(all, trails...)
+	}
+	cd.mu.RUnlock()
+	b, _ := json.Marshal(all)
+	return b
+}
+
+func (cd *CloudDashboard) riskJSON() []byte {
+	cd.mu.RLock()
+	all := []RiskState{}
+	for _, states := range cd.risk {
+		all = append(all, states...)
+	}
+	cd.mu.RUnlock()
+	b, _ := json.Marshal(all)
+	return b
+}
+
+func (cd *CloudDashboard) riskHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(cd.riskJSON())
+}
+
+func (cd *CloudDashboard) drawdownJSON() []byte {
+	cd.mu.RLock()
+	all := []DrawdownState{}
+	for _, states := range cd.drawdowns {
+		all = append(all, states...)
+	}
+	cd.mu.RUnlock()
+	b, _ := json.Marshal(all)
+	return b
+}
+
+func (cd *CloudDashboard) drawdownHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(cd.drawdownJSON())
+}
+
+func (cd *CloudDashboard) protectionJSON() []byte {
+	cd.mu.RLock()
+	all := []NakedPosition{}
+	for _, naked := range cd.naked {
+		all = append(all, naked...)
+	}
+	cd.mu.RUnlock()
+	b, _ := json.Marshal(all)
+	return b
+}
+
+func (cd *CloudDashboard) protectionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(cd.protectionJSON())
+}
+
+func (cd *CloudDashboard) instrumentSpec(instrument string) (InstrumentSpec, bool) {
+	cd.specsMu.Lock()
+	defer cd.specsMu.Unlock()
+	is, ok := cd.specs[instrumentRoot(instrument)]
+	return is, ok
+}
+
+// exposure computes what each position of snap loses if all of its stops
+// are hit and gains if all of its targets are. Stops are the stop orders on
+// the position's closing side; targets are its profit targets, or closing
+// limit orders priced beyond the average price. Both are counted up to the
+// position's quantity.
+func (cd *CloudDashboard) exposure(snap Snapshot) AccountExposure {
+	total := AccountExposure{Positions: []PositionExposure{}}
+	for _, pos := range snap.Positions {
+		if pos.MarketPosition == "Flat" || pos.Quantity <= 0 {
+			continue
+		}
+		pe := PositionExposure{Instrument: pos.Instrument, Quantity: pos.Quantity}
+		is, known := cd.instrumentSpec(pos.Instrument)
+		pe.PointValue = is.PointValue
+		pe.UnknownSpec = !known
+
+		// direction turns a price move away from the average price into
+		// profit (positive) or loss (negative) for the position.
+		direction, closing := 1.0, "Sell"
+		if pos.MarketPosition == "Short" {
+			direction, closing = -1.0, "Buy"
+		}
+		stopQty, targetQty := 0, 0
+		for _, o := range snap.WorkingOrders {
+			if o.Instrument != pos.Instrument || !strings.HasPrefix(o.OrderAction, closing) {
+				continue
+			}
+			open := o.Quantity - o.Filled
+			if o.IsStopLoss || strings.Contains(o.OrderType, "Stop") {
+				q := min(open, pos.Quantity-stopQty)
+				stopQty += q
+				pe.Risk -= (o.StopPrice - pos.AveragePrice) * direction * float64(q) * is.PointValue
+			} else if o.IsProfitTarget || o.OrderType == "Limit" && (o.LimitPrice-pos.AveragePrice)*direction > 0 {
+				q := min(open, pos.Quantity-targetQty)
+				targetQty += q
+				pe.Reward += (o.LimitPrice - pos.AveragePrice) * direction * float64(q) * is.PointValue
+			}
+		}
+		pe.Unprotected = pos.Quantity - stopQty
+		pe.Untargeted = pos.Quantity - targetQty
+		total.add(AccountExposure{Risk: pe.Risk, Reward: pe.Reward, Unprotected: pe.Unprotected, UnknownSpec: pe.UnknownSpec})
+		total.Positions = append(total.Positions, pe)
+	}
+	return total
+}
+
+// exposureHandler serves the exposure of every account and their total.
+func (cd *CloudDashboard) exposureHandler(w http.ResponseWriter, r *http.Request) {
+	resp := struct {
+		Accounts map[string]AccountExposure `json:"accounts"`
+		Total    AccountExposure            `json:"total"`
+	}{Accounts: make(map[string]AccountExposure)}
+
+	cd.mu.RLock()
+	for account, snap := range cd.latest {
+		if snap.Exposure != nil {
+			resp.Accounts[account] = *snap.Exposure
+			resp.Total.add(*snap.Exposure)
+		}
+	}
+	cd.mu.RUnlock()
+	resp.Total.Positions = []PositionExposure{}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (cd *CloudDashboard) instrumentsPath() string {
+	return filepath.Join(cd.stateDir, "instruments.json")
+}
+
+func (cd *CloudDashboard) loadInstrumentSpecs() {
+	var specs []InstrumentSpec
+	if err := readJSONFile(cd.instrumentsPath(), &specs); err != nil {
+		log.Printf("Failed to load instrument specs: %v", err)
+		return
+	}
+	cd.specsMu.Lock()
+	for _, is := range specs {
+		cd.specs[is.Root] = is
+	}
+	cd.specsMu.Unlock()
+}
+
+// specListLocked returns the specs ordered by root. specsMu must be held.
+func (cd *CloudDashboard) specListLocked() []InstrumentSpec {
+	list := make([]InstrumentSpec, 0, len(cd.specs))
+	for _, is := range cd.specs {
+		list = append(list, is)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Root < list[j].Root })
+	return list
+}
+
+// saveInstrumentSpecsLocked persists the custom specs. specsMu must be held.
+func (cd *CloudDashboard) saveInstrumentSpecsLocked() {
+	custom := []InstrumentSpec{}
+	for _, is := range cd.specListLocked() {
+		if is.Custom {
+			custom = append(custom, is)
+		}
+	}
+	if err := writeJSONFile(cd.instrumentsPath(), custom); err != nil {
+		log.Printf("Failed to save instrument specs: %v", err)
+	}
+}
+
+// instrumentsHandler serves GET /api/instruments, and GET, PUT and DELETE
+// /api/instruments/{root}. DELETE drops a custom spec, restoring the
+// built-in one if there is one.
+func (cd *CloudDashboard) instrumentsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	root := strings.ToUpper(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/instruments"), "/"))
+
+	changed := func() bool {
+		cd.specsMu.Lock()
+		defer cd.specsMu.Unlock()
+		existing, found := cd.specs[root]
+		switch {
+		case r.Method == http.MethodGet && root == "":
+			json.NewEncoder(w).Encode(cd.specListLocked())
+		case r.Method == http.MethodGet && found:
+			json.NewEncoder(w).Encode(existing)
+		case r.Method == http.MethodGet:
+			http.Error(w, "unknown instrument "+root, http.StatusNotFound)
+		case r.Method == http.MethodPut && root != "":
+			var is InstrumentSpec
+			if err := json.NewDecoder(r.Body).Decode(&is); err != nil {
+				http.Error(w, "invalid JSON body", http.StatusBadRequest)
+				return false
+			}
+			if is.PointValue <= 0 {
+				http.Error(w, "a positive pointValue is required", http.StatusBadRequest)
+				return false
+			}
+			is.Root, is.Custom = root, true
+			cd.specs[root] = is
+			cd.saveInstrumentSpecsLocked()
+			json.NewEncoder(w).Encode(is)
+			return true
+		case r.Method == http.MethodDelete && found && existing.Custom:
+			delete(cd.specs, root)
+			if is, ok := parseInstrumentSpecs(os.Getenv("INSTRUMENT_SPECS"))[root]; ok {
+				cd.specs[root] = is
+			}
+			cd.saveInstrumentSpecsLocked()
+			w.WriteHeader(http.StatusNoContent)
+			return true
+		case r.Method == http.MethodDelete:
+			http.Error(w, "no custom spec for "+root, http.StatusNotFound)
 		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
+		return false
+	}()
+	if changed {
+		cd.refreshExposure()
+	}
+}
+
+// refreshExposure recomputes the exposure of the latest snapshots after
+// the instrument specs changed and pushes them to the browsers.
+func (cd *CloudDashboard) refreshExposure() {
+	cd.mu.Lock()
+	for account, snap := range cd.latest {
+		exposure := cd.exposure(snap)
+		snap.Exposure = &exposure
+		cd.latest[account] = snap
+	}
+	b, _ := json.Marshal(cd.latest)
+	cd.mu.Unlock()
+	cd.broadcast(b)
+}
+
+func (cd *CloudDashboard) addAlert(alert Alert) {
+	if alert.Time.IsZero() {
+		alert.Time = time.Now()
+	}
+	log.Printf("Alert [%s/%s] %s", alert.Level, alert.Source, alert.Message)
+
+	cd.alertsMu.Lock()
+	cd.alerts = append(cd.alerts, alert)
+	if len(cd.alerts) > 100 {
+		cd.alerts = cd.alerts[len(cd.alerts)-100:]
+	}
+	cd.alertsMu.Unlock()
+
+	b, err := json.Marshal(alert)
+	if err != nil {
+		log.Printf("JSON Marshal error: %v", err)
+		return
 	}
+	cd.broadcastEvent("alert", b)
+}
+
+func (cd *CloudDashboard) addOrderEvent(event OrderEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	cd.orderEventsMu.Lock()
+	cd.orderEvents = append(cd.orderEvents, event)
+	if len(cd.orderEvents) > 200 {
+		cd.orderEvents = cd.orderEvents[len(cd.orderEvents)-200:]
+	}
+	cd.orderEventsMu.Unlock()
+
+	if event.Kind == "order" && event.CommandId != "" && strings.EqualFold(event.State, "REJECTED") {
+		cd.commands.Update(event.CommandId, CommandRejected, fmt.Sprintf("order %s rejected by NinjaTrader", event.OrderId))
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("JSON Marshal error: %v", err)
+		return
+	}
+	cd.broadcastEvent("order_event", b)
+}
+
+func (cd *CloudDashboard) orderEventsHandler(w http.ResponseWriter, r *http.Request) {
+	cd.orderEventsMu.Lock()
+	events := append([]OrderEvent{}, cd.orderEvents...)
+	cd.orderEventsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+func (cd *CloudDashboard) alertsHandler(w http.ResponseWriter, r *http.Request) {
+	cd.alertsMu.Lock()
+	alerts := append([]Alert{}, cd.alerts...)
+	cd.alertsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+func (cd *CloudDashboard) broadcastCommand(rec CommandRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("JSON Marshal error: %v", err)
+		return
+	}
+	cd.broadcastEvent("command", b)
+}
+
+func (cd *CloudDashboard) broadcastTrails() {
+	cd.broadcastEvent("trails", cd.trailsJSON())
+}
+
+// readJSONFile decodes path into v. A missing file is not an error.
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile replaces path atomically so that a crash never leaves a
+// truncated state file behind.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
 func main() {
 	dashboard := NewCloudDashboard()
 	dashboard.Start()
-}
\ No newline at end of file
+}
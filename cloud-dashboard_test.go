@@ -0,0 +1,677 @@
+package main
+
+// The repository holds several main packages side by side, so run these
+// tests with the file they cover:
+//
+//	go test cloud-dashboard.go cloud-dashboard_test.go
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDashboard(t *testing.T) *CloudDashboard {
+	t.Helper()
+	t.Setenv("DASHBOARD_PASS", "test")
+	t.Setenv("API_SECRET_TOKEN", "test")
+	t.Setenv("STATE_DIR", t.TempDir())
+	return NewCloudDashboard()
+}
+
+// fakeConnection answers every queued command the way a connection server
+// would, with the error respond returns for it. Commands the connection
+// server verifies are verified once acknowledged without an error.
+func fakeConnection(cd *CloudDashboard, respond func(CommandRecord) string) {
+	cd.commands = NewCommandRegistry(500, func(rec CommandRecord) {
+		if rec.Status != CommandQueued {
+			return
+		}
+		go func() {
+			if errText := respond(rec); errText != "" {
+				cd.commands.Update(rec.ID, CommandFailed, errText)
+				return
+			}
+			cd.commands.Update(rec.ID, CommandAcknowledged, "")
+			if verifiedCommands[rec.Type] {
+				cd.commands.Update(rec.ID, CommandVerified, "")
+			}
+		}()
+	})
+}
+
+func TestRunMacro(t *testing.T) {
+	standDown := Macro{Name: "stand-down", Steps: []MacroStep{
+		{Type: "cancel_all_orders"},
+		{Type: "flatten_account", WaitFor: CommandVerified},
+		{Type: "lockout", Duration: "30m"},
+	}}
+	if err := standDown.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// errors maps a command type to the error the connection server
+		// reports for it
+		errors     map[string]string
+		wantStatus string
+		wantSteps  []string
+		wantLocked bool
+	}{
+		{
+			// The connection server acknowledges a cancel with nothing
+			// working as a no-op and verifies it at once.
+			name:       "account with no working orders",
+			wantStatus: "succeeded",
+			wantSteps:  []string{CommandVerified, CommandVerified, "done"},
+			wantLocked: true,
+		},
+		{
+			name:       "flatten fails",
+			errors:     map[string]string{"flatten_account": "no instruments known for account Sim101"},
+			wantStatus: "failed",
+			wantSteps:  []string{CommandVerified, "failed", "waiting"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cd := newTestDashboard(t)
+			cd.ackTimeout = 2 * time.Second
+			cd.accountOwners["Sim101"] = "box"
+			fakeConnection(cd, func(rec CommandRecord) string {
+				if rec.Payload["account"] != "Sim101" {
+					return "wrong account"
+				}
+				return tt.errors[rec.Type]
+			})
+
+			run := &MacroRun{ID: "run1", Macro: standDown.Name, Account: "Sim101", Status: "running", StartedAt: time.Now()}
+			cd.runMacro(standDown, run)
+
+			if run.Status != tt.wantStatus {
+				t.Fatalf("status = %s (%s), want %s", run.Status, run.Error, tt.wantStatus)
+			}
+			for i, want := range tt.wantSteps {
+				if got := run.Steps[i].Status; got != want {
+					t.Errorf("step %d status = %s, want %s", i+1, got, want)
+				}
+			}
+			if _, locked := cd.lockedUntil("Sim101"); locked != tt.wantLocked {
+				t.Errorf("locked = %v, want %v", locked, tt.wantLocked)
+			}
+		})
+	}
+}
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    []ruleClause
+		wantErr bool
+	}{
+		{expr: "unrealized < -800", want: []ruleClause{{field: "unrealized", op: "<", value: -800}}},
+		{expr: "Position.CurrentPrice CROSSES 6000 AND balance >= 50000", want: []ruleClause{
+			{field: "position.currentPrice", op: "crosses", value: 6000},
+			{field: "balance", op: ">=", value: 50000},
+		}},
+		{expr: "", wantErr: true},
+		{expr: "unrealized <", wantErr: true},
+		{expr: "equity < 100", wantErr: true},
+		{expr: "unrealized => 100", wantErr: true},
+		{expr: "unrealized < lots", wantErr: true},
+		{expr: "unrealized < 1 and", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCondition(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCondition(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCondition(%q) = %+v, want %+v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestRuleEvaluate(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+		// values are fed to evaluate one snapshot after another
+		values []map[string]float64
+		want   []bool
+	}{
+		{
+			name:      "fires on the edge only",
+			condition: "unrealized < -800",
+			values:    []map[string]float64{{"unrealized": -500}, {"unrealized": -900}, {"unrealized": -950}, {"unrealized": -100}, {"unrealized": -801}},
+			want:      []bool{false, true, false, false, true},
+		},
+		{
+			name:      "all clauses must hold",
+			condition: "unrealized < 0 and balance > 1000",
+			values:    []map[string]float64{{"unrealized": -1, "balance": 900}, {"unrealized": -1, "balance": 1100}},
+			want:      []bool{false, true},
+		},
+		{
+			name:      "missing field never holds",
+			condition: "position.quantity >= 1",
+			values:    []map[string]float64{{"balance": 1000}, {"position.quantity": 2}},
+			want:      []bool{false, true},
+		},
+		{
+			name:      "equality within epsilon",
+			condition: "realized == 0.3",
+			values:    []map[string]float64{{"realized": 0.1 + 0.2}},
+			want:      []bool{true},
+		},
+		{
+			name:      "inequality within epsilon",
+			condition: "realized != 0.3",
+			values:    []map[string]float64{{"realized": 0.1 + 0.2}, {"realized": 0.31}},
+			want:      []bool{false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ru := Rule{Account: "Sim101", Instrument: "ES 12-26", Condition: tt.condition, Type: "flatten_account"}
+			if err := ru.validate(); err != nil {
+				t.Fatal(err)
+			}
+			for i, values := range tt.values {
+				if got := ru.evaluate(values); got != tt.want[i] {
+					t.Errorf("evaluate(%v) = %v, want %v", values, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRuleCrosses(t *testing.T) {
+	tests := []struct {
+		name   string
+		prices []float64
+		want   []bool
+	}{
+		{name: "no previous value", prices: []float64{6001}, want: []bool{false}},
+		{name: "upwards", prices: []float64{5999, 6000.25}, want: []bool{false, true}},
+		{name: "downwards", prices: []float64{6001, 5999.75}, want: []bool{false, true}},
+		{name: "onto the level", prices: []float64{5999, 6000}, want: []bool{false, true}},
+		{name: "stays above", prices: []float64{6001, 6002, 6003}, want: []bool{false, false, false}},
+		{name: "crosses back later", prices: []float64{5999, 6001, 6002, 5999}, want: []bool{false, true, false, true}},
+		// Like any condition, one that holds on consecutive snapshots
+		// fires on the first of them only.
+		{name: "consecutive crossings", prices: []float64{5999, 6001, 5999}, want: []bool{false, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ru := Rule{Account: "Sim101", Instrument: "ES 12-26", Condition: "position.currentPrice crosses 6000", Type: "flatten_account"}
+			if err := ru.validate(); err != nil {
+				t.Fatal(err)
+			}
+			for i, price := range tt.prices {
+				values := map[string]float64{"position.currentPrice": price}
+				if got := ru.evaluate(values); got != tt.want[i] {
+					t.Errorf("price %v: evaluate() = %v, want %v", price, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRuleFiringsPersisted(t *testing.T) {
+	cd := newTestDashboard(t)
+	cd.accountOwners["Sim101"] = "box"
+	fakeConnection(cd, func(CommandRecord) string { return "" })
+	ru := Rule{Name: "stop out", Account: "Sim101", Condition: "unrealized < -800", Type: "flatten_account", Armed: true}
+	if err := ru.validate(); err != nil {
+		t.Fatal(err)
+	}
+	cd.rules["r1"] = &ru
+
+	cd.evaluateRules(Snapshot{Account: "Sim101", Unrealized: -900})
+	// Let the dispatched command finish before the state directory goes.
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if rec, ok := cd.commands.Get(cd.ruleFirings[0].CommandID); ok && rec.Status == CommandVerified {
+			break
+		}
+	}
+
+	restored := NewCloudDashboard()
+	if got := restored.ruleFirings; len(got) != 1 || got[0].Name != "stop out" {
+		t.Fatalf("restored firings = %+v, want the one firing", got)
+	}
+}
+
+func TestUpdateConnection(t *testing.T) {
+	type ack struct{ name, status, err string }
+	tests := []struct {
+		name       string
+		acks       []ack
+		wantStatus string
+		wantError  string
+	}{
+		{
+			name:       "waits for every connection server",
+			acks:       []ack{{"box1", CommandAcknowledged, ""}},
+			wantStatus: CommandDelivered,
+		},
+		{
+			name:       "acknowledged by all",
+			acks:       []ack{{"box1", CommandAcknowledged, ""}, {"box2", CommandAcknowledged, ""}},
+			wantStatus: CommandAcknowledged,
+		},
+		{
+			name:       "one fails",
+			acks:       []ack{{"box1", CommandAcknowledged, ""}, {"box2", CommandFailed, "ATI disabled"}},
+			wantStatus: CommandFailed,
+			wantError:  "box2: ATI disabled",
+		},
+		{
+			name:       "failure before the others answer",
+			acks:       []ack{{"box1", CommandExpired, "arrived after its TTL"}},
+			wantStatus: CommandExpired,
+			wantError:  "box1: arrived after its TTL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := NewCommandRegistry(10, func(CommandRecord) {})
+			reg.Add(Command{ID: "c1", Type: "flatten_all"})
+			reg.Update("c1", CommandDelivered, "")
+			reg.AddConnections("c1", []string{"box1", "box2"})
+			for _, a := range tt.acks {
+				if status, errText, ok := reg.UpdateConnection("c1", a.name, a.status, a.err); ok {
+					reg.Update("c1", status, errText)
+				}
+			}
+			rec, _ := reg.Get("c1")
+			if rec.Status != tt.wantStatus || rec.Error != tt.wantError {
+				t.Fatalf("command = %s %q, want %s %q", rec.Status, rec.Error, tt.wantStatus, tt.wantError)
+			}
+			if got := rec.Connections[tt.acks[0].name]; got != tt.acks[0].status {
+				t.Errorf("connection %s = %s, want %s", tt.acks[0].name, got, tt.acks[0].status)
+			}
+		})
+	}
+}
+
+func TestExposure(t *testing.T) {
+	long := Position{Instrument: "ES 12-26", MarketPosition: "Long", Quantity: 2, AveragePrice: 6000}
+	short := Position{Instrument: "ES 12-26", MarketPosition: "Short", Quantity: 2, AveragePrice: 6000}
+	tests := []struct {
+		name   string
+		pos    Position
+		orders []WorkingOrder
+		want   PositionExposure
+	}{
+		{
+			name: "stop and target",
+			pos:  long,
+			orders: []WorkingOrder{
+				{Instrument: "ES 12-26", OrderAction: "Sell", OrderType: "StopMarket", Quantity: 2, StopPrice: 5990},
+				{Instrument: "ES 12-26", OrderAction: "Sell", OrderType: "Limit", Quantity: 2, LimitPrice: 6020},
+			},
+			want: PositionExposure{Risk: 1000, Reward: 2000},
+		},
+		{
+			name: "closing limit at a loss is not a target",
+			pos:  long,
+			orders: []WorkingOrder{
+				{Instrument: "ES 12-26", OrderAction: "Sell", OrderType: "Limit", Quantity: 2, LimitPrice: 5995},
+			},
+			want: PositionExposure{Unprotected: 2, Untargeted: 2},
+		},
+		{
+			name: "flagged profit target",
+			pos:  long,
+			orders: []WorkingOrder{
+				{Instrument: "ES 12-26", OrderAction: "Sell", OrderType: "MIT", Quantity: 1, LimitPrice: 6010, IsProfitTarget: true},
+			},
+			want: PositionExposure{Reward: 500, Unprotected: 2, Untargeted: 1},
+		},
+		{
+			name: "short",
+			pos:  short,
+			orders: []WorkingOrder{
+				{Instrument: "ES 12-26", OrderAction: "BuyToCover", OrderType: "StopMarket", Quantity: 2, StopPrice: 6010},
+				{Instrument: "ES 12-26", OrderAction: "BuyToCover", OrderType: "Limit", Quantity: 2, LimitPrice: 5980},
+				{Instrument: "ES 12-26", OrderAction: "BuyToCover", OrderType: "Limit", Quantity: 1, LimitPrice: 6005},
+			},
+			want: PositionExposure{Risk: 1000, Reward: 2000},
+		},
+		{
+			name: "stop locking in profit, counted up to the position",
+			pos:  long,
+			orders: []WorkingOrder{
+				{Instrument: "ES 12-26", OrderAction: "Sell", OrderType: "StopMarket", Quantity: 3, Filled: 0, StopPrice: 6004},
+				{Instrument: "NQ 12-26", OrderAction: "Sell", OrderType: "StopMarket", Quantity: 1, StopPrice: 20000},
+				{Instrument: "ES 12-26", OrderAction: "Buy", OrderType: "Limit", Quantity: 1, LimitPrice: 5990},
+			},
+			want: PositionExposure{Risk: -400, Untargeted: 2},
+		},
+		{
+			name: "partly filled target",
+			pos:  long,
+			orders: []WorkingOrder{
+				{Instrument: "ES 12-26", OrderAction: "Sell", OrderType: "Limit", Quantity: 2, Filled: 1, LimitPrice: 6020},
+			},
+			want: PositionExposure{Reward: 1000, Unprotected: 2, Untargeted: 1},
+		},
+	}
+	cd := newTestDashboard(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cd.exposure(Snapshot{Account: "Sim101", Positions: []Position{tt.pos}, WorkingOrders: tt.orders})
+			want := tt.want
+			want.Instrument, want.Quantity, want.PointValue = tt.pos.Instrument, tt.pos.Quantity, 50
+			if len(got.Positions) != 1 || !reflect.DeepEqual(got.Positions[0], want) {
+				t.Fatalf("exposure = %+v, want %+v", got.Positions, want)
+			}
+			if got.Risk != want.Risk || got.Reward != want.Reward || got.Unprotected != want.Unprotected {
+				t.Errorf("account totals = %+v, want those of the position", got)
+			}
+		})
+	}
+
+	unknown := cd.exposure(Snapshot{Positions: []Position{{Instrument: "XYZ 12-26", MarketPosition: "Long", Quantity: 1, AveragePrice: 10}}})
+	if !unknown.UnknownSpec || unknown.Risk != 0 || unknown.Unprotected != 1 {
+		t.Errorf("exposure without a spec = %+v, want it flagged", unknown)
+	}
+}
+
+func TestPlaceOrderWithStrategy(t *testing.T) {
+	cd := newTestDashboard(t)
+	cd.ackTimeout = 2 * time.Second
+	cd.accountOwners["Sim101"] = "box"
+	var sent []CommandRecord
+	var mu sync.Mutex
+	fakeConnection(cd, func(rec CommandRecord) string {
+		mu.Lock()
+		sent = append(sent, rec)
+		mu.Unlock()
+		return ""
+	})
+
+	body := `{"account":"Sim101","instrument":"ES 12-26","action":"buy","quantity":1,"orderType":"market","strategy":"Scalp"}`
+	w := httptest.NewRecorder()
+	cd.placeOrderHandler("place_order")(w, httptest.NewRequest(http.MethodPost, "/api/place_order", strings.NewReader(body)))
+	// Without a connection server the command is queued for fakeConnection.
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d (%s), want 202", w.Code, w.Body)
+	}
+	rec := cd.commands.List()[0]
+	cd.commands.Wait(rec.ID, 2*time.Second, func(rec CommandRecord) bool { return rec.Status == CommandAcknowledged })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 1 || sent[0].Type != "place_atm_order" {
+		t.Fatalf("sent %+v, want one place_atm_order", sent)
+	}
+	strategyId, _ := sent[0].Payload["strategyId"].(string)
+	if !strings.HasPrefix(strategyId, "atm_") {
+		t.Fatalf("strategyId = %q, want one generated by the dashboard", strategyId)
+	}
+	cd.resolveATMStrategy(sent[0].ID, true)
+	if s, ok := cd.atmStrategies[strategyId]; !ok || s.Template != "Scalp" {
+		t.Fatalf("atmStrategies = %+v, want the started strategy", cd.atmStrategies)
+	}
+}
+
+func TestParseCommandTTLs(t *testing.T) {
+	ttls := parseCommandTTLs("place_order=5s, flatten_all=0, bogus, close_position=-1s, arm_trail=soon, custom=1m")
+	tests := map[string]time.Duration{
+		"place_order":     5 * time.Second,
+		"flatten_all":     0,
+		"close_position":  defaultCommandTTLs["close_position"],
+		"arm_trail":       defaultCommandTTLs["arm_trail"],
+		"custom":          time.Minute,
+		"flatten_account": defaultCommandTTLs["flatten_account"],
+	}
+	for cmdType, want := range tests {
+		if got, ok := ttls[cmdType]; !ok || got != want {
+			t.Errorf("TTL of %s = %v (set %v), want %v", cmdType, got, ok, want)
+		}
+	}
+}
+
+func TestQueuedCommandsExpire(t *testing.T) {
+	cd := newTestDashboard(t)
+	stale := Command{ID: "stale", Type: "flatten_account", Payload: map[string]interface{}{"account": "Sim101"},
+		IssuedAt: time.Now().Add(-time.Minute), TTLSeconds: 30}
+	fresh := Command{ID: "fresh", Type: "flatten_account", Payload: map[string]interface{}{"account": "Sim101"},
+		IssuedAt: time.Now(), TTLSeconds: 30}
+	for _, cmd := range []Command{stale, fresh} {
+		cd.commands.Add(cmd)
+		cd.commands.Update(cmd.ID, CommandQueued, "waiting for a connection server")
+		if err := cd.queue.Push(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cd.flushQueue(false)
+
+	if rec, _ := cd.commands.Get("stale"); rec.Status != CommandExpired {
+		t.Errorf("stale command status = %s, want %s", rec.Status, CommandExpired)
+	}
+	if rec, _ := cd.commands.Get("fresh"); rec.Status != CommandQueued {
+		t.Errorf("fresh command status = %s, want %s", rec.Status, CommandQueued)
+	}
+	if queued := cd.queue.List(); len(queued) != 1 || queued[0].ID != "fresh" {
+		t.Errorf("queue = %+v, want only the fresh command", queued)
+	}
+}
+
+func TestCommandQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	q, err := NewCommandQueue(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"c1", "c2"} {
+		if err := q.Push(Command{ID: id, Type: "flatten_all"}); err != nil {
+			t.Fatalf("Push(%s) error = %v", id, err)
+		}
+	}
+	if err := q.Push(Command{ID: "c3", Type: "flatten_all"}); err == nil {
+		t.Fatal("Push() onto a full queue succeeded")
+	}
+	if !q.Remove("c1") || q.Remove("c1") {
+		t.Fatal("Remove() should report c1 queued exactly once")
+	}
+
+	// A restarted dashboard delivers what was still waiting.
+	restored, err := NewCommandQueue(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.List(); len(got) != 1 || got[0].ID != "c2" {
+		t.Fatalf("restored queue = %+v, want c2", got)
+	}
+	if err := restored.Push(Command{ID: "c3", Type: "flatten_all"}); err != nil {
+		t.Fatalf("Push() after a removal error = %v", err)
+	}
+}
+
+func TestCommandRegistryTransitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []string
+		want    string
+	}{
+		{name: "lifecycle", updates: []string{CommandDelivered, CommandAcknowledged, CommandVerified}, want: CommandVerified},
+		{name: "never backwards", updates: []string{CommandAcknowledged, CommandDelivered, CommandPending}, want: CommandAcknowledged},
+		{name: "late ack overrides a timeout", updates: []string{CommandDelivered, CommandTimedOut, CommandAcknowledged}, want: CommandAcknowledged},
+		{name: "ack after a failure is ignored", updates: []string{CommandFailed, CommandAcknowledged}, want: CommandFailed},
+		{name: "queued then delivered", updates: []string{CommandQueued, CommandDelivered}, want: CommandDelivered},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changes []string
+			reg := NewCommandRegistry(10, func(rec CommandRecord) { changes = append(changes, rec.Status) })
+			reg.Add(Command{ID: "c1", Type: "flatten_all"})
+			for _, status := range tt.updates {
+				reg.Update("c1", status, "")
+			}
+			rec, _ := reg.Get("c1")
+			if rec.Status != tt.want {
+				t.Fatalf("status = %s, want %s", rec.Status, tt.want)
+			}
+			if len(rec.History) != len(changes) || changes[len(changes)-1] != tt.want {
+				t.Errorf("history %+v and notifications %v disagree", rec.History, changes)
+			}
+		})
+	}
+
+	t.Run("expire pending", func(t *testing.T) {
+		reg := NewCommandRegistry(10, func(CommandRecord) {})
+		for _, id := range []string{"pending", "delivered", "queued", "acknowledged"} {
+			reg.Add(Command{ID: id, Type: "flatten_all", IssuedAt: time.Now().Add(-time.Minute)})
+		}
+		reg.Update("delivered", CommandDelivered, "")
+		reg.Update("queued", CommandQueued, "")
+		reg.Update("acknowledged", CommandAcknowledged, "")
+		reg.ExpirePending(30 * time.Second)
+		for id, want := range map[string]string{
+			"pending":      CommandTimedOut,
+			"delivered":    CommandTimedOut,
+			"queued":       CommandQueued,
+			"acknowledged": CommandAcknowledged,
+		} {
+			if rec, _ := reg.Get(id); rec.Status != want {
+				t.Errorf("%s: status = %s, want %s", id, rec.Status, want)
+			}
+		}
+	})
+
+	t.Run("keeps the most recent", func(t *testing.T) {
+		reg := NewCommandRegistry(2, func(CommandRecord) {})
+		for _, id := range []string{"c1", "c2", "c3"} {
+			reg.Add(Command{ID: id, Type: "flatten_all"})
+		}
+		if _, ok := reg.Get("c1"); ok {
+			t.Error("oldest command still tracked")
+		}
+		if got := len(reg.List()); got != 2 {
+			t.Errorf("tracking %d commands, want 2", got)
+		}
+	})
+}
+
+func TestScheduleNext(t *testing.T) {
+	weekdays := []string{"mon", "tue", "wed", "thu", "fri"}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		after    string
+		want     string
+	}{
+		{
+			name:     "later the same day",
+			schedule: Schedule{Time: "15:55", Timezone: "America/New_York", Days: weekdays},
+			after:    "2026-10-14T12:00:00Z",
+			want:     "2026-10-14T15:55:00-04:00",
+		},
+		{
+			name:     "Friday after the time runs on Monday",
+			schedule: Schedule{Time: "15:55", Timezone: "America/New_York", Days: weekdays},
+			after:    "2026-10-16T20:00:00Z",
+			want:     "2026-10-19T15:55:00-04:00",
+		},
+		{
+			name:     "exactly at the time runs next week",
+			schedule: Schedule{Time: "15:55", Timezone: "America/New_York", Days: []string{"Wed"}},
+			after:    "2026-10-14T19:55:00Z",
+			want:     "2026-10-21T15:55:00-04:00",
+		},
+		{
+			name:     "keeps local time when DST ends",
+			schedule: Schedule{Time: "16:00", Timezone: "America/Chicago", Days: weekdays},
+			after:    "2026-10-30T22:00:00Z",
+			want:     "2026-11-02T16:00:00-06:00",
+		},
+		{
+			name:     "keeps local time when DST starts",
+			schedule: Schedule{Time: "16:00", Timezone: "America/Chicago", Days: []string{"sun"}},
+			after:    "2027-03-10T00:00:00Z",
+			want:     "2027-03-14T16:00:00-05:00",
+		},
+		{
+			name:     "time skipped by DST runs an hour later",
+			schedule: Schedule{Time: "02:30", Timezone: "America/New_York", Days: []string{"sun"}},
+			after:    "2027-03-13T12:00:00Z",
+			want:     "2027-03-14T03:30:00-04:00",
+		},
+		{
+			name:     "one-off date",
+			schedule: Schedule{Time: "09:00", Timezone: "Europe/London", Date: "2026-12-24"},
+			after:    "2026-10-16T00:00:00Z",
+			want:     "2026-12-24T09:00:00Z",
+		},
+		{
+			name:     "one-off date in the past",
+			schedule: Schedule{Time: "09:00", Timezone: "Europe/London", Date: "2026-10-01"},
+			after:    "2026-10-16T00:00:00Z",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			after, err := time.Parse(time.RFC3339, tt.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tt.schedule.next(after)
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("next() = %v, want none", got)
+				}
+				return
+			}
+			want, err := time.Parse(time.RFC3339, tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || !got.Equal(want) {
+				t.Fatalf("next() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMacroValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		macro       Macro
+		wantErr     bool
+		wantWaitFor string
+	}{
+		{name: "waits for acknowledgment by default", macro: Macro{Name: "flat", Steps: []MacroStep{{Type: "flatten_account"}}}, wantWaitFor: CommandAcknowledged},
+		{name: "verified step", macro: Macro{Name: "flat", Steps: []MacroStep{{Type: "flatten_account", WaitFor: CommandVerified}}}, wantWaitFor: CommandVerified},
+		{name: "lockout", macro: Macro{Name: "stop", Steps: []MacroStep{{Type: "lockout", Duration: "30m"}}}},
+		{name: "no name", macro: Macro{Name: "  ", Steps: []MacroStep{{Type: "flatten_account"}}}, wantErr: true},
+		{name: "slash in the name", macro: Macro{Name: "a/b", Steps: []MacroStep{{Type: "flatten_account"}}}, wantErr: true},
+		{name: "no steps", macro: Macro{Name: "empty"}, wantErr: true},
+		{name: "order entry", macro: Macro{Name: "buy", Steps: []MacroStep{{Type: "place_order"}}}, wantErr: true},
+		{name: "lockout without a duration", macro: Macro{Name: "stop", Steps: []MacroStep{{Type: "lockout"}}}, wantErr: true},
+		{name: "negative lockout", macro: Macro{Name: "stop", Steps: []MacroStep{{Type: "lockout", Duration: "-5m"}}}, wantErr: true},
+		{name: "unverified command waiting for verification", macro: Macro{Name: "x", Steps: []MacroStep{{Type: "disarm_trail", WaitFor: CommandVerified}}}, wantErr: true},
+		{name: "unknown waitFor", macro: Macro{Name: "x", Steps: []MacroStep{{Type: "flatten_account", WaitFor: "filled"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.macro.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.macro.Steps[0].WaitFor != tt.wantWaitFor {
+				t.Errorf("waitFor = %q, want %q", tt.macro.Steps[0].WaitFor, tt.wantWaitFor)
+			}
+		})
+	}
+}
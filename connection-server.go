@@ -2,17 +2,25 @@
 package main
 
 import (
+	crand "crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
+	_ "time/tzdata" // risk limits roll over in the exchange timezone on any host
 
 	"github.com/gorilla/websocket"
 )
@@ -57,6 +65,26 @@ type Command struct {
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload"`
 	ID      string          `json:"id"`
+	// IssuedAt and TTLSeconds bound how late the command may still be
+	// executed; a zero TTL never expires.
+	IssuedAt   time.Time `json:"issuedAt"`
+	TTLSeconds float64   `json:"ttlSeconds,omitempty"`
+}
+
+// errCommandExpired is returned for commands that arrive after their TTL.
+var errCommandExpired = errors.New("command expired")
+
+// checkExpiry fails commands older than their TTL, so that a close clicked
+// during an outage does not fire minutes later into a different market.
+func (cmd Command) checkExpiry() error {
+	if cmd.TTLSeconds <= 0 || cmd.IssuedAt.IsZero() {
+		return nil
+	}
+	ttl := time.Duration(cmd.TTLSeconds * float64(time.Second))
+	if age := time.Since(cmd.IssuedAt); age > ttl {
+		return fmt.Errorf("%w: issued %v ago, time-to-live is %v", errCommandExpired, age.Round(time.Second), ttl)
+	}
+	return nil
 }
 
 // Payloads for specific commands for type-safe unmarshaling
@@ -74,6 +102,857 @@ type CancelOrderPayload struct {
 	OrderId string `json:"orderId"`
 }
 
+type PlaceOrderPayload struct {
+	Account    string  `json:"account"`
+	Instrument string  `json:"instrument"`
+	Action     string  `json:"action"`
+	Quantity   int     `json:"quantity"`
+	OrderType  string  `json:"orderType"`
+	LimitPrice float64 `json:"limitPrice"`
+	StopPrice  float64 `json:"stopPrice"`
+	TIF        string  `json:"tif"`
+	OcoId      string  `json:"ocoId"`
+	OrderId    string  `json:"orderId"`
+	Strategy   string  `json:"strategy"`
+	StrategyId string  `json:"strategyId"`
+}
+
+// validate normalizes the payload to the upper-case values OIF expects and
+// checks that every price required by the order type is present.
+func (p *PlaceOrderPayload) validate() error {
+	p.Action = strings.ToUpper(strings.TrimSpace(p.Action))
+	p.OrderType = strings.ToUpper(strings.TrimSpace(p.OrderType))
+	p.TIF = strings.ToUpper(strings.TrimSpace(p.TIF))
+	if p.TIF == "" {
+		p.TIF = "DAY"
+	}
+
+	if p.Account == "" {
+		return fmt.Errorf("account is required")
+	}
+	if p.Instrument == "" {
+		return fmt.Errorf("instrument is required")
+	}
+	if p.Action != "BUY" && p.Action != "SELL" {
+		return fmt.Errorf("invalid action %q: must be BUY or SELL", p.Action)
+	}
+	if p.Quantity <= 0 {
+		return fmt.Errorf("quantity must be positive, got %d", p.Quantity)
+	}
+	switch p.OrderType {
+	case "MARKET":
+	case "LIMIT":
+		if p.LimitPrice <= 0 {
+			return fmt.Errorf("limit price is required for LIMIT orders")
+		}
+	case "STOPMARKET":
+		if p.StopPrice <= 0 {
+			return fmt.Errorf("stop price is required for STOPMARKET orders")
+		}
+	case "STOPLIMIT":
+		if p.LimitPrice <= 0 || p.StopPrice <= 0 {
+			return fmt.Errorf("limit and stop prices are required for STOPLIMIT orders")
+		}
+	default:
+		return fmt.Errorf("invalid order type %q: must be MARKET, LIMIT, STOPMARKET or STOPLIMIT", p.OrderType)
+	}
+	if p.TIF != "DAY" && p.TIF != "GTC" {
+		return fmt.Errorf("invalid TIF %q: must be DAY or GTC", p.TIF)
+	}
+	return nil
+}
+
+// oifLine returns the payload as an OIF PLACE command.
+func (p *PlaceOrderPayload) oifLine() OIFLine {
+	return OIFLine{
+		Command:    "PLACE",
+		Account:    p.Account,
+		Instrument: p.Instrument,
+		Action:     p.Action,
+		Quantity:   p.Quantity,
+		OrderType:  p.OrderType,
+		LimitPrice: p.LimitPrice,
+		StopPrice:  p.StopPrice,
+		TIF:        p.TIF,
+		OcoId:      p.OcoId,
+		OrderId:    p.OrderId,
+		Strategy:   p.Strategy,
+		StrategyId: p.StrategyId,
+	}
+}
+
+// ChangeOrderPayload modifies a working order. Zero values leave the
+// corresponding field of the order unchanged.
+type ChangeOrderPayload struct {
+	Account    string  `json:"account"`
+	OrderId    string  `json:"orderId"`
+	Quantity   int     `json:"quantity"`
+	LimitPrice float64 `json:"limitPrice"`
+	StopPrice  float64 `json:"stopPrice"`
+	StrategyId string  `json:"strategyId"`
+}
+
+func (p *ChangeOrderPayload) validate() error {
+	if p.OrderId == "" {
+		return fmt.Errorf("orderId is required")
+	}
+	if p.Quantity < 0 || p.LimitPrice < 0 || p.StopPrice < 0 {
+		return fmt.Errorf("quantity and prices must not be negative")
+	}
+	if p.Quantity == 0 && p.LimitPrice == 0 && p.StopPrice == 0 {
+		return fmt.Errorf("nothing to change: quantity, limitPrice or stopPrice is required")
+	}
+	return nil
+}
+
+// oifLine returns the payload as an OIF CHANGE command.
+func (p *ChangeOrderPayload) oifLine() OIFLine {
+	return OIFLine{
+		Command:    "CHANGE",
+		Account:    p.Account,
+		Quantity:   p.Quantity,
+		LimitPrice: p.LimitPrice,
+		StopPrice:  p.StopPrice,
+		OrderId:    p.OrderId,
+		StrategyId: p.StrategyId,
+	}
+}
+
+// PlaceBracketPayload describes an entry order protected by a stop-loss and
+// a profit target. The two exits share an OCO id so that a fill on one
+// cancels the other, and are only placed once the entry fills.
+type PlaceBracketPayload struct {
+	Account     string  `json:"account"`
+	Instrument  string  `json:"instrument"`
+	Action      string  `json:"action"`
+	Quantity    int     `json:"quantity"`
+	EntryType   string  `json:"entryType"`
+	EntryPrice  float64 `json:"entryPrice"`
+	StopPrice   float64 `json:"stopPrice"`
+	TargetPrice float64 `json:"targetPrice"`
+	TIF         string  `json:"tif"`
+	OcoId       string  `json:"ocoId"`
+}
+
+func (p *PlaceBracketPayload) validate() error {
+	p.Action = strings.ToUpper(strings.TrimSpace(p.Action))
+	p.EntryType = strings.ToUpper(strings.TrimSpace(p.EntryType))
+	if p.EntryType == "" {
+		p.EntryType = "MARKET"
+	}
+	if p.EntryType != "MARKET" && p.EntryType != "LIMIT" {
+		return fmt.Errorf("invalid entry type %q: must be MARKET or LIMIT", p.EntryType)
+	}
+	entry := p.entry()
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	p.TIF = entry.TIF
+	if p.StopPrice <= 0 || p.TargetPrice <= 0 {
+		return fmt.Errorf("stop and target prices are required")
+	}
+
+	// The stop must sit on the losing side and the target on the winning
+	// side of the entry; for market entries we can only check them against
+	// each other.
+	long := p.Action == "BUY"
+	if long && p.StopPrice >= p.TargetPrice || !long && p.StopPrice <= p.TargetPrice {
+		return fmt.Errorf("stop %s and target %s are on the wrong sides for a %s bracket",
+			formatPrice(p.StopPrice), formatPrice(p.TargetPrice), p.Action)
+	}
+	if p.EntryType == "LIMIT" {
+		if long && (p.StopPrice >= p.EntryPrice || p.TargetPrice <= p.EntryPrice) ||
+			!long && (p.StopPrice <= p.EntryPrice || p.TargetPrice >= p.EntryPrice) {
+			return fmt.Errorf("entry %s must lie between stop %s and target %s",
+				formatPrice(p.EntryPrice), formatPrice(p.StopPrice), formatPrice(p.TargetPrice))
+		}
+	}
+	return nil
+}
+
+func (p *PlaceBracketPayload) entry() PlaceOrderPayload {
+	entry := PlaceOrderPayload{
+		Account:    p.Account,
+		Instrument: p.Instrument,
+		Action:     p.Action,
+		Quantity:   p.Quantity,
+		OrderType:  p.EntryType,
+		TIF:        p.TIF,
+	}
+	if p.EntryType == "LIMIT" {
+		entry.LimitPrice = p.EntryPrice
+	}
+	if p.OcoId != "" {
+		entry.OrderId = p.OcoId + "_entry"
+	}
+	return entry
+}
+
+// orders returns the entry, stop-loss and profit-target orders in the order
+// they must be submitted. validate must have been called first.
+func (p *PlaceBracketPayload) orders() []PlaceOrderPayload {
+	exitAction := "SELL"
+	if p.Action == "SELL" {
+		exitAction = "BUY"
+	}
+
+	entry := p.entry()
+	stop := PlaceOrderPayload{
+		Account:    p.Account,
+		Instrument: p.Instrument,
+		Action:     exitAction,
+		Quantity:   p.Quantity,
+		OrderType:  "STOPMARKET",
+		StopPrice:  p.StopPrice,
+		TIF:        p.TIF,
+		OcoId:      p.OcoId,
+		OrderId:    p.OcoId + "_stop",
+	}
+	target := PlaceOrderPayload{
+		Account:    p.Account,
+		Instrument: p.Instrument,
+		Action:     exitAction,
+		Quantity:   p.Quantity,
+		OrderType:  "LIMIT",
+		LimitPrice: p.TargetPrice,
+		TIF:        p.TIF,
+		OcoId:      p.OcoId,
+		OrderId:    p.OcoId + "_target",
+	}
+	return []PlaceOrderPayload{entry, stop, target}
+}
+
+type CancelAllOrdersPayload struct {
+	Account    string `json:"account"`
+	Instrument string `json:"instrument,omitempty"`
+}
+
+// BreakevenPayload moves the stop-loss of a position to its average price,
+// optionally offset by a number of ticks in the position's favor.
+type BreakevenPayload struct {
+	Account     string `json:"account"`
+	Instrument  string `json:"instrument"`
+	OffsetTicks int    `json:"offsetTicks"`
+}
+
+// NudgeOrderPayload moves a working order's price by a number of ticks;
+// positive values move it up, negative values down.
+type NudgeOrderPayload struct {
+	Account string `json:"account"`
+	OrderId string `json:"orderId"`
+	Ticks   int    `json:"ticks"`
+}
+
+// ArmTrailPayload arms a trailing stop for a position. Distance is in ticks
+// for mode "ticks" and in percent of price for mode "percent"; the stop is
+// only moved once it can improve by at least StepTicks.
+type ArmTrailPayload struct {
+	Account    string  `json:"account"`
+	Instrument string  `json:"instrument"`
+	Mode       string  `json:"mode"`
+	Distance   float64 `json:"distance"`
+	StepTicks  int     `json:"stepTicks"`
+}
+
+type CloseStrategyPayload struct {
+	Account    string `json:"account"`
+	StrategyId string `json:"strategyId"`
+}
+
+func formatPrice(price float64) string {
+	return strconv.FormatFloat(price, 'f', -1, 64)
+}
+
+// OIFLine is one NinjaTrader Order Instruction File command. Build renders
+// it in the positional layout ATI expects for its Command, leaving out the
+// fields that command does not take:
+//
+//	PLACE;ACCOUNT;INSTRUMENT;ACTION;QTY;ORDER TYPE;LIMIT PRICE;STOP PRICE;TIF;OCO ID;ORDER ID;STRATEGY;STRATEGY ID
+//	CHANGE;;;;QTY;;LIMIT PRICE;STOP PRICE;;;ORDER ID;;STRATEGY ID
+//	CANCEL;;;;;;;;;;ORDER ID;;STRATEGY ID
+//	CLOSEPOSITION;ACCOUNT;INSTRUMENT;;;;;;;;;;
+//	CLOSESTRATEGY;;;;;;;;;;;;STRATEGY ID
+//
+// REVERSEPOSITION uses the PLACE layout; CANCELALLORDERS and
+// FLATTENEVERYTHING take no fields. Account is only written where the
+// layout has it, but is kept on the line so that fills reported back by
+// NinjaTrader can be attributed to the account of the order.
+type OIFLine struct {
+	Command    string
+	Account    string
+	Instrument string
+	Action     string
+	Quantity   int
+	OrderType  string
+	LimitPrice float64
+	StopPrice  float64
+	TIF        string
+	OcoId      string
+	OrderId    string
+	Strategy   string
+	StrategyId string
+}
+
+// Build renders the line. It fails rather than writing anything if a field
+// contains a separator, line break or other control character, since OIF
+// has no escaping and such a value would inject extra fields or commands.
+func (l OIFLine) Build() (string, error) {
+	text := map[string]string{
+		"account": l.Account, "instrument": l.Instrument, "action": l.Action,
+		"order type": l.OrderType, "TIF": l.TIF, "OCO id": l.OcoId,
+		"order id": l.OrderId, "strategy": l.Strategy, "strategy id": l.StrategyId,
+	}
+	for name, v := range text {
+		if strings.Contains(v, ";") || strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return "", fmt.Errorf("invalid OIF %s %q: must not contain ';' or control characters", name, v)
+		}
+	}
+	if l.Quantity < 0 || l.LimitPrice < 0 || l.StopPrice < 0 ||
+		math.IsNaN(l.LimitPrice) || math.IsNaN(l.StopPrice) || math.IsInf(l.LimitPrice, 0) || math.IsInf(l.StopPrice, 0) {
+		return "", fmt.Errorf("invalid OIF quantity or price")
+	}
+
+	f := make([]string, 13)
+	f[0] = l.Command
+	switch l.Command {
+	case "PLACE", "REVERSEPOSITION":
+		if l.Account == "" || l.Instrument == "" {
+			return "", fmt.Errorf("OIF %s requires an account and instrument", l.Command)
+		}
+		f[1], f[2], f[3] = l.Account, l.Instrument, l.Action
+		f[4], f[5] = strconv.Itoa(l.Quantity), l.OrderType
+		f[6], f[7] = formatPrice(l.LimitPrice), formatPrice(l.StopPrice)
+		f[8], f[9], f[10], f[11], f[12] = l.TIF, l.OcoId, l.OrderId, l.Strategy, l.StrategyId
+	case "CHANGE":
+		if l.OrderId == "" {
+			return "", fmt.Errorf("OIF CHANGE requires an order id")
+		}
+		f[4] = strconv.Itoa(l.Quantity)
+		f[6], f[7] = formatPrice(l.LimitPrice), formatPrice(l.StopPrice)
+		f[10], f[12] = l.OrderId, l.StrategyId
+	case "CANCEL":
+		if l.OrderId == "" {
+			return "", fmt.Errorf("OIF CANCEL requires an order id")
+		}
+		f[10], f[12] = l.OrderId, l.StrategyId
+	case "CLOSEPOSITION":
+		if l.Account == "" || l.Instrument == "" {
+			return "", fmt.Errorf("OIF CLOSEPOSITION requires an account and instrument")
+		}
+		f[1], f[2] = l.Account, l.Instrument
+	case "CLOSESTRATEGY":
+		if l.StrategyId == "" {
+			return "", fmt.Errorf("OIF CLOSESTRATEGY requires a strategy id")
+		}
+		f[12] = l.StrategyId
+	case "CANCELALLORDERS", "FLATTENEVERYTHING":
+	default:
+		return "", fmt.Errorf("unknown OIF command %q", l.Command)
+	}
+	return strings.Join(f, ";"), nil
+}
+
+// defaultTickSizes holds the minimum price increment of common futures,
+// keyed by master instrument name. TICK_SIZES can add to or override it.
+var defaultTickSizes = map[string]float64{
+	"ES": 0.25, "MES": 0.25, "NQ": 0.25, "MNQ": 0.25,
+	"YM": 1, "MYM": 1, "RTY": 0.1, "M2K": 0.1,
+	"CL": 0.01, "MCL": 0.01, "NG": 0.001, "GC": 0.1, "MGC": 0.1, "SI": 0.005,
+	"ZB": 0.03125, "ZN": 0.015625, "ZF": 0.0078125,
+	"6E": 0.00005, "6B": 0.0001, "6J": 0.0000005,
+}
+
+// parseTickSizes parses "ES=0.25,CL=0.01" into a map on top of the defaults.
+func parseTickSizes(spec string) map[string]float64 {
+	sizes := make(map[string]float64, len(defaultTickSizes))
+	for root, size := range defaultTickSizes {
+		sizes[root] = size
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("Ignoring malformed TICK_SIZES entry %q", entry)
+			continue
+		}
+		size, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || size <= 0 {
+			log.Printf("Ignoring invalid tick size in TICK_SIZES entry %q", entry)
+			continue
+		}
+		sizes[strings.ToUpper(strings.TrimSpace(parts[0]))] = size
+	}
+	return sizes
+}
+
+// instrumentRoot returns the master instrument of a full NinjaTrader
+// instrument name, e.g. "ES" for "ES 12-26".
+func instrumentRoot(instrument string) string {
+	if i := strings.IndexByte(instrument, ' '); i >= 0 {
+		instrument = instrument[:i]
+	}
+	return strings.ToUpper(instrument)
+}
+
+func roundToTick(price, tick float64) float64 {
+	// Round twice so that results like 1234.3000000000002 do not leak into OIF.
+	return math.Round(math.Round(price/tick)*tick*1e8) / 1e8
+}
+
+// Trail is the state of one armed trailing stop, persisted across restarts
+// and reported to the dashboard.
+type Trail struct {
+	Account    string    `json:"account"`
+	Instrument string    `json:"instrument"`
+	Mode       string    `json:"mode"`
+	Distance   float64   `json:"distance"`
+	StepTicks  int       `json:"stepTicks"`
+	ArmedAt    time.Time `json:"armedAt"`
+	BestPrice  float64   `json:"bestPrice"`
+	StopPrice  float64   `json:"stopPrice"`
+	LastMoved  time.Time `json:"lastMoved,omitempty"`
+	Status     string    `json:"status"`
+}
+
+// SizeLimits cap open contracts, order size and resting orders. A zero
+// limit is not enforced.
+type SizeLimits struct {
+	MaxPosition      int `json:"maxPosition"`
+	MaxOrderQuantity int `json:"maxOrderQuantity"`
+	MaxWorkingOrders int `json:"maxWorkingOrders"`
+}
+
+// RiskLimits are the limits enforced on one account. A zero limit is not
+// enforced.
+type RiskLimits struct {
+	DailyLossLimit float64 `json:"dailyLossLimit"`
+	// Size limits on the account as a whole
+	SizeLimits
+	// Instruments limits single instruments, keyed by instrument or master
+	// instrument, e.g. "ES 12-26" or "ES"
+	Instruments map[string]SizeLimits `json:"instruments,omitempty"`
+	// AutoReduce trades a position found above its limit back down to it
+	AutoReduce bool `json:"autoReduce"`
+	// Trailing drawdown rule of an evaluation or funded account
+	TrailingDrawdown *DrawdownLimits `json:"trailingDrawdown,omitempty"`
+	// What to do about positions without a covering stop
+	NakedPositions *NakedPolicy `json:"nakedPositions,omitempty"`
+}
+
+// NakedPolicy alerts on a position whose stops do not cover its quantity
+// once it has been uncovered for GraceSeconds, and with AutoStopTicks
+// places a stop that many ticks away for the uncovered quantity.
+type NakedPolicy struct {
+	GraceSeconds  float64 `json:"graceSeconds"`
+	AutoStopTicks int     `json:"autoStopTicks,omitempty"`
+}
+
+// defaultNakedPolicy applies without RISK_CONFIG: alert only.
+var defaultNakedPolicy = NakedPolicy{GraceSeconds: 30}
+
+// NakedPosition is an open position not fully covered by stop orders,
+// reported to the dashboard.
+type NakedPosition struct {
+	Account    string    `json:"account"`
+	Instrument string    `json:"instrument"`
+	Quantity   int       `json:"quantity"`
+	Covered    int       `json:"covered"`
+	Status     string    `json:"status"`
+	Since      time.Time `json:"since"`
+	Alerted    bool      `json:"alerted"`
+	StopPlaced bool      `json:"stopPlaced,omitempty"`
+	// StopOrderId is the protective stop placed for the position
+	StopOrderId string `json:"stopOrderId,omitempty"`
+	// lastStopAttempt spaces out retries of a stop that failed to place
+	lastStopAttempt time.Time
+}
+
+// DrawdownLimits describe a trailing drawdown: the account is liquidated
+// when its equity falls Amount below its high-water mark. In "intraday"
+// mode the mark follows equity tick by tick, in "eod" mode it follows the
+// balance at the end of each trading day. The threshold stops trailing at
+// LockAt when set. The account is flattened FlattenBuffer before it, or on
+// the breach itself without a buffer.
+type DrawdownLimits struct {
+	Amount          float64 `json:"amount"`
+	Mode            string  `json:"mode"`
+	LockAt          float64 `json:"lockAt,omitempty"`
+	FlattenBuffer   float64 `json:"flattenBuffer,omitempty"`
+	// StartingBalance is the initial high-water mark, e.g. the size of an
+	// evaluation account, for tracking that starts after it has lost money
+	StartingBalance float64 `json:"startingBalance,omitempty"`
+}
+
+// DrawdownState tracks an account against its trailing drawdown. It is
+// persisted so the high-water mark survives restarts, and reported to the
+// dashboard.
+type DrawdownState struct {
+	Account     string    `json:"account"`
+	Mode        string    `json:"mode"`
+	HighWater   float64   `json:"highWater"`
+	Threshold   float64   `json:"threshold"`
+	Equity      float64   `json:"equity"`
+	Distance    float64   `json:"distance"`
+	Buffer      float64   `json:"buffer,omitempty"`
+	TradingDay  string    `json:"tradingDay"`
+	DayBalance  float64   `json:"dayBalance"`
+	Breached    bool      `json:"breached"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	lastFlatten time.Time
+}
+
+// RiskConfig is read from the JSON file named by RISK_CONFIG. Default
+// applies to every account; Accounts overrides it field by field.
+type RiskConfig struct {
+	Timezone        string                `json:"timezone"`
+	TradingDayStart string                `json:"tradingDayStart"`
+	Default         RiskLimits            `json:"default"`
+	Accounts        map[string]RiskLimits `json:"accounts"`
+	location        *time.Location
+	startHour       int
+	startMinute     int
+}
+
+// RiskState is an account's standing against its daily loss limit,
+// persisted so that a restart does not lift a lockout, and reported to the
+// dashboard.
+type RiskState struct {
+	Account     string     `json:"account"`
+	TradingDay  string     `json:"tradingDay"`
+	DailyPnL    float64    `json:"dailyPnl"`
+	LossLimit   float64    `json:"lossLimit"`
+	Headroom    float64    `json:"headroom"`
+	Breached    bool       `json:"breached"`
+	BreachedAt  *time.Time `json:"breachedAt,omitempty"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+	lastFlatten time.Time
+}
+
+// riskReflattenInterval spaces out repeated flattens of a locked account
+// that still shows exposure, while the first one is being worked.
+const riskReflattenInterval = 10 * time.Second
+
+// orderEntryCommands are the commands that can open new exposure and are
+// refused on a locked account.
+var orderEntryCommands = map[string]bool{
+	"place_order":      true,
+	"place_bracket":    true,
+	"place_atm_order":  true,
+	"reverse_position": true,
+}
+
+// errRiskLocked rejects new orders on an account that breached its limit.
+var errRiskLocked = errors.New("risk lockout")
+
+// errRiskLimit rejects orders that would break a size limit.
+var errRiskLimit = errors.New("risk limit")
+
+func loadRiskConfig(path string) (*RiskConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rc RiskConfig
+	if err := json.Unmarshal(data, &rc); err != nil {
+		return nil, err
+	}
+	if rc.Timezone == "" {
+		rc.Timezone = "America/Chicago"
+	}
+	if rc.location, err = time.LoadLocation(rc.Timezone); err != nil {
+		return nil, fmt.Errorf("invalid timezone: %w", err)
+	}
+	if rc.TradingDayStart == "" {
+		rc.TradingDayStart = "17:00"
+	}
+	start, err := time.Parse("15:04", rc.TradingDayStart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tradingDayStart %q: want HH:MM", rc.TradingDayStart)
+	}
+	rc.startHour, rc.startMinute = start.Hour(), start.Minute()
+	for name, l := range rc.Accounts {
+		if err := l.TrailingDrawdown.validate(); err != nil {
+			return nil, fmt.Errorf("account %s: %w", name, err)
+		}
+	}
+	if err := rc.Default.TrailingDrawdown.validate(); err != nil {
+		return nil, fmt.Errorf("default: %w", err)
+	}
+	return &rc, nil
+}
+
+// limits returns the limits for account: its own where set, else the
+// defaults.
+func (rc *RiskConfig) limits(account string) RiskLimits {
+	l := rc.Default
+	a, ok := rc.Accounts[account]
+	if !ok {
+		return l
+	}
+	if a.DailyLossLimit > 0 {
+		l.DailyLossLimit = a.DailyLossLimit
+	}
+	if a.MaxPosition > 0 {
+		l.MaxPosition = a.MaxPosition
+	}
+	if a.MaxOrderQuantity > 0 {
+		l.MaxOrderQuantity = a.MaxOrderQuantity
+	}
+	if a.MaxWorkingOrders > 0 {
+		l.MaxWorkingOrders = a.MaxWorkingOrders
+	}
+	if len(a.Instruments) > 0 {
+		merged := make(map[string]SizeLimits, len(l.Instruments)+len(a.Instruments))
+		for k, v := range l.Instruments {
+			merged[k] = v
+		}
+		for k, v := range a.Instruments {
+			merged[k] = v
+		}
+		l.Instruments = merged
+	}
+	l.AutoReduce = l.AutoReduce || a.AutoReduce
+	if a.TrailingDrawdown != nil {
+		l.TrailingDrawdown = a.TrailingDrawdown
+	}
+	if a.NakedPositions != nil {
+		l.NakedPositions = a.NakedPositions
+	}
+	return l
+}
+
+func (d *DrawdownLimits) validate() error {
+	if d == nil {
+		return nil
+	}
+	if d.Mode == "" {
+		d.Mode = "intraday"
+	}
+	if d.Mode != "intraday" && d.Mode != "eod" {
+		return fmt.Errorf("invalid trailingDrawdown mode %q: must be intraday or eod", d.Mode)
+	}
+	if d.Amount <= 0 || d.LockAt < 0 || d.StartingBalance < 0 || d.FlattenBuffer < 0 || d.FlattenBuffer >= d.Amount {
+		return fmt.Errorf("trailingDrawdown needs a positive amount and a flattenBuffer below it")
+	}
+	return nil
+}
+
+// instrument returns the size limits for instrument, looked up by full
+// name and then by master instrument.
+func (l RiskLimits) instrument(instrument string) SizeLimits {
+	if sl, ok := l.Instruments[instrument]; ok {
+		return sl
+	}
+	return l.Instruments[instrumentRoot(instrument)]
+}
+
+// tradingDay names the trading day t falls in and returns when the next one
+// starts. A session belongs to the date on which it closes, and no session
+// opens on Saturday.
+func (rc *RiskConfig) tradingDay(t time.Time) (string, time.Time) {
+	local := t.In(rc.location)
+	next := time.Date(local.Year(), local.Month(), local.Day(), rc.startHour, rc.startMinute, 0, 0, rc.location)
+	if !local.Before(next) {
+		next = next.AddDate(0, 0, 1)
+	}
+	for next.Weekday() == time.Saturday {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next.Format("2006-01-02"), next
+}
+
+func trailKey(account, instrument string) string {
+	return account + "|" + instrument
+}
+
+// verification watches incoming snapshots for the expected effect of a
+// command that has already been written to NinjaTrader.
+type verification struct {
+	commandID   string
+	account     string
+	description string
+	satisfied   func(Snapshot) bool
+	deadline    time.Time
+}
+
+// outgoingFile remembers what was last seen in a file of NinjaTrader's
+// outgoing folder so that only transitions are forwarded.
+type outgoingFile struct {
+	modTime time.Time
+	content string
+}
+
+// pendingBracket holds the exits of a bracket until its entry fills.
+// placed is the quantity the exits were last placed or changed for, and
+// startPosition the account's position in the instrument when the entry
+// was sent, against which snapshots show the fill.
+type pendingBracket struct {
+	commandID     string
+	payload       PlaceBracketPayload
+	placed        int
+	startPosition int
+	createdAt     time.Time
+	// reported is set once the entry's state is read from the outgoing
+	// folder; alerted once the operator was told the exits are still held
+	reported bool
+	alerted  bool
+}
+
+// bracketPendingAlert is how long the exits of a bracket are held for an
+// unfilled entry before an alert is raised.
+const bracketPendingAlert = 5 * time.Minute
+
+// issuedOrder links an order id we put into an OIF line to its command.
+type issuedOrder struct {
+	commandID  string
+	account    string
+	instrument string
+	issuedAt   time.Time
+}
+
+// executedCommand is the result of a command, kept so that a redelivered
+// command is acknowledged with its original result instead of running again.
+type executedCommand struct {
+	Type       string    `json:"type"`
+	Error      string    `json:"error,omitempty"`
+	Simulated  bool      `json:"simulated,omitempty"`
+	Expired    bool      `json:"expired,omitempty"`
+	ExecutedAt time.Time `json:"executedAt"`
+}
+
+const executedRetention = 24 * time.Hour
+
+// pendingOIF is an OIF file written to the incoming folder that NinjaTrader
+// has not consumed yet.
+type pendingOIF struct {
+	commandID string
+	line      string
+	writtenAt time.Time
+}
+
+// Executor carries out the OIF lines of a command. Implementations are
+// selected with the EXECUTOR environment variable.
+type Executor interface {
+	Execute(commandID string, lines []OIFLine) error
+}
+
+// OIFExecutor writes each line to its own file in NinjaTrader's incoming
+// folder, in order, so that multi-order commands such as brackets are
+// picked up in sequence. Files are written under a temporary name outside
+// the folder and renamed in, so ATI never reads a partial file.
+type OIFExecutor struct {
+	incomingDir string
+	onWrite     func(commandID, path string, line OIFLine, text string)
+}
+
+func (e *OIFExecutor) Execute(commandID string, lines []OIFLine) error {
+	texts, err := buildOIF(lines)
+	if err != nil {
+		return err
+	}
+	for i, text := range texts {
+		tmp, err := os.CreateTemp(filepath.Dir(e.incomingDir), ".oif_*.tmp")
+		if err != nil {
+			return err
+		}
+		_, err = tmp.WriteString(text + "\r\n")
+		if err == nil {
+			err = tmp.Sync()
+		}
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		path := filepath.Join(e.incomingDir, fmt.Sprintf("oif_%d_%d_%d.txt", time.Now().UnixNano(), i, rand.Intn(10000)))
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		if e.onWrite != nil {
+			e.onWrite(commandID, path, lines[i], text)
+		}
+	}
+	return nil
+}
+
+// DryRunExecutor validates and logs OIF lines without handing them to
+// NinjaTrader. If sandboxDir is set the files are also written there, as
+// they would have been to the incoming folder.
+type DryRunExecutor struct {
+	sandboxDir string
+}
+
+func (e DryRunExecutor) Execute(commandID string, lines []OIFLine) error {
+	texts, err := buildOIF(lines)
+	if err != nil {
+		return err
+	}
+	for _, text := range texts {
+		log.Printf("Dry run: command %s: %s", commandID, text)
+	}
+	if e.sandboxDir != "" {
+		return (&OIFExecutor{incomingDir: e.sandboxDir}).Execute(commandID, lines)
+	}
+	return nil
+}
+
+// RecordedOIF is one line captured by a RecordingExecutor.
+type RecordedOIF struct {
+	CommandID string
+	Line      string
+}
+
+// RecordingExecutor keeps the lines it is given in memory instead of
+// writing them, for exercising command handling without NinjaTrader. With
+// a limit only the most recent lines are kept.
+type RecordingExecutor struct {
+	mu    sync.Mutex
+	lines []RecordedOIF
+	limit int
+}
+
+func (e *RecordingExecutor) Execute(commandID string, lines []OIFLine) error {
+	texts, err := buildOIF(lines)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, text := range texts {
+		e.lines = append(e.lines, RecordedOIF{CommandID: commandID, Line: text})
+	}
+	if e.limit > 0 && len(e.lines) > e.limit {
+		e.lines = append([]RecordedOIF(nil), e.lines[len(e.lines)-e.limit:]...)
+	}
+	return nil
+}
+
+// Recorded returns the lines executed so far.
+func (e *RecordingExecutor) Recorded() []RecordedOIF {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]RecordedOIF(nil), e.lines...)
+}
+
+// buildOIF renders every line up front so that a command is either written
+// in full or not at all.
+func buildOIF(lines []OIFLine) ([]string, error) {
+	texts := make([]string, 0, len(lines))
+	for _, line := range lines {
+		text, err := line.Build()
+		if err != nil {
+			return nil, err
+		}
+		texts = append(texts, text)
+	}
+	return texts, nil
+}
+
 type ConnectionServer struct {
 	mu              sync.RWMutex
 	latest          map[string]Snapshot
@@ -82,11 +961,50 @@ type ConnectionServer struct {
 	reconnectChan   chan struct{}
 	cloudURL        string
 	apiSecretToken  string
+	name            string
 	incomingDir     string
 	commandChan     chan Command
 	isConnected     bool
 	connectAttempts int
 	maxReconnects   int
+	tickSizes       map[string]float64
+	stateDir        string
+	trails          map[string]*Trail
+	trailsMu        sync.Mutex
+	verifyWindow    time.Duration
+	verifications   []*verification
+	verifyMu        sync.Mutex
+	// OIF consumption tracking
+	pendingOIF        map[string]pendingOIF
+	oifMu             sync.Mutex
+	consumeTimeout    time.Duration
+	staleScanInterval time.Duration
+	staleCount        int
+	staleAlertAt      time.Time
+	// NinjaTrader outgoing folder watching
+	outgoingDir       string
+	outgoingFiles     map[string]outgoingFile
+	outgoingReadable  bool
+	issuedOrders      map[string]issuedOrder
+	brackets          map[string]*pendingBracket
+	executor          Executor
+	executed          map[string]executedCommand
+	executedMu        sync.Mutex
+	// simulated is set when the executor never reaches NinjaTrader, so
+	// acknowledgments are flagged and effects are not verified.
+	simulated bool
+	// Daily loss limits; risk is nil when RISK_CONFIG is not set
+	risk       *RiskConfig
+	riskStates map[string]*RiskState
+	riskMu     sync.Mutex
+	// When each position above its size limit was last acted on, and the
+	// auto-reduce order still in flight for it
+	oversize map[string]time.Time
+	reducing map[string]reduceOrder
+	// Trailing drawdown tracking, persisted in stateDir
+	drawdowns map[string]*DrawdownState
+	// Positions not fully covered by stops
+	naked map[string]*NakedPosition
 }
 
 func NewConnectionServer() *ConnectionServer {
@@ -106,26 +1024,131 @@ func NewConnectionServer() *ConnectionServer {
 		incoming = filepath.Join(home, "Documents", "NinjaTrader 8", "incoming")
 	}
 
-	return &ConnectionServer{
+	name := os.Getenv("CONNECTION_NAME")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+
+	stateDir := os.Getenv("STATE_DIR")
+	if stateDir == "" {
+		stateDir = "state"
+	}
+
+	verifyWindow := 15 * time.Second
+	if v := os.Getenv("VERIFY_WINDOW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			verifyWindow = d
+		} else {
+			log.Printf("Ignoring invalid VERIFY_WINDOW %q", v)
+		}
+	}
+
+	outgoing := os.Getenv("NT_OUTGOING")
+	if outgoing == "" {
+		outgoing = filepath.Join(filepath.Dir(incoming), "outgoing")
+	}
+
+	consumeTimeout := 10 * time.Second
+	if v := os.Getenv("OIF_CONSUME_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			consumeTimeout = d
+		} else {
+			log.Printf("Ignoring invalid OIF_CONSUME_TIMEOUT %q", v)
+		}
+	}
+
+	cs := &ConnectionServer{
 		latest:        make(map[string]Snapshot),
 		cloudURL:      cloudURL,
 		apiSecretToken: apiSecretToken,
+		name:          name,
 		incomingDir:   incoming,
 		commandChan:   make(chan Command, 100), // Buffered channel to prevent blocking
 		reconnectChan: make(chan struct{}, 1),
 		maxReconnects: 10,
+		tickSizes:     parseTickSizes(os.Getenv("TICK_SIZES")),
+		stateDir:      stateDir,
+		trails:        make(map[string]*Trail),
+		verifyWindow:  verifyWindow,
+		pendingOIF:    make(map[string]pendingOIF),
+		consumeTimeout: consumeTimeout,
+		staleScanInterval: 30 * time.Second,
+		outgoingDir:   outgoing,
+		outgoingFiles: make(map[string]outgoingFile),
+		issuedOrders:  make(map[string]issuedOrder),
+		brackets:      make(map[string]*pendingBracket),
+		executed:      make(map[string]executedCommand),
+		riskStates:    make(map[string]*RiskState),
+		oversize:      make(map[string]time.Time),
+		reducing:      make(map[string]reduceOrder),
+		drawdowns:     make(map[string]*DrawdownState),
+		naked:         make(map[string]*NakedPosition),
 	}
+
+	if path := os.Getenv("RISK_CONFIG"); path != "" {
+		rc, err := loadRiskConfig(path)
+		if err != nil {
+			log.Fatalf("Cannot load RISK_CONFIG %s: %v", path, err)
+		}
+		cs.risk = rc
+	}
+
+	switch executor := os.Getenv("EXECUTOR"); executor {
+	case "", "oif":
+		cs.executor = &OIFExecutor{incomingDir: incoming, onWrite: cs.trackOIF}
+	case "dryrun":
+		sandbox := os.Getenv("DRY_RUN_DIR")
+		if sandbox != "" {
+			if err := os.MkdirAll(sandbox, 0755); err != nil {
+				log.Fatalf("Cannot create DRY_RUN_DIR %s: %v", sandbox, err)
+			}
+		}
+		cs.executor = DryRunExecutor{sandboxDir: sandbox}
+		cs.simulated = true
+	case "record":
+		limit := 1000
+		if v := os.Getenv("RECORD_LIMIT"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				limit = n
+			} else {
+				log.Printf("Ignoring invalid RECORD_LIMIT %q", v)
+			}
+		}
+		cs.executor = &RecordingExecutor{limit: limit}
+		cs.simulated = true
+	default:
+		log.Fatalf("Unknown EXECUTOR %q: must be oif, dryrun or record", executor)
+	}
+	return cs
 }
 
 func (cs *ConnectionServer) Start() {
 	log.Printf("Starting Connection Server")
 	log.Printf("Cloud URL: %s", cs.cloudURL)
+	log.Printf("Connection name: %s", cs.name)
 	log.Printf("NT Incoming: %s", cs.incomingDir)
+	log.Printf("NT Outgoing: %s", cs.outgoingDir)
+	log.Printf("Executor: %T", cs.executor)
+	if cs.simulated {
+		log.Printf("DRY RUN: commands are validated and acknowledged as simulated; nothing is sent to NinjaTrader")
+	}
 
 	if _, err := os.Stat(cs.incomingDir); os.IsNotExist(err) {
 		log.Printf("Warning: NinjaTrader incoming folder does not exist at %s", cs.incomingDir)
 	}
 
+	if err := os.MkdirAll(cs.stateDir, 0755); err != nil {
+		log.Printf("Warning: cannot create state directory %s: %v", cs.stateDir, err)
+	}
+	cs.loadTrails()
+	cs.loadExecuted()
+	if cs.risk != nil {
+		log.Printf("Risk limits: default daily loss %v, %d account override(s), trading day starts %s %s",
+			cs.risk.Default.DailyLossLimit, len(cs.risk.Accounts), cs.risk.TradingDayStart, cs.risk.Timezone)
+		cs.loadRiskStates()
+		cs.loadDrawdowns()
+	}
+
 	// Start HTTP server for NinjaTrader webhooks
 	http.HandleFunc("/webhook", cs.webhookHandler)
 	
@@ -139,6 +1162,10 @@ func (cs *ConnectionServer) Start() {
 	
 	// Start command processor
 	go cs.processCommands()
+	go cs.expireVerifications()
+	go cs.watchOIFConsumption()
+	go cs.watchOutgoing()
+	go cs.watchProtection()
 	
 	// Initial connection attempt
 	cs.reconnectChan <- struct{}{}
@@ -177,6 +1204,11 @@ func (cs *ConnectionServer) webhookHandler(w http.ResponseWriter, r *http.Reques
 
 	// Send to cloud dashboard
 	cs.sendToCloud(data)
+	cs.checkVerifications(snap)
+	cs.checkBrackets(snap)
+	cs.updateTrails(snap)
+	cs.checkRisk(snap)
+	cs.checkProtection(snap)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -256,6 +1288,14 @@ func (cs *ConnectionServer) connectToCloud() {
 	// Start reading commands from cloud
 	go cs.readFromCloud()
 
+	// Identify ourselves so the dashboard can route account commands here
+	// and redeliver anything it queued while we were away.
+	hello, _ := json.Marshal(map[string]interface{}{
+		"type": "hello",
+		"data": map[string]string{"name": cs.name},
+	})
+	cs.wsConn.WriteMessage(websocket.TextMessage, hello)
+
 	// Send initial snapshot if we have data
 	cs.mu.RLock()
 	if len(cs.latest) > 0 {
@@ -268,7 +1308,20 @@ func (cs *ConnectionServer) connectToCloud() {
 	} else {
 		cs.mu.RUnlock()
 	}
-}
+
+	if data, err := cs.trailStateMessage(); err == nil {
+		cs.wsConn.WriteMessage(websocket.TextMessage, data)
+	}
+	if data, err := cs.riskStateMessage(); err == nil {
+		cs.wsConn.WriteMessage(websocket.TextMessage, data)
+	}
+	if data, err := cs.drawdownStateMessage(); err == nil {
+		cs.wsConn.WriteMessage(websocket.TextMessage, data)
+	}
+	if data, err := cs.protectionStateMessage(); err == nil {
+		cs.wsConn.WriteMessage(websocket.TextMessage, data)
+	}
+}
 
 func (cs *ConnectionServer) scheduleReconnect() {
 	cs.connectAttempts++
@@ -319,56 +1372,2068 @@ func (cs *ConnectionServer) readFromCloud() {
 
 func (cs *ConnectionServer) processCommands() {
 	for cmd := range cs.commandChan {
-		err := cs.executeCommand(cmd)
-		
-		// Send acknowledgment back to cloud
-		ack := map[string]interface{}{
-			"type": "command_ack",
-			"id":   cmd.ID,
+		// A dashboard retry or a replay after reconnect must not place the
+		// same order twice; answer with the original result instead.
+		if prev, ok := cs.executedResult(cmd.ID); ok {
+			log.Printf("Duplicate command %s (%s), replaying result from %s", cmd.ID, cmd.Type, prev.ExecutedAt.Format(time.RFC3339))
+			cs.sendAck(cmd.ID, prev, true)
+			continue
 		}
+
+		err := cs.executeCommand(cmd)
+		result := executedCommand{Type: cmd.Type, Simulated: cs.simulated, ExecutedAt: time.Now()}
 		if err != nil {
-			ack["error"] = err.Error()
+			result.Error = err.Error()
+			result.Expired = errors.Is(err, errCommandExpired)
 			log.Printf("Command execution failed: %v", err)
+		}
+		cs.recordExecuted(cmd.ID, result)
+
+		// Send acknowledgment back to cloud
+		cs.sendAck(cmd.ID, result, false)
+
+		// A simulated flatten never changes the snapshots, so there is
+		// nothing to verify.
+		if err == nil && !cs.simulated {
+			cs.watchEffect(cmd)
+		}
+	}
+}
+
+func (cs *ConnectionServer) sendAck(commandID string, result executedCommand, duplicate bool) {
+	ack := map[string]interface{}{
+		"type": "command_ack",
+		"id":   commandID,
+	}
+	if result.Error != "" {
+		ack["error"] = result.Error
+	} else {
+		ack["success"] = true
+	}
+	if result.Simulated {
+		ack["simulated"] = true
+	}
+	if result.Expired {
+		ack["expired"] = true
+	}
+	if duplicate {
+		ack["duplicate"] = true
+	}
+	data, _ := json.Marshal(ack)
+	cs.sendToCloud(data)
+}
+
+func (cs *ConnectionServer) executedPath() string {
+	return filepath.Join(cs.stateDir, "executed.json")
+}
+
+func (cs *ConnectionServer) loadExecuted() {
+	executed := make(map[string]executedCommand)
+	if err := readJSONFile(cs.executedPath(), &executed); err != nil {
+		log.Printf("Failed to load executed commands: %v", err)
+		return
+	}
+	cs.executedMu.Lock()
+	cs.executed = executed
+	cs.executedMu.Unlock()
+	if len(executed) > 0 {
+		log.Printf("Restored %d recently executed command id(s)", len(executed))
+	}
+}
+
+func (cs *ConnectionServer) executedResult(commandID string) (executedCommand, bool) {
+	if commandID == "" {
+		return executedCommand{}, false
+	}
+	cs.executedMu.Lock()
+	defer cs.executedMu.Unlock()
+	result, ok := cs.executed[commandID]
+	return result, ok
+}
+
+// recordExecuted persists the result of a command, dropping results older
+// than executedRetention.
+func (cs *ConnectionServer) recordExecuted(commandID string, result executedCommand) {
+	if commandID == "" {
+		return
+	}
+	cs.executedMu.Lock()
+	defer cs.executedMu.Unlock()
+	cs.executed[commandID] = result
+	for id, r := range cs.executed {
+		if time.Since(r.ExecutedAt) > executedRetention {
+			delete(cs.executed, id)
+		}
+	}
+	if err := writeJSONFile(cs.executedPath(), cs.executed); err != nil {
+		log.Printf("Failed to save executed commands: %v", err)
+	}
+}
+
+// watchEffect registers a verification for commands whose effect is visible
+// in the account snapshots.
+func (cs *ConnectionServer) watchEffect(cmd Command) {
+	var v *verification
+	switch cmd.Type {
+	case "flatten_account":
+		var p FlattenAccountPayload
+		if json.Unmarshal(cmd.Payload, &p) != nil {
+			return
+		}
+		v = &verification{
+			account:     p.Account,
+			description: fmt.Sprintf("account %s flat with no working orders", p.Account),
+			satisfied: func(snap Snapshot) bool {
+				for _, pos := range snap.Positions {
+					if pos.MarketPosition != "Flat" && pos.Quantity > 0 {
+						return false
+					}
+				}
+				return len(snap.WorkingOrders) == 0
+			},
+		}
+	case "close_position":
+		var p ClosePositionPayload
+		if json.Unmarshal(cmd.Payload, &p) != nil {
+			return
+		}
+		v = &verification{
+			account:     p.Account,
+			description: fmt.Sprintf("position in %s closed", p.Instrument),
+			satisfied: func(snap Snapshot) bool {
+				for _, pos := range snap.Positions {
+					if pos.Instrument == p.Instrument && pos.MarketPosition != "Flat" && pos.Quantity > 0 {
+						return false
+					}
+				}
+				return true
+			},
+		}
+	case "cancel_order":
+		var p CancelOrderPayload
+		if json.Unmarshal(cmd.Payload, &p) != nil {
+			return
+		}
+		v = &verification{
+			account:     p.Account,
+			description: fmt.Sprintf("order %s no longer working", p.OrderId),
+			satisfied: func(snap Snapshot) bool {
+				for _, o := range snap.WorkingOrders {
+					if o.OrderId == p.OrderId {
+						return false
+					}
+				}
+				return true
+			},
+		}
+	case "cancel_all_orders":
+		var p CancelAllOrdersPayload
+		if json.Unmarshal(cmd.Payload, &p) != nil {
+			return
+		}
+		description := fmt.Sprintf("no working orders for account %s", p.Account)
+		if p.Instrument != "" {
+			description = fmt.Sprintf("no working orders for %s", p.Instrument)
+		}
+		v = &verification{
+			account:     p.Account,
+			description: description,
+			satisfied: func(snap Snapshot) bool {
+				for _, o := range snap.WorkingOrders {
+					if p.Instrument == "" || o.Instrument == p.Instrument {
+						return false
+					}
+				}
+				return true
+			},
+		}
+	default:
+		return
+	}
+	v.commandID = cmd.ID
+	v.deadline = time.Now().Add(cs.verifyWindow)
+
+	// The effect may already show, e.g. flattening an account that is
+	// flat, and no further snapshot may come to confirm it.
+	if snap, ok := cs.snapshot(v.account); ok && v.satisfied(snap) {
+		log.Printf("Command %s verified: %s", v.commandID, v.description)
+		cs.sendVerification(v.commandID, true, "")
+		return
+	}
+	cs.verifyMu.Lock()
+	cs.verifications = append(cs.verifications, v)
+	cs.verifyMu.Unlock()
+}
+
+// checkVerifications resolves every pending verification for the snapshot's
+// account whose expected effect is now visible.
+func (cs *ConnectionServer) checkVerifications(snap Snapshot) {
+	var done []*verification
+	cs.verifyMu.Lock()
+	pending := cs.verifications[:0]
+	for _, v := range cs.verifications {
+		if v.account == snap.Account && v.satisfied(snap) {
+			done = append(done, v)
 		} else {
-			ack["success"] = true
+			pending = append(pending, v)
 		}
+	}
+	cs.verifications = pending
+	cs.verifyMu.Unlock()
 
-		data, _ := json.Marshal(ack)
-		cs.sendToCloud(data)
+	for _, v := range done {
+		log.Printf("Command %s verified: %s", v.commandID, v.description)
+		cs.sendVerification(v.commandID, true, "")
+	}
+}
+
+func (cs *ConnectionServer) expireVerifications() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, v := range cs.takeExpiredVerifications(time.Now()) {
+			log.Printf("Command %s not verified: %s not observed within %v", v.commandID, v.description, cs.verifyWindow)
+			cs.sendVerification(v.commandID, false, fmt.Sprintf("%s not observed within %v", v.description, cs.verifyWindow))
+		}
+	}
+}
+
+// takeExpiredVerifications removes and returns the verifications whose
+// deadline has passed at now.
+func (cs *ConnectionServer) takeExpiredVerifications(now time.Time) []*verification {
+	var expired []*verification
+	cs.verifyMu.Lock()
+	defer cs.verifyMu.Unlock()
+	pending := cs.verifications[:0]
+	for _, v := range cs.verifications {
+		if now.After(v.deadline) {
+			expired = append(expired, v)
+		} else {
+			pending = append(pending, v)
+		}
+	}
+	cs.verifications = pending
+	return expired
+}
+
+// sendVerification sends the second, effect-level acknowledgment of a command.
+func (cs *ConnectionServer) sendVerification(commandID string, verified bool, reason string) {
+	ack := map[string]interface{}{
+		"type":     "command_ack",
+		"id":       commandID,
+		"stage":    "verification",
+		"verified": verified,
+	}
+	if reason != "" {
+		ack["error"] = reason
 	}
+	data, _ := json.Marshal(ack)
+	cs.sendToCloud(data)
 }
 
 func (cs *ConnectionServer) executeCommand(cmd Command) error {
+	if err := cmd.checkExpiry(); err != nil {
+		return err
+	}
+	if orderEntryCommands[cmd.Type] {
+		if err := cs.checkRiskLock(cmd); err != nil {
+			return err
+		}
+	}
 	switch cmd.Type {
 	case "flatten_all":
-		return cs.writeOIF("FLATTENEVERYTHING;;;;;;;;;;;;")
+		return cs.writeOIF(cmd.ID, OIFLine{Command: "FLATTENEVERYTHING"})
 	case "flatten_account":
 		var p FlattenAccountPayload
 		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
 			return fmt.Errorf("failed to unmarshal flatten_account payload: %w", err)
 		}
-		return cs.writeOIF(fmt.Sprintf("FLATTENEVERYTHING;ACCOUNT=%s;;;;;;;;;;;", p.Account))
+		lines := cs.flattenLines(p.Account)
+		if len(lines) == 0 {
+			return fmt.Errorf("no instruments known for account %s: no snapshot or order since start", p.Account)
+		}
+		return cs.writeOIF(cmd.ID, lines...)
 	case "close_position":
 		var p ClosePositionPayload
 		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
 			return fmt.Errorf("failed to unmarshal close_position payload: %w", err)
 		}
-		return cs.writeOIF(fmt.Sprintf("CLOSEPOSITION;ACCOUNT=%s;INSTRUMENT=%s;;;;;;;;;;", p.Account, p.Instrument))
+		return cs.writeOIF(cmd.ID, OIFLine{Command: "CLOSEPOSITION", Account: p.Account, Instrument: p.Instrument})
 	case "cancel_order":
 		var p CancelOrderPayload
 		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
 			return fmt.Errorf("failed to unmarshal cancel_order payload: %w", err)
 		}
-		return cs.writeOIF(fmt.Sprintf("CANCEL;ACCOUNT=%s;ORDERID=%s;;;;;;;;;;", p.Account, p.OrderId))
+		return cs.writeOIF(cmd.ID, cancelOrderLine(p.Account, p.OrderId))
+	case "cancel_all_orders":
+		var p CancelAllOrdersPayload
+		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
+			return fmt.Errorf("failed to unmarshal cancel_all_orders payload: %w", err)
+		}
+		snap, ok := cs.snapshot(p.Account)
+		if !ok {
+			return fmt.Errorf("no snapshot for account %s", p.Account)
+		}
+		// OIF CANCELALLORDERS is global across accounts, so cancel the
+		// account's working orders one by one instead.
+		var lines []OIFLine
+		for _, o := range snap.WorkingOrders {
+			if p.Instrument == "" || o.Instrument == p.Instrument {
+				lines = append(lines, cancelOrderLine(p.Account, o.OrderId))
+			}
+		}
+		if len(lines) == 0 {
+			// Nothing to cancel is already the requested state; a macro or
+			// schedule that starts by cancelling must carry on.
+			log.Printf("No working orders to cancel for account %s", p.Account)
+			return nil
+		}
+		return cs.writeOIF(cmd.ID, lines...)
+	case "reverse_position":
+		var p ClosePositionPayload
+		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
+			return fmt.Errorf("failed to unmarshal reverse_position payload: %w", err)
+		}
+		pos, ok := cs.position(p.Account, p.Instrument)
+		if !ok {
+			return fmt.Errorf("no open position in %s for account %s", p.Instrument, p.Account)
+		}
+		action := "SELL"
+		if pos.MarketPosition == "Short" {
+			action = "BUY"
+		}
+		return cs.writeOIF(cmd.ID, OIFLine{
+			Command:    "REVERSEPOSITION",
+			Account:    p.Account,
+			Instrument: p.Instrument,
+			Action:     action,
+			Quantity:   pos.Quantity,
+			OrderType:  "MARKET",
+			TIF:        "DAY",
+		})
+	case "breakeven":
+		var p BreakevenPayload
+		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
+			return fmt.Errorf("failed to unmarshal breakeven payload: %w", err)
+		}
+		changes, err := cs.breakevenChanges(p)
+		if err != nil {
+			return err
+		}
+		var lines []OIFLine
+		for _, c := range changes {
+			lines = append(lines, c.oifLine())
+		}
+		return cs.writeOIF(cmd.ID, lines...)
+	case "nudge_order":
+		var p NudgeOrderPayload
+		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
+			return fmt.Errorf("failed to unmarshal nudge_order payload: %w", err)
+		}
+		change, err := cs.nudgeChange(p)
+		if err != nil {
+			return err
+		}
+		return cs.writeOIF(cmd.ID, change.oifLine())
+	case "arm_trail":
+		var p ArmTrailPayload
+		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
+			return fmt.Errorf("failed to unmarshal arm_trail payload: %w", err)
+		}
+		return cs.armTrail(p)
+	case "disarm_trail":
+		var p ClosePositionPayload
+		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
+			return fmt.Errorf("failed to unmarshal disarm_trail payload: %w", err)
+		}
+		return cs.disarmTrail(p.Account, p.Instrument, "disarmed")
+	case "place_order", "place_atm_order":
+		var p PlaceOrderPayload
+		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
+			return fmt.Errorf("failed to unmarshal %s payload: %w", cmd.Type, err)
+		}
+		// ATM strategies are started only through place_atm_order, whose
+		// strategy id the dashboard assigns so that it can track them.
+		if cmd.Type == "place_order" && (p.Strategy != "" || p.StrategyId != "") {
+			return fmt.Errorf("invalid place_order payload: ATM strategies are placed with place_atm_order")
+		}
+		if cmd.Type == "place_atm_order" && (p.Strategy == "" || p.StrategyId == "") {
+			return fmt.Errorf("invalid place_atm_order payload: ATM strategy template and strategyId are required")
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("invalid %s payload: %w", cmd.Type, err)
+		}
+		if err := cs.checkOrderLimits(cmd.Type, p, restingOrders(p)); err != nil {
+			return err
+		}
+		if p.OrderId == "" {
+			p.OrderId = cmd.ID
+		}
+		return cs.writeOIF(cmd.ID, p.oifLine())
+	case "close_strategy":
+		var p CloseStrategyPayload
+		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
+			return fmt.Errorf("failed to unmarshal close_strategy payload: %w", err)
+		}
+		if p.StrategyId == "" {
+			return fmt.Errorf("invalid close_strategy payload: strategyId is required")
+		}
+		return cs.writeOIF(cmd.ID, OIFLine{Command: "CLOSESTRATEGY", Account: p.Account, StrategyId: p.StrategyId})
+	case "change_order":
+		var p ChangeOrderPayload
+		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
+			return fmt.Errorf("failed to unmarshal change_order payload: %w", err)
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("invalid change_order payload: %w", err)
+		}
+		if p.Quantity > 0 {
+			// Only the order size applies; the order is already working.
+			if o, ok := cs.workingOrder(p.Account, p.OrderId); ok {
+				if err := cs.checkOrderLimits(cmd.Type, PlaceOrderPayload{Account: p.Account, Instrument: o.Instrument, Quantity: p.Quantity}, 0); err != nil {
+					return err
+				}
+			}
+		}
+		return cs.writeOIF(cmd.ID, p.oifLine())
+	case "place_bracket":
+		var p PlaceBracketPayload
+		if err := json.Unmarshal(cmd.Payload, &p); err != nil {
+			return fmt.Errorf("failed to unmarshal place_bracket payload: %w", err)
+		}
+		if p.OcoId == "" {
+			p.OcoId = newID("bracket")
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("invalid place_bracket payload: %w", err)
+		}
+		resting := 0
+		for _, order := range p.orders() {
+			resting += restingOrders(order)
+		}
+		if err := cs.checkOrderLimits(cmd.Type, p.entry(), resting); err != nil {
+			return err
+		}
+		orders := p.orders()
+		if cs.simulated {
+			// Nothing reaches NinjaTrader, so no fill will ever be
+			// reported; show the whole bracket at once.
+			var lines []OIFLine
+			for _, order := range orders {
+				lines = append(lines, order.oifLine())
+			}
+			return cs.writeOIF(cmd.ID, lines...)
+		}
+		// Exits resting while the account is flat could fill on their
+		// own and open a naked position, so hold them until the entry's
+		// fill is read from the outgoing folder, or shows in a snapshot.
+		entry := orders[0]
+		start := 0
+		if snap, ok := cs.snapshot(p.Account); ok {
+			start = positionQuantity(snap, p.Instrument)
+		}
+		cs.oifMu.Lock()
+		if !cs.outgoingReadable {
+			cs.oifMu.Unlock()
+			return fmt.Errorf("NinjaTrader outgoing folder %s is not being read, so the entry's fill would not be seen: place the bracket's orders separately", cs.outgoingDir)
+		}
+		cs.brackets[entry.OrderId] = &pendingBracket{commandID: cmd.ID, payload: p, startPosition: start, createdAt: time.Now()}
+		cs.oifMu.Unlock()
+		if err := cs.writeOIF(cmd.ID, entry.oifLine()); err != nil {
+			cs.oifMu.Lock()
+			delete(cs.brackets, entry.OrderId)
+			cs.oifMu.Unlock()
+			return err
+		}
+		log.Printf("Bracket %s: stop and target wait for entry %s to fill", p.OcoId, entry.OrderId)
+		return nil
 	default:
 		return fmt.Errorf("unknown command type: %s", cmd.Type)
 	}
 }
 
-func (cs *ConnectionServer) writeOIF(line string) error {
-	filename := fmt.Sprintf("oif_%d_%d.txt", time.Now().UnixNano(), rand.Intn(10000))
-	path := filepath.Join(cs.incomingDir, filename)
-	return os.WriteFile(path, []byte(line+"\r\n"), 0644)
+func (cs *ConnectionServer) tickSize(instrument string) (float64, error) {
+	if size, ok := cs.tickSizes[instrumentRoot(instrument)]; ok {
+		return size, nil
+	}
+	return 0, fmt.Errorf("unknown tick size for %s: add it to TICK_SIZES", instrument)
+}
+
+// stopOrders returns the working stop orders protecting pos: the orders
+// NinjaTrader flags as stop losses, or failing that any stop order on the
+// closing side of the position.
+func stopOrders(snap Snapshot, pos Position) []WorkingOrder {
+	closingAction := "Sell"
+	if pos.MarketPosition == "Short" {
+		closingAction = "Buy"
+	}
+	var flagged, others []WorkingOrder
+	for _, o := range snap.WorkingOrders {
+		if o.Instrument != pos.Instrument {
+			continue
+		}
+		if o.IsStopLoss {
+			flagged = append(flagged, o)
+		} else if strings.Contains(o.OrderType, "Stop") && strings.HasPrefix(o.OrderAction, closingAction) {
+			others = append(others, o)
+		}
+	}
+	if len(flagged) > 0 {
+		return flagged
+	}
+	return others
+}
+
+// breakevenChanges composes the CHANGE commands that move every stop of the
+// position to its average price plus the offset.
+func (cs *ConnectionServer) breakevenChanges(p BreakevenPayload) ([]ChangeOrderPayload, error) {
+	pos, ok := cs.position(p.Account, p.Instrument)
+	if !ok {
+		return nil, fmt.Errorf("no open position in %s for account %s", p.Instrument, p.Account)
+	}
+	tick, err := cs.tickSize(p.Instrument)
+	if err != nil {
+		return nil, err
+	}
+	snap, _ := cs.snapshot(p.Account)
+	stops := stopOrders(snap, pos)
+	if len(stops) == 0 {
+		return nil, fmt.Errorf("no stop loss found for %s in account %s", p.Instrument, p.Account)
+	}
+
+	long := pos.MarketPosition == "Long"
+	stopPrice := pos.AveragePrice + float64(p.OffsetTicks)*tick
+	if !long {
+		stopPrice = pos.AveragePrice - float64(p.OffsetTicks)*tick
+	}
+	stopPrice = roundToTick(stopPrice, tick)
+	if pos.CurrentPrice > 0 && (long && stopPrice >= pos.CurrentPrice || !long && stopPrice <= pos.CurrentPrice) {
+		return nil, fmt.Errorf("breakeven stop %s would be through the market at %s",
+			formatPrice(stopPrice), formatPrice(pos.CurrentPrice))
+	}
+
+	var changes []ChangeOrderPayload
+	for _, o := range stops {
+		changes = append(changes, ChangeOrderPayload{Account: p.Account, OrderId: o.OrderId, StopPrice: stopPrice})
+	}
+	return changes, nil
+}
+
+// nudgeChange composes the CHANGE command that moves an order's stop and/or
+// limit price by the given number of ticks.
+func (cs *ConnectionServer) nudgeChange(p NudgeOrderPayload) (ChangeOrderPayload, error) {
+	if p.Ticks == 0 {
+		return ChangeOrderPayload{}, fmt.Errorf("ticks must not be zero")
+	}
+	snap, ok := cs.snapshot(p.Account)
+	if !ok {
+		return ChangeOrderPayload{}, fmt.Errorf("no snapshot for account %s", p.Account)
+	}
+	for _, o := range snap.WorkingOrders {
+		if o.OrderId != p.OrderId {
+			continue
+		}
+		tick, err := cs.tickSize(o.Instrument)
+		if err != nil {
+			return ChangeOrderPayload{}, err
+		}
+		delta := float64(p.Ticks) * tick
+		change := ChangeOrderPayload{Account: p.Account, OrderId: o.OrderId}
+		if o.StopPrice > 0 {
+			change.StopPrice = roundToTick(o.StopPrice+delta, tick)
+		}
+		if o.LimitPrice > 0 {
+			change.LimitPrice = roundToTick(o.LimitPrice+delta, tick)
+		}
+		if err := change.validate(); err != nil {
+			return ChangeOrderPayload{}, fmt.Errorf("cannot nudge order %s: %w", o.OrderId, err)
+		}
+		return change, nil
+	}
+	return ChangeOrderPayload{}, fmt.Errorf("working order %s not found in account %s", p.OrderId, p.Account)
+}
+
+func cancelOrderLine(account, orderId string) OIFLine {
+	return OIFLine{Command: "CANCEL", Account: account, OrderId: orderId}
+}
+
+func (cs *ConnectionServer) snapshot(account string) (Snapshot, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	snap, ok := cs.latest[account]
+	return snap, ok
+}
+
+// position returns the open position in instrument for account according to
+// the latest snapshot.
+func (cs *ConnectionServer) position(account, instrument string) (Position, bool) {
+	snap, ok := cs.snapshot(account)
+	if !ok {
+		return Position{}, false
+	}
+	for _, pos := range snap.Positions {
+		if pos.Instrument == instrument && pos.MarketPosition != "Flat" && pos.Quantity > 0 {
+			return pos, true
+		}
+	}
+	return Position{}, false
+}
+
+func (cs *ConnectionServer) workingOrder(account, orderId string) (WorkingOrder, bool) {
+	snap, ok := cs.snapshot(account)
+	if !ok {
+		return WorkingOrder{}, false
+	}
+	for _, o := range snap.WorkingOrders {
+		if o.OrderId == orderId {
+			return o, true
+		}
+	}
+	return WorkingOrder{}, false
+}
+
+// writeOIF hands the lines of a command to the configured executor.
+// commandID is the command to fail if NinjaTrader does not consume the
+// files, or empty for engine-issued changes.
+// newID returns a unique id with the given prefix for commands and orders
+// the connection server issues itself. The random part keeps ids made in
+// the same nanosecond apart, since they share the executed-command set with
+// the dashboard's.
+func newID(prefix string) string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return fmt.Sprintf("%s_%d_%x", prefix, time.Now().UnixNano(), b)
+}
+
+func (cs *ConnectionServer) writeOIF(commandID string, lines ...OIFLine) error {
+	return cs.executor.Execute(commandID, lines)
+}
+
+// flattenLines closes every instrument the account is known to trade and
+// cancels its working orders. OIF FLATTENEVERYTHING is global across
+// accounts, so it cannot flatten just one. Instruments come from the last
+// snapshot and from the orders issued since start; CLOSEPOSITION also
+// cancels the instrument's working orders, which covers orders placed after
+// the last snapshot, and is harmless on an instrument that is already flat.
+func (cs *ConnectionServer) flattenLines(account string) []OIFLine {
+	instruments := make(map[string]bool)
+	snap, ok := cs.snapshot(account)
+	if ok {
+		for _, pos := range snap.Positions {
+			instruments[pos.Instrument] = true
+		}
+		for _, o := range snap.WorkingOrders {
+			instruments[o.Instrument] = true
+		}
+	}
+	cs.oifMu.Lock()
+	for _, order := range cs.issuedOrders {
+		if order.account == account && order.instrument != "" {
+			instruments[order.instrument] = true
+		}
+	}
+	cs.oifMu.Unlock()
+
+	names := make([]string, 0, len(instruments))
+	for instrument := range instruments {
+		names = append(names, instrument)
+	}
+	sort.Strings(names)
+	var lines []OIFLine
+	for _, instrument := range names {
+		lines = append(lines, OIFLine{Command: "CLOSEPOSITION", Account: account, Instrument: instrument})
+	}
+	if ok {
+		for _, o := range snap.WorkingOrders {
+			lines = append(lines, cancelOrderLine(account, o.OrderId))
+		}
+	}
+	return lines
+}
+
+// trackOIF records a file written by the OIF executor until NinjaTrader
+// consumes it, and the order it places so that outgoing order updates can
+// be attributed to the command.
+func (cs *ConnectionServer) trackOIF(commandID, path string, line OIFLine, text string) {
+	cs.oifMu.Lock()
+	defer cs.oifMu.Unlock()
+	cs.pendingOIF[path] = pendingOIF{commandID: commandID, line: text, writtenAt: time.Now()}
+	if line.OrderId != "" && commandID != "" {
+		cs.issuedOrders[line.OrderId] = issuedOrder{commandID: commandID, account: line.Account, instrument: line.Instrument, issuedAt: time.Now()}
+	}
+}
+
+// watchOIFConsumption fails commands whose OIF files NinjaTrader has not
+// deleted within the consume timeout, and periodically scans the incoming
+// folder for stale files that nobody is processing.
+func (cs *ConnectionServer) watchOIFConsumption() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastScan := time.Now()
+	for range ticker.C {
+		cs.checkPendingOIF()
+		if time.Since(lastScan) >= cs.staleScanInterval {
+			cs.scanStaleOIF()
+			lastScan = time.Now()
+		}
+	}
+}
+
+func (cs *ConnectionServer) checkPendingOIF() {
+	unconsumed := make(map[string][]string)
+	cs.oifMu.Lock()
+	for path, f := range cs.pendingOIF {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(cs.pendingOIF, path)
+			continue
+		}
+		if time.Since(f.writtenAt) > cs.consumeTimeout {
+			delete(cs.pendingOIF, path)
+			unconsumed[f.commandID] = append(unconsumed[f.commandID], filepath.Base(path))
+		}
+	}
+	cs.oifMu.Unlock()
+
+	for commandID, files := range unconsumed {
+		reason := fmt.Sprintf("NinjaTrader did not consume %d OIF file(s) within %v (%s); is ATI enabled?",
+			len(files), cs.consumeTimeout, strings.Join(files, ", "))
+		log.Printf("Command %s: %s", commandID, reason)
+		if commandID == "" {
+			cs.sendAlert("error", "oif", "", reason)
+			continue
+		}
+		ack := map[string]interface{}{
+			"type":  "command_ack",
+			"id":    commandID,
+			"stage": "consumption",
+			"error": reason,
+		}
+		data, _ := json.Marshal(ack)
+		cs.sendToCloud(data)
+	}
+}
+
+// scanStaleOIF alerts the dashboard when files accumulate in the incoming
+// folder, whoever wrote them. It re-alerts only when the count changes or
+// the condition persists for another alert interval.
+func (cs *ConnectionServer) scanStaleOIF() {
+	entries, err := os.ReadDir(cs.incomingDir)
+	if err != nil {
+		return
+	}
+	stale := 0
+	var oldest time.Time
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < cs.consumeTimeout {
+			continue
+		}
+		stale++
+		if oldest.IsZero() || info.ModTime().Before(oldest) {
+			oldest = info.ModTime()
+		}
+	}
+
+	if stale == 0 {
+		if cs.staleCount > 0 {
+			cs.sendAlert("info", "oif", "", "Incoming folder is clear again; NinjaTrader is consuming OIF files")
+		}
+		cs.staleCount = 0
+		return
+	}
+	if stale == cs.staleCount && time.Since(cs.staleAlertAt) < 5*time.Minute {
+		return
+	}
+	cs.staleCount = stale
+	cs.staleAlertAt = time.Now()
+	cs.sendAlert("error", "oif", "", fmt.Sprintf("%d unprocessed OIF file(s) in %s, oldest %v old; NinjaTrader ATI may be disabled or frozen",
+		stale, cs.incomingDir, time.Since(oldest).Round(time.Second)))
+}
+
+// watchOutgoing polls NinjaTrader's outgoing folder, where ATI keeps one
+// file per order ("<order id>.txt": STATE;FILLED;AVG FILL PRICE) and per
+// position ("<instrument> <exchange>_<account>_position.txt":
+// MARKET POSITION;QUANTITY;AVG PRICE), and forwards every change.
+func (cs *ConnectionServer) watchOutgoing() {
+	if _, err := os.Stat(cs.outgoingDir); os.IsNotExist(err) {
+		log.Printf("Warning: NinjaTrader outgoing folder does not exist at %s", cs.outgoingDir)
+	}
+
+	// Files present at startup describe the past; only forward later changes.
+	cs.scanOutgoing(false)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		cs.scanOutgoing(true)
+		cs.pruneIssuedOrders()
+		cs.checkPendingBrackets()
+	}
+}
+
+func (cs *ConnectionServer) scanOutgoing(forward bool) {
+	entries, err := os.ReadDir(cs.outgoingDir)
+	cs.oifMu.Lock()
+	wasReadable := cs.outgoingReadable
+	cs.outgoingReadable = err == nil
+	cs.oifMu.Unlock()
+	if err != nil {
+		if wasReadable {
+			log.Printf("Cannot read NinjaTrader outgoing folder: %v", err)
+			cs.sendAlert("error", "oif", "", fmt.Sprintf("Cannot read NinjaTrader outgoing folder: %v; brackets are refused until it is back", err))
+		}
+		return
+	}
+	if !wasReadable {
+		log.Printf("Reading NinjaTrader outgoing folder %s", cs.outgoingDir)
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(strings.ToLower(e.Name()), ".txt") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		prev, seen := cs.outgoingFiles[e.Name()]
+		if seen && info.ModTime().Equal(prev.modTime) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(cs.outgoingDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		content := strings.TrimSpace(string(data))
+		cs.outgoingFiles[e.Name()] = outgoingFile{modTime: info.ModTime(), content: content}
+		if !forward || content == "" || seen && content == prev.content {
+			continue
+		}
+		cs.forwardOutgoing(strings.TrimSuffix(e.Name(), filepath.Ext(e.Name())), content)
+	}
+}
+
+func (cs *ConnectionServer) forwardOutgoing(name, content string) {
+	fields := strings.Split(content, ";")
+	if len(fields) < 3 {
+		// Connection state files hold a single CONNECTED/DISCONNECTED token
+		return
+	}
+	filled, _ := strconv.Atoi(fields[1])
+	price, _ := strconv.ParseFloat(fields[2], 64)
+
+	var msg map[string]interface{}
+	if strings.HasSuffix(name, "_position") {
+		base := strings.TrimSuffix(name, "_position")
+		i := strings.LastIndex(base, "_")
+		if i < 0 {
+			return
+		}
+		msg = map[string]interface{}{
+			"type": "position_state",
+			"data": map[string]interface{}{
+				"account":        base[i+1:],
+				"instrument":     base[:i],
+				"marketPosition": fields[0],
+				"quantity":       filled,
+				"averagePrice":   price,
+				"time":           time.Now(),
+			},
+		}
+		log.Printf("ATI position %s %s: %s", base[i+1:], base[:i], content)
+	} else {
+		orderId, order := cs.lookupIssuedOrder(name)
+		msg = map[string]interface{}{
+			"type": "order_state",
+			"data": map[string]interface{}{
+				"account":          order.account,
+				"orderId":          orderId,
+				"state":            fields[0],
+				"filled":           filled,
+				"averageFillPrice": price,
+				"commandId":        order.commandID,
+				"time":             time.Now(),
+			},
+		}
+		log.Printf("ATI order %s: %s", orderId, content)
+		if strings.EqualFold(fields[0], "REJECTED") {
+			cs.sendAlert("error", "order", order.account, fmt.Sprintf("Order %s was rejected by NinjaTrader", orderId))
+		}
+		cs.updateBracket(orderId, fields[0], filled)
+		cs.updateProtectiveStop(orderId, fields[0])
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("JSON Marshal error: %v", err)
+		return
+	}
+	cs.sendToCloud(data)
+}
+
+// lookupIssuedOrder correlates an outgoing order file with the command that
+// issued the order. Depending on the NinjaTrader version the file is named
+// after the order id alone or prefixed with the account.
+func (cs *ConnectionServer) lookupIssuedOrder(name string) (string, issuedOrder) {
+	cs.oifMu.Lock()
+	defer cs.oifMu.Unlock()
+	if order, ok := cs.issuedOrders[name]; ok {
+		return name, order
+	}
+	for orderId, order := range cs.issuedOrders {
+		if strings.HasSuffix(name, "_"+orderId) {
+			return orderId, order
+		}
+	}
+	return name, issuedOrder{}
+}
+
+func (cs *ConnectionServer) pruneIssuedOrders() {
+	cs.oifMu.Lock()
+	defer cs.oifMu.Unlock()
+	for orderId, order := range cs.issuedOrders {
+		if time.Since(order.issuedAt) > 24*time.Hour {
+			delete(cs.issuedOrders, orderId)
+		}
+	}
+	for orderId, b := range cs.brackets {
+		if time.Since(b.createdAt) > 24*time.Hour {
+			delete(cs.brackets, orderId)
+		}
+	}
+}
+
+// updateBracket places the stop and target of a bracket once its entry
+// order has filled, sized to the filled quantity and resized as a partial
+// fill grows. An entry that is rejected or cancelled unfilled drops them.
+func (cs *ConnectionServer) updateBracket(orderId, state string, filled int) {
+	state = strings.ToUpper(state)
+	cs.oifMu.Lock()
+	b, ok := cs.brackets[orderId]
+	if !ok {
+		cs.oifMu.Unlock()
+		return
+	}
+	b.reported = true
+	if state == "FILLED" && filled == 0 {
+		filled = b.payload.Quantity
+	}
+	done := state == "FILLED" || state == "REJECTED" || state == "CANCELLED" || state == "CANCELED"
+	if done {
+		delete(cs.brackets, orderId)
+	}
+	placed := b.placed
+	if filled > placed {
+		b.placed = filled
+	}
+	cs.oifMu.Unlock()
+
+	if done && filled == 0 {
+		msg := fmt.Sprintf("Bracket entry %s was %s; its stop and target were not placed", orderId, strings.ToLower(state))
+		log.Printf("%s", msg)
+		cs.sendAlert("warning", "order", b.payload.Account, msg)
+		return
+	}
+	cs.placeBracketExits(orderId, b, placed, filled)
+}
+
+// checkBrackets places the exits of pending brackets whose entry fill
+// shows in the account's position before, or instead of, being read from
+// the outgoing folder.
+func (cs *ConnectionServer) checkBrackets(snap Snapshot) {
+	type fill struct {
+		orderId        string
+		b              *pendingBracket
+		placed, filled int
+	}
+	var fills []fill
+	cs.oifMu.Lock()
+	for orderId, b := range cs.brackets {
+		p := b.payload
+		if p.Account != snap.Account {
+			continue
+		}
+		filled := positionQuantity(snap, p.Instrument) - b.startPosition
+		if p.Action == "SELL" {
+			filled = -filled
+		}
+		if filled > p.Quantity {
+			filled = p.Quantity
+		}
+		if filled <= b.placed {
+			continue
+		}
+		fills = append(fills, fill{orderId, b, b.placed, filled})
+		b.placed = filled
+		if filled == p.Quantity {
+			delete(cs.brackets, orderId)
+		}
+	}
+	cs.oifMu.Unlock()
+
+	for _, f := range fills {
+		log.Printf("Bracket %s: position shows entry %s filled %d", f.b.payload.OcoId, f.orderId, f.filled)
+		cs.placeBracketExits(f.orderId, f.b, f.placed, f.filled)
+	}
+}
+
+// placeBracketExits places the stop and target of a bracket for the filled
+// quantity of its entry, or resizes them from placed.
+func (cs *ConnectionServer) placeBracketExits(orderId string, b *pendingBracket, placed, filled int) {
+	if filled <= placed {
+		return
+	}
+	p := b.payload
+	var lines []OIFLine
+	for _, exit := range p.orders()[1:] {
+		if placed == 0 {
+			exit.Quantity = filled
+			lines = append(lines, exit.oifLine())
+		} else {
+			lines = append(lines, (&ChangeOrderPayload{Account: p.Account, OrderId: exit.OrderId, Quantity: filled}).oifLine())
+		}
+	}
+	if err := cs.writeOIF(b.commandID, lines...); err != nil {
+		log.Printf("Placing exits of bracket %s failed: %v", p.OcoId, err)
+		cs.sendAlert("error", "order", p.Account, fmt.Sprintf("Entry %s filled %d but its stop and target could not be placed: %v", orderId, filled, err))
+		return
+	}
+	log.Printf("Bracket %s: entry filled %d, stop and target placed for %d", p.OcoId, filled, filled)
+}
+
+// checkPendingBrackets alerts once on each bracket whose entry has not
+// filled within bracketPendingAlert, so that an entry whose fill was
+// missed does not leave a position without its stop.
+func (cs *ConnectionServer) checkPendingBrackets() {
+	var msgs []string
+	var accounts []string
+	cs.oifMu.Lock()
+	for orderId, b := range cs.brackets {
+		age := time.Since(b.createdAt)
+		if b.placed > 0 || b.alerted || age < bracketPendingAlert {
+			continue
+		}
+		b.alerted = true
+		msg := fmt.Sprintf("Bracket entry %s has not filled after %v; its stop and target are held until it does", orderId, age.Round(time.Second))
+		if !b.reported {
+			msg += fmt.Sprintf(". No state was reported for it in %s", cs.outgoingDir)
+		}
+		msgs = append(msgs, msg)
+		accounts = append(accounts, b.payload.Account)
+	}
+	cs.oifMu.Unlock()
+
+	for i, msg := range msgs {
+		log.Printf("%s", msg)
+		cs.sendAlert("warning", "order", accounts[i], msg)
+	}
+}
+
+// sendAlert raises an operator-facing alert on the dashboard.
+func (cs *ConnectionServer) sendAlert(level, source, account, message string) {
+	data, err := json.Marshal(map[string]interface{}{
+		"type": "alert",
+		"data": map[string]interface{}{
+			"level":   level,
+			"source":  source,
+			"account": account,
+			"message": message,
+			"time":    time.Now(),
+		},
+	})
+	if err != nil {
+		log.Printf("JSON Marshal error: %v", err)
+		return
+	}
+	cs.sendToCloud(data)
+}
+
+func (cs *ConnectionServer) trailsPath() string {
+	return filepath.Join(cs.stateDir, "trails.json")
+}
+
+func (cs *ConnectionServer) loadTrails() {
+	var trails []*Trail
+	if err := readJSONFile(cs.trailsPath(), &trails); err != nil {
+		log.Printf("Failed to load trailing stops: %v", err)
+		return
+	}
+	cs.trailsMu.Lock()
+	for _, t := range trails {
+		cs.trails[trailKey(t.Account, t.Instrument)] = t
+	}
+	cs.trailsMu.Unlock()
+	if len(trails) > 0 {
+		log.Printf("Restored %d armed trailing stop(s)", len(trails))
+	}
+}
+
+// saveTrailsLocked persists the armed trails. trailsMu must be held.
+func (cs *ConnectionServer) saveTrailsLocked() {
+	trails := make([]*Trail, 0, len(cs.trails))
+	for _, t := range cs.trails {
+		trails = append(trails, t)
+	}
+	if err := writeJSONFile(cs.trailsPath(), trails); err != nil {
+		log.Printf("Failed to save trailing stops: %v", err)
+	}
+}
+
+func (cs *ConnectionServer) trailStateMessage() ([]byte, error) {
+	cs.trailsMu.Lock()
+	trails := make([]Trail, 0, len(cs.trails))
+	for _, t := range cs.trails {
+		trails = append(trails, *t)
+	}
+	cs.trailsMu.Unlock()
+	return json.Marshal(map[string]interface{}{
+		"type": "trail_state",
+		"data": trails,
+	})
+}
+
+func (cs *ConnectionServer) reportTrails() {
+	data, err := cs.trailStateMessage()
+	if err != nil {
+		log.Printf("JSON Marshal error: %v", err)
+		return
+	}
+	cs.sendToCloud(data)
+}
+
+func (cs *ConnectionServer) armTrail(p ArmTrailPayload) error {
+	p.Mode = strings.ToLower(strings.TrimSpace(p.Mode))
+	if p.Mode == "" {
+		p.Mode = "ticks"
+	}
+	if p.Mode != "ticks" && p.Mode != "percent" {
+		return fmt.Errorf("invalid trail mode %q: must be ticks or percent", p.Mode)
+	}
+	if p.Distance <= 0 {
+		return fmt.Errorf("trail distance must be positive")
+	}
+	if p.StepTicks <= 0 {
+		p.StepTicks = 1
+	}
+	pos, ok := cs.position(p.Account, p.Instrument)
+	if !ok {
+		return fmt.Errorf("no open position in %s for account %s", p.Instrument, p.Account)
+	}
+	if _, err := cs.tickSize(p.Instrument); err != nil {
+		return err
+	}
+
+	t := &Trail{
+		Account:    p.Account,
+		Instrument: p.Instrument,
+		Mode:       p.Mode,
+		Distance:   p.Distance,
+		StepTicks:  p.StepTicks,
+		ArmedAt:    time.Now(),
+		BestPrice:  pos.CurrentPrice,
+		Status:     "armed",
+	}
+	if t.BestPrice == 0 {
+		t.BestPrice = pos.AveragePrice
+	}
+
+	cs.trailsMu.Lock()
+	cs.trails[trailKey(p.Account, p.Instrument)] = t
+	cs.saveTrailsLocked()
+	cs.trailsMu.Unlock()
+
+	log.Printf("Trailing stop armed for %s %s: %v %s, step %d ticks", p.Account, p.Instrument, p.Distance, p.Mode, p.StepTicks)
+	if snap, ok := cs.snapshot(p.Account); ok {
+		cs.updateTrails(snap)
+	}
+	cs.reportTrails()
+	return nil
+}
+
+func (cs *ConnectionServer) disarmTrail(account, instrument, reason string) error {
+	cs.trailsMu.Lock()
+	key := trailKey(account, instrument)
+	if _, ok := cs.trails[key]; !ok {
+		cs.trailsMu.Unlock()
+		return fmt.Errorf("no trailing stop armed for %s in account %s", instrument, account)
+	}
+	delete(cs.trails, key)
+	cs.saveTrailsLocked()
+	cs.trailsMu.Unlock()
+
+	log.Printf("Trailing stop for %s %s %s", account, instrument, reason)
+	cs.reportTrails()
+	return nil
+}
+
+// updateTrails ratchets the stops of every trail armed on the snapshot's
+// account. It only ever moves a stop in the position's favor and only when
+// the improvement is at least the trail's step, to avoid spamming
+// NinjaTrader with CHANGE commands.
+func (cs *ConnectionServer) updateTrails(snap Snapshot) {
+	cs.trailsMu.Lock()
+	changed := false
+	var closed []string
+	for _, t := range cs.trails {
+		if t.Account != snap.Account {
+			continue
+		}
+		var pos *Position
+		for i := range snap.Positions {
+			p := &snap.Positions[i]
+			if p.Instrument == t.Instrument && p.MarketPosition != "Flat" && p.Quantity > 0 {
+				pos = p
+			}
+		}
+		if pos == nil {
+			closed = append(closed, t.Instrument)
+			continue
+		}
+		if cs.ratchetTrail(t, snap, *pos) {
+			changed = true
+		}
+	}
+	if changed {
+		cs.saveTrailsLocked()
+	}
+	cs.trailsMu.Unlock()
+
+	for _, instrument := range closed {
+		cs.disarmTrail(snap.Account, instrument, "disarmed: position closed")
+	}
+	if changed {
+		cs.reportTrails()
+	}
+}
+
+// ratchetTrail advances a single trail and reports whether its state changed.
+// trailsMu must be held.
+func (cs *ConnectionServer) ratchetTrail(t *Trail, snap Snapshot, pos Position) bool {
+	tick, err := cs.tickSize(t.Instrument)
+	if err != nil || pos.CurrentPrice <= 0 {
+		return false
+	}
+	long := pos.MarketPosition == "Long"
+	changed := false
+
+	if long && pos.CurrentPrice > t.BestPrice || !long && (t.BestPrice == 0 || pos.CurrentPrice < t.BestPrice) {
+		t.BestPrice = pos.CurrentPrice
+		changed = true
+	}
+
+	stops := stopOrders(snap, pos)
+	if len(stops) == 0 {
+		if t.Status != "no stop" {
+			t.Status = "no stop"
+			changed = true
+		}
+		return changed
+	}
+	if t.Status == "no stop" {
+		t.Status = "armed"
+		changed = true
+	}
+
+	distance := t.Distance * tick
+	if t.Mode == "percent" {
+		distance = t.BestPrice * t.Distance / 100
+	}
+	var desired float64
+	if long {
+		desired = math.Floor((t.BestPrice-distance)/tick) * tick
+	} else {
+		desired = math.Ceil((t.BestPrice+distance)/tick) * tick
+	}
+	desired = roundToTick(desired, tick)
+
+	// The stop we last set may not be reflected in the snapshot yet, so
+	// compare against whichever is more favorable.
+	current := t.StopPrice
+	for _, o := range stops {
+		if current == 0 || long && o.StopPrice > current || !long && o.StopPrice < current {
+			current = o.StopPrice
+		}
+	}
+	step := float64(t.StepTicks) * tick
+	improves := long && desired >= current+step-tick/2 || !long && desired <= current-step+tick/2
+	throughMarket := long && desired >= pos.CurrentPrice || !long && desired <= pos.CurrentPrice
+	if !improves || throughMarket {
+		if t.StopPrice != current {
+			t.StopPrice = current
+			changed = true
+		}
+		return changed
+	}
+
+	var lines []OIFLine
+	for _, o := range stops {
+		lines = append(lines, (&ChangeOrderPayload{Account: t.Account, OrderId: o.OrderId, StopPrice: desired}).oifLine())
+	}
+	if err := cs.writeOIF("", lines...); err != nil {
+		log.Printf("Trailing stop update failed for %s %s: %v", t.Account, t.Instrument, err)
+		t.Status = "error: " + err.Error()
+		return true
+	}
+	log.Printf("Trailing stop for %s %s moved from %s to %s", t.Account, t.Instrument, formatPrice(current), formatPrice(desired))
+	t.StopPrice = desired
+	t.LastMoved = time.Now()
+	t.Status = "trailing"
+	return true
+}
+
+func (cs *ConnectionServer) riskPath() string {
+	return filepath.Join(cs.stateDir, "risk.json")
+}
+
+func (cs *ConnectionServer) loadRiskStates() {
+	var states []*RiskState
+	if err := readJSONFile(cs.riskPath(), &states); err != nil {
+		log.Printf("Failed to load risk state: %v", err)
+		return
+	}
+	day, _ := cs.risk.tradingDay(time.Now())
+	cs.riskMu.Lock()
+	for _, st := range states {
+		if st.TradingDay != day {
+			continue
+		}
+		cs.riskStates[st.Account] = st
+		if st.Breached {
+			log.Printf("Account %s is locked out until %s after breaching its daily loss limit", st.Account, st.LockedUntil.Format(time.RFC3339))
+		}
+	}
+	cs.riskMu.Unlock()
+}
+
+// saveRiskStatesLocked persists the risk states. riskMu must be held.
+func (cs *ConnectionServer) saveRiskStatesLocked() {
+	states := make([]*RiskState, 0, len(cs.riskStates))
+	for _, st := range cs.riskStates {
+		states = append(states, st)
+	}
+	if err := writeJSONFile(cs.riskPath(), states); err != nil {
+		log.Printf("Failed to save risk state: %v", err)
+	}
+}
+
+func (cs *ConnectionServer) riskStateMessage() ([]byte, error) {
+	cs.riskMu.Lock()
+	states := make([]RiskState, 0, len(cs.riskStates))
+	for _, st := range cs.riskStates {
+		states = append(states, *st)
+	}
+	cs.riskMu.Unlock()
+	return json.Marshal(map[string]interface{}{
+		"type": "risk_state",
+		"data": states,
+	})
+}
+
+func (cs *ConnectionServer) reportRisk() {
+	data, err := cs.riskStateMessage()
+	if err != nil {
+		log.Printf("JSON Marshal error: %v", err)
+		return
+	}
+	cs.sendToCloud(data)
+}
+
+// checkRisk applies the risk limits to a new snapshot.
+func (cs *ConnectionServer) checkRisk(snap Snapshot) {
+	if cs.risk == nil {
+		return
+	}
+	cs.checkLossLimit(snap)
+	cs.checkPositionLimits(snap)
+	cs.checkDrawdown(snap)
+}
+
+// checkLossLimit updates the account's daily P/L from snap and, once it
+// reaches the loss limit, flattens the account and locks it out of new
+// orders until the next trading day. Exposure that reappears on a locked
+// account, e.g. from an order placed in NinjaTrader directly, is flattened
+// again.
+func (cs *ConnectionServer) checkLossLimit(snap Snapshot) {
+	limit := cs.risk.limits(snap.Account).DailyLossLimit
+	if limit <= 0 {
+		return
+	}
+	now := time.Now()
+	day, next := cs.risk.tradingDay(now)
+
+	cs.riskMu.Lock()
+	st := cs.riskStates[snap.Account]
+	rolled := st == nil || st.TradingDay != day
+	if rolled {
+		if st != nil && st.Breached {
+			log.Printf("Risk lockout on %s lifted for trading day %s", snap.Account, day)
+		}
+		st = &RiskState{Account: snap.Account, TradingDay: day}
+		cs.riskStates[snap.Account] = st
+	}
+	pnl := snap.Realized + snap.Unrealized
+	changed := rolled || st.DailyPnL != pnl || st.LossLimit != limit
+	st.DailyPnL = pnl
+	st.LossLimit = limit
+	st.Headroom = limit + st.DailyPnL
+	breached := !st.Breached && st.DailyPnL <= -limit
+	if breached {
+		st.Breached = true
+		st.BreachedAt = &now
+		st.LockedUntil = &next
+	}
+	flatten := st.Breached && hasExposure(snap) && now.Sub(st.lastFlatten) >= riskReflattenInterval
+	if flatten {
+		st.lastFlatten = now
+	}
+	if rolled || breached {
+		cs.saveRiskStatesLocked()
+	}
+	state := *st
+	cs.riskMu.Unlock()
+
+	if breached {
+		msg := fmt.Sprintf("Daily loss limit of %.2f breached (P/L %.2f); flattening and locking out new orders until %s",
+			limit, state.DailyPnL, next.Format("Mon 15:04 MST"))
+		log.Printf("Account %s: %s", snap.Account, msg)
+		cs.sendAlert("error", "risk", snap.Account, msg)
+	} else if flatten {
+		log.Printf("Account %s has exposure while locked out; flattening again", snap.Account)
+		cs.sendAlert("warning", "risk", snap.Account, "New exposure on an account locked out for its daily loss limit; flattening again")
+	}
+	if flatten {
+		cs.riskFlatten(snap.Account)
+	}
+	if changed || breached {
+		cs.reportRisk()
+	}
+}
+
+// riskFlatten closes every position and cancels every working order of
+// account through the regular flatten_account command.
+func (cs *ConnectionServer) riskFlatten(account string) {
+	payload, _ := json.Marshal(FlattenAccountPayload{Account: account})
+	cmd := Command{Type: "flatten_account", Payload: payload, ID: newID("risk")}
+	if err := cs.executeCommand(cmd); err != nil {
+		log.Printf("Risk flatten of %s failed: %v", account, err)
+		cs.sendAlert("error", "risk", account, "Risk flatten failed: "+err.Error())
+	}
+}
+
+// checkRiskLock refuses order entry on an account locked out for the rest
+// of the trading day.
+func (cs *ConnectionServer) checkRiskLock(cmd Command) error {
+	if cs.risk == nil {
+		return nil
+	}
+	var p struct {
+		Account string `json:"account"`
+	}
+	json.Unmarshal(cmd.Payload, &p)
+	day, _ := cs.risk.tradingDay(time.Now())
+	cs.riskMu.Lock()
+	defer cs.riskMu.Unlock()
+	if st, ok := cs.riskStates[p.Account]; ok && st.Breached && st.TradingDay == day {
+		return fmt.Errorf("%w: account %s breached its daily loss limit of %.2f and is locked out until %s",
+			errRiskLocked, p.Account, st.LossLimit, st.LockedUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkOrderLimits refuses an order that would break the account's or the
+// instrument's size limits if it filled, and raises an alert. resting is
+// the number of orders it leaves working. Orders that reduce a position are
+// not limited by the position size.
+func (cs *ConnectionServer) checkOrderLimits(cmdType string, p PlaceOrderPayload, resting int) error {
+	if cs.risk == nil {
+		return nil
+	}
+	limits := cs.risk.limits(p.Account)
+	snap, _ := cs.snapshot(p.Account)
+
+	var violations []string
+	check := func(scope string, sl SizeLimits, match func(string) bool) {
+		if sl.MaxOrderQuantity > 0 && p.Quantity > sl.MaxOrderQuantity {
+			violations = append(violations, fmt.Sprintf("quantity %d is above the %s order limit of %d", p.Quantity, scope, sl.MaxOrderQuantity))
+		}
+		if sl.MaxWorkingOrders > 0 && resting > 0 {
+			working := 0
+			for _, o := range snap.WorkingOrders {
+				if match(o.Instrument) {
+					working++
+				}
+			}
+			if working+resting > sl.MaxWorkingOrders {
+				violations = append(violations, fmt.Sprintf("%d working order(s) would exceed the %s limit of %d", working+resting, scope, sl.MaxWorkingOrders))
+			}
+		}
+		if sl.MaxPosition > 0 && p.Action != "" {
+			open, current := 0, 0
+			for _, pos := range snap.Positions {
+				if match(pos.Instrument) {
+					open += abs(signedQuantity(pos))
+					if pos.Instrument == p.Instrument {
+						current = signedQuantity(pos)
+					}
+				}
+			}
+			after := current + p.Quantity
+			if p.Action == "SELL" {
+				after = current - p.Quantity
+			}
+			total := open - abs(current) + abs(after)
+			if abs(after) > abs(current) && total > sl.MaxPosition {
+				violations = append(violations, fmt.Sprintf("%d contracts open would exceed the %s position limit of %d", total, scope, sl.MaxPosition))
+			}
+		}
+	}
+	check("account", limits.SizeLimits, func(string) bool { return true })
+	check(p.Instrument, limits.instrument(p.Instrument), func(instrument string) bool { return instrument == p.Instrument })
+
+	if len(violations) == 0 {
+		return nil
+	}
+	msg := strings.Join(violations, "; ")
+	cs.sendAlert("warning", "risk", p.Account, fmt.Sprintf("Refused %s for %s: %s", cmdType, p.Instrument, msg))
+	return fmt.Errorf("%w: %s", errRiskLimit, msg)
+}
+
+// reduceOrder is an auto-reduce market order written for an oversize
+// position.
+type reduceOrder struct {
+	orderId  string
+	issuedAt time.Time
+}
+
+// checkPositionLimits alerts on positions above their size limit, e.g. from
+// orders placed in NinjaTrader directly, and with AutoReduce trades them
+// back down to the limit. A new reduce order is only written once the last
+// one has left the working orders, so reduces cannot stack up and flip the
+// position while snapshots lag behind the fills.
+func (cs *ConnectionServer) checkPositionLimits(snap Snapshot) {
+	limits := cs.risk.limits(snap.Account)
+	now := time.Now()
+
+	// due reports whether an oversize position under key should be acted
+	// on now, and whether it was already known.
+	due := func(key string) (bool, bool) {
+		cs.riskMu.Lock()
+		defer cs.riskMu.Unlock()
+		last, seen := cs.oversize[key]
+		if seen && now.Sub(last) < riskReflattenInterval {
+			return false, true
+		}
+		cs.oversize[key] = now
+		return true, seen
+	}
+	clear := func(key string) {
+		cs.riskMu.Lock()
+		delete(cs.oversize, key)
+		delete(cs.reducing, key)
+		cs.riskMu.Unlock()
+	}
+	// inFlight reports whether the last reduce order under key may still
+	// be working: it is listed in the snapshot, or was written too
+	// recently to have shown up in it.
+	inFlight := func(key string) bool {
+		cs.riskMu.Lock()
+		defer cs.riskMu.Unlock()
+		r, ok := cs.reducing[key]
+		if !ok {
+			return false
+		}
+		for _, o := range snap.WorkingOrders {
+			if o.OrderId == r.orderId {
+				return true
+			}
+		}
+		if now.Sub(r.issuedAt) < riskReflattenInterval {
+			return true
+		}
+		delete(cs.reducing, key)
+		return false
+	}
+
+	total := 0
+	for _, pos := range snap.Positions {
+		if pos.MarketPosition == "Flat" || pos.Quantity <= 0 {
+			continue
+		}
+		total += pos.Quantity
+		max := limits.MaxPosition
+		if m := limits.instrument(pos.Instrument).MaxPosition; m > 0 && (max == 0 || m < max) {
+			max = m
+		}
+		key := trailKey(snap.Account, pos.Instrument)
+		if max == 0 || pos.Quantity <= max {
+			clear(key)
+			continue
+		}
+		if limits.AutoReduce && inFlight(key) {
+			continue
+		}
+		act, seen := due(key)
+		if !act {
+			continue
+		}
+		msg := fmt.Sprintf("%s position of %d contracts is above its limit of %d", pos.Instrument, pos.Quantity, max)
+		if !limits.AutoReduce {
+			if !seen {
+				log.Printf("Account %s: %s", snap.Account, msg)
+				cs.sendAlert("warning", "risk", snap.Account, msg)
+			}
+			continue
+		}
+		action := "SELL"
+		if pos.MarketPosition == "Short" {
+			action = "BUY"
+		}
+		excess := pos.Quantity - max
+		orderId := newID("reduce")
+		log.Printf("Account %s: %s; reducing by %d", snap.Account, msg, excess)
+		cs.sendAlert("warning", "risk", snap.Account, fmt.Sprintf("%s; reducing by %d", msg, excess))
+		err := cs.writeOIF("", OIFLine{
+			Command:    "PLACE",
+			Account:    snap.Account,
+			Instrument: pos.Instrument,
+			Action:     action,
+			Quantity:   excess,
+			OrderType:  "MARKET",
+			TIF:        "DAY",
+			OrderId:    orderId,
+		})
+		if err == nil {
+			cs.riskMu.Lock()
+			cs.reducing[key] = reduceOrder{orderId: orderId, issuedAt: now}
+			cs.riskMu.Unlock()
+		} else {
+			log.Printf("Auto-reduce of %s %s failed: %v", snap.Account, pos.Instrument, err)
+			cs.sendAlert("error", "risk", snap.Account, "Auto-reduce failed: "+err.Error())
+		}
+	}
+
+	// With several instruments open there is no single position to trade
+	// down, so an account above its total only raises an alert.
+	key := trailKey(snap.Account, "")
+	if limits.MaxPosition == 0 || total <= limits.MaxPosition {
+		clear(key)
+	} else if act, seen := due(key); act && !seen {
+		msg := fmt.Sprintf("%d contracts open across the account, above its limit of %d", total, limits.MaxPosition)
+		log.Printf("Account %s: %s", snap.Account, msg)
+		cs.sendAlert("warning", "risk", snap.Account, msg)
+	}
+}
+
+func (cs *ConnectionServer) drawdownsPath() string {
+	return filepath.Join(cs.stateDir, "drawdown.json")
+}
+
+func (cs *ConnectionServer) loadDrawdowns() {
+	var states []*DrawdownState
+	if err := readJSONFile(cs.drawdownsPath(), &states); err != nil {
+		log.Printf("Failed to load drawdown state: %v", err)
+		return
+	}
+	cs.riskMu.Lock()
+	for _, st := range states {
+		cs.drawdowns[st.Account] = st
+	}
+	cs.riskMu.Unlock()
+	if len(states) > 0 {
+		log.Printf("Restored trailing drawdown high-water marks for %d account(s)", len(states))
+	}
+}
+
+// saveDrawdownsLocked persists the drawdown states. riskMu must be held.
+func (cs *ConnectionServer) saveDrawdownsLocked() {
+	states := make([]*DrawdownState, 0, len(cs.drawdowns))
+	for _, st := range cs.drawdowns {
+		states = append(states, st)
+	}
+	if err := writeJSONFile(cs.drawdownsPath(), states); err != nil {
+		log.Printf("Failed to save drawdown state: %v", err)
+	}
+}
+
+func (cs *ConnectionServer) drawdownStateMessage() ([]byte, error) {
+	cs.riskMu.Lock()
+	states := make([]DrawdownState, 0, len(cs.drawdowns))
+	for _, st := range cs.drawdowns {
+		states = append(states, *st)
+	}
+	cs.riskMu.Unlock()
+	return json.Marshal(map[string]interface{}{
+		"type": "drawdown_state",
+		"data": states,
+	})
+}
+
+// checkDrawdown follows the account's equity, raises its high-water mark
+// and flattens the account once it comes within the buffer of the
+// liquidation threshold, or reaches it.
+func (cs *ConnectionServer) checkDrawdown(snap Snapshot) {
+	dd := cs.risk.limits(snap.Account).TrailingDrawdown
+	if dd == nil {
+		return
+	}
+	now := time.Now()
+	day, _ := cs.risk.tradingDay(now)
+	equity := snap.Balance + snap.Unrealized
+
+	cs.riskMu.Lock()
+	st := cs.drawdowns[snap.Account]
+	created := st == nil || st.Mode != dd.Mode
+	if created {
+		st = &DrawdownState{Account: snap.Account, Mode: dd.Mode, HighWater: equity, TradingDay: day, DayBalance: snap.Balance}
+		if dd.Mode == "eod" {
+			st.HighWater = snap.Balance
+		}
+		cs.drawdowns[snap.Account] = st
+	}
+	prev := *st
+	highWater := math.Max(st.HighWater, dd.StartingBalance)
+	if dd.Mode == "intraday" {
+		highWater = math.Max(highWater, equity)
+	} else if st.TradingDay != day {
+		// The last balance seen on the previous trading day closes it.
+		highWater = math.Max(highWater, st.DayBalance)
+	}
+	persist := highWater != st.HighWater || st.TradingDay != day
+	st.HighWater = highWater
+	st.TradingDay = day
+	st.DayBalance = snap.Balance
+	st.Threshold = st.HighWater - dd.Amount
+	if dd.LockAt > 0 && st.Threshold > dd.LockAt {
+		st.Threshold = dd.LockAt
+	}
+	st.Equity = equity
+	st.Distance = equity - st.Threshold
+	st.Buffer = dd.FlattenBuffer
+	st.UpdatedAt = now
+	breached := !st.Breached && st.Distance <= 0
+	if breached || st.Breached && st.Distance > 0 {
+		// A breach is sticky until equity recovers above the threshold,
+		// e.g. after a deposit or a raised limit, so the next one alerts.
+		st.Breached = breached
+		persist = true
+	}
+	// Without a buffer the account is flattened on the breach itself.
+	flatten := st.Distance <= dd.FlattenBuffer && hasExposure(snap) &&
+		now.Sub(st.lastFlatten) >= riskReflattenInterval
+	if flatten {
+		st.lastFlatten = now
+	}
+	if persist {
+		cs.saveDrawdownsLocked()
+	}
+	changed := created || st.HighWater != prev.HighWater || st.Threshold != prev.Threshold ||
+		st.Equity != prev.Equity || st.Buffer != prev.Buffer || st.Breached != prev.Breached || st.TradingDay != prev.TradingDay
+	state := *st
+	cs.riskMu.Unlock()
+
+	if breached || flatten {
+		msg := fmt.Sprintf("Equity %.2f is within %.2f of the trailing drawdown threshold %.2f", state.Equity, state.Distance, state.Threshold)
+		if state.Distance <= 0 {
+			msg = fmt.Sprintf("Equity %.2f is at or below the trailing drawdown threshold %.2f", state.Equity, state.Threshold)
+		}
+		if flatten {
+			msg += "; flattening"
+		}
+		log.Printf("Account %s: %s", snap.Account, msg)
+		cs.sendAlert("error", "drawdown", snap.Account, msg)
+	}
+	if flatten {
+		cs.riskFlatten(snap.Account)
+	}
+	if changed {
+		if data, err := cs.drawdownStateMessage(); err == nil {
+			cs.sendToCloud(data)
+		}
+	}
+}
+
+func (cs *ConnectionServer) nakedPolicy(account string) NakedPolicy {
+	if cs.risk != nil {
+		if p := cs.risk.limits(account).NakedPositions; p != nil {
+			return *p
+		}
+	}
+	return defaultNakedPolicy
+}
+
+// watchProtection re-checks the latest snapshots every second, since
+// NinjaTrader only sends one when something changes and the grace period
+// must still run out.
+func (cs *ConnectionServer) watchProtection() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		cs.mu.RLock()
+		snaps := make([]Snapshot, 0, len(cs.latest))
+		for _, snap := range cs.latest {
+			snaps = append(snaps, snap)
+		}
+		cs.mu.RUnlock()
+		for _, snap := range snaps {
+			cs.checkProtection(snap)
+		}
+	}
+}
+
+// stopCoverage returns the unfilled quantity of every stop order working
+// on the closing side of pos, ATM stop-losses and manual stops alike.
+func stopCoverage(snap Snapshot, pos Position) int {
+	closingAction := "Sell"
+	if pos.MarketPosition == "Short" {
+		closingAction = "Buy"
+	}
+	covered := 0
+	for _, o := range snap.WorkingOrders {
+		if o.Instrument != pos.Instrument || !strings.HasPrefix(o.OrderAction, closingAction) {
+			continue
+		}
+		if o.IsStopLoss || strings.Contains(o.OrderType, "Stop") {
+			covered += o.Quantity - o.Filled
+		}
+	}
+	return covered
+}
+
+// checkProtection tracks the positions of snap whose stop orders do not
+// cover their quantity, alerts once one has stayed uncovered for the grace
+// period and, if the policy says so, places a stop for the uncovered part.
+func (cs *ConnectionServer) checkProtection(snap Snapshot) {
+	policy := cs.nakedPolicy(snap.Account)
+	grace := time.Duration(policy.GraceSeconds * float64(time.Second))
+	now := time.Now()
+	changed := false
+	var alerts []NakedPosition
+	var stops []NakedPosition
+	var positions []Position
+
+	cs.riskMu.Lock()
+	uncovered := make(map[string]bool)
+	for _, pos := range snap.Positions {
+		if pos.MarketPosition == "Flat" || pos.Quantity <= 0 {
+			continue
+		}
+		covered := stopCoverage(snap, pos)
+		if covered >= pos.Quantity {
+			continue
+		}
+		key := trailKey(snap.Account, pos.Instrument)
+		uncovered[key] = true
+		status := "naked"
+		if covered > 0 {
+			status = "partial"
+		}
+		np := cs.naked[key]
+		if np == nil {
+			np = &NakedPosition{Account: snap.Account, Instrument: pos.Instrument, Since: now}
+			cs.naked[key] = np
+			changed = true
+		}
+		if np.Quantity != pos.Quantity || np.Covered != covered || np.Status != status {
+			np.Quantity, np.Covered, np.Status = pos.Quantity, covered, status
+			changed = true
+		}
+		if now.Sub(np.Since) < grace {
+			continue
+		}
+		if !np.Alerted {
+			np.Alerted = true
+			changed = true
+			alerts = append(alerts, *np)
+		}
+		// A stop that failed to place is tried again on a later tick.
+		if policy.AutoStopTicks > 0 && !np.StopPlaced && now.Sub(np.lastStopAttempt) >= riskReflattenInterval {
+			np.lastStopAttempt = now
+			stops = append(stops, *np)
+			positions = append(positions, pos)
+		}
+	}
+	for key, np := range cs.naked {
+		if np.Account == snap.Account && !uncovered[key] {
+			delete(cs.naked, key)
+			changed = true
+		}
+	}
+	cs.riskMu.Unlock()
+
+	for _, np := range alerts {
+		msg := fmt.Sprintf("%s position of %d has no stop", np.Instrument, np.Quantity)
+		if np.Covered > 0 {
+			msg = fmt.Sprintf("%s position of %d has stops for only %d", np.Instrument, np.Quantity, np.Covered)
+		}
+		msg += fmt.Sprintf(" after %v", grace)
+		log.Printf("Account %s: %s", np.Account, msg)
+		cs.sendAlert("warning", "protection", np.Account, msg)
+	}
+	for i, np := range stops {
+		orderId, err := cs.placeProtectiveStop(np.Account, positions[i], np.Quantity-np.Covered, policy.AutoStopTicks)
+		if err != nil {
+			msg := fmt.Sprintf("Placing a stop for %s failed: %v; retrying", np.Instrument, err)
+			log.Printf("Account %s: %s", np.Account, msg)
+			cs.sendAlert("error", "protection", np.Account, msg)
+			continue
+		}
+		key := trailKey(np.Account, np.Instrument)
+		cs.riskMu.Lock()
+		if cur := cs.naked[key]; cur != nil {
+			cur.StopPlaced, cur.StopOrderId = true, orderId
+			changed = true
+		}
+		cs.riskMu.Unlock()
+		msg := fmt.Sprintf("Placed stop %s for %d %s, %d ticks away", orderId, np.Quantity-np.Covered, np.Instrument, policy.AutoStopTicks)
+		log.Printf("Account %s: %s", np.Account, msg)
+		cs.sendAlert("warning", "protection", np.Account, msg)
+	}
+	if changed {
+		if data, err := cs.protectionStateMessage(); err == nil {
+			cs.sendToCloud(data)
+		}
+	}
+}
+
+// placeProtectiveStop places a stop market order for quantity contracts of
+// the account's pos, ticks away from its average price, or from the current
+// price when the market has already moved past that. It returns the stop's
+// order id, which is also used as its command id so that its consumption
+// and order updates are tracked like any other order.
+func (cs *ConnectionServer) placeProtectiveStop(account string, pos Position, quantity, ticks int) (string, error) {
+	tick, err := cs.tickSize(pos.Instrument)
+	if err != nil {
+		return "", err
+	}
+	distance := float64(ticks) * tick
+	action, stop := "SELL", pos.AveragePrice-distance
+	if pos.MarketPosition == "Short" {
+		action, stop = "BUY", pos.AveragePrice+distance
+	}
+	if pos.CurrentPrice > 0 {
+		if action == "SELL" && stop >= pos.CurrentPrice {
+			stop = pos.CurrentPrice - distance
+		} else if action == "BUY" && stop <= pos.CurrentPrice {
+			stop = pos.CurrentPrice + distance
+		}
+	}
+	orderId := newID("stop")
+	return orderId, cs.writeOIF(orderId, OIFLine{
+		Command:    "PLACE",
+		Account:    account,
+		Instrument: pos.Instrument,
+		Action:     action,
+		Quantity:   quantity,
+		OrderType:  "STOPMARKET",
+		StopPrice:  roundToTick(stop, tick),
+		TIF:        "GTC",
+		OrderId:    orderId,
+	})
+}
+
+// updateProtectiveStop makes a naked position eligible for another stop
+// when the one placed for it is rejected or cancelled before the snapshot
+// shows it covered.
+func (cs *ConnectionServer) updateProtectiveStop(orderId, state string) {
+	state = strings.ToUpper(state)
+	if state != "REJECTED" && state != "CANCELLED" && state != "CANCELED" {
+		return
+	}
+	cs.riskMu.Lock()
+	defer cs.riskMu.Unlock()
+	for _, np := range cs.naked {
+		if np.StopPlaced && np.StopOrderId == orderId {
+			np.StopPlaced, np.StopOrderId = false, ""
+		}
+	}
+}
+
+func (cs *ConnectionServer) protectionStateMessage() ([]byte, error) {
+	cs.riskMu.Lock()
+	naked := make([]NakedPosition, 0, len(cs.naked))
+	for _, np := range cs.naked {
+		naked = append(naked, *np)
+	}
+	cs.riskMu.Unlock()
+	return json.Marshal(map[string]interface{}{
+		"type": "protection_state",
+		"data": naked,
+	})
+}
+
+// restingOrders is the number of orders p leaves working: none for a market
+// order, which fills at once.
+func restingOrders(p PlaceOrderPayload) int {
+	if p.OrderType == "MARKET" {
+		return 0
+	}
+	return 1
+}
+
+// positionQuantity is the account's net position in instrument, negative
+// when short.
+func positionQuantity(snap Snapshot, instrument string) int {
+	net := 0
+	for _, pos := range snap.Positions {
+		if pos.Instrument == instrument {
+			net += signedQuantity(pos)
+		}
+	}
+	return net
+}
+
+// signedQuantity is the position's quantity, negative when short.
+func signedQuantity(pos Position) int {
+	if pos.MarketPosition == "Short" {
+		return -pos.Quantity
+	}
+	if pos.MarketPosition == "Flat" {
+		return 0
+	}
+	return pos.Quantity
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func hasExposure(snap Snapshot) bool {
+	for _, pos := range snap.Positions {
+		if pos.MarketPosition != "Flat" && pos.Quantity > 0 {
+			return true
+		}
+	}
+	return len(snap.WorkingOrders) > 0
+}
+
+// readJSONFile decodes path into v. A missing file is not an error.
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile replaces path atomically so that a crash never leaves a
+// truncated state file behind.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
 func main() {
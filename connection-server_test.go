@@ -0,0 +1,787 @@
+package main
+
+// The repository holds several main packages side by side, so run these
+// tests with the file they cover:
+//
+//	go test connection-server.go connection-server_test.go
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOIFLineBuildRejectsSeparators(t *testing.T) {
+	valid := OIFLine{Command: "PLACE", Account: "Sim101", Instrument: "ES 12-26", Action: "BUY", Quantity: 1, OrderType: "MARKET", TIF: "DAY", OrderId: "o1"}
+	text, err := valid.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if want := "PLACE;Sim101;ES 12-26;BUY;1;MARKET;0;0;DAY;;o1;;"; text != want {
+		t.Fatalf("Build() = %q, want %q", text, want)
+	}
+
+	for _, bad := range []string{"Sim;101", "Sim101\nFLATTENEVERYTHING", "Sim101\r", "Sim\x00101"} {
+		for name, set := range map[string]func(*OIFLine){
+			"account":    func(l *OIFLine) { l.Account = bad },
+			"instrument": func(l *OIFLine) { l.Instrument = bad },
+			"order id":   func(l *OIFLine) { l.OrderId = bad },
+		} {
+			line := valid
+			set(&line)
+			if text, err := line.Build(); err == nil {
+				t.Errorf("Build() with %s %q = %q, want an error", name, bad, text)
+			}
+		}
+	}
+}
+
+func TestRecordingExecutorKeepsLimit(t *testing.T) {
+	rec := &RecordingExecutor{limit: 2}
+	for _, id := range []string{"o1", "o2", "o3"} {
+		if err := rec.Execute("cmd_"+id, []OIFLine{{Command: "CANCEL", OrderId: id}}); err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+	}
+	want := []string{"CANCEL;;;;;;;;;;o2;;", "CANCEL;;;;;;;;;;o3;;"}
+	if got := recordedLines(rec); !reflect.DeepEqual(got, want) {
+		t.Fatalf("recorded %q, want %q", got, want)
+	}
+}
+
+func newRecordingServer(t *testing.T) (*ConnectionServer, *RecordingExecutor) {
+	t.Helper()
+	t.Setenv("API_SECRET_TOKEN", "test")
+	t.Setenv("NT_INCOMING", t.TempDir())
+	t.Setenv("NT_OUTGOING", t.TempDir())
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("RISK_CONFIG", "")
+	cs := NewConnectionServer()
+	rec := &RecordingExecutor{}
+	cs.executor = rec
+	cs.scanOutgoing(false)
+	return cs, rec
+}
+
+func execute(t *testing.T, cs *ConnectionServer, id, cmdType string, payload interface{}) error {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs.executeCommand(Command{ID: id, Type: cmdType, Payload: data})
+}
+
+func recordedLines(rec *RecordingExecutor) []string {
+	var lines []string
+	for _, r := range rec.Recorded() {
+		lines = append(lines, r.Line)
+	}
+	return lines
+}
+
+func TestExecuteCommand(t *testing.T) {
+	snap := Snapshot{
+		Account: "Sim101",
+		Positions: []Position{
+			{Instrument: "ES 12-26", MarketPosition: "Long", Quantity: 2},
+		},
+		WorkingOrders: []WorkingOrder{
+			{OrderId: "b1_stop", Instrument: "ES 12-26", OrderType: "StopMarket", OrderAction: "Sell", Quantity: 2, StopPrice: 5990},
+			{OrderId: "x", Instrument: "NQ 12-26", OrderType: "Limit", OrderAction: "Buy", Quantity: 1, LimitPrice: 20000},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		cmdType string
+		payload interface{}
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "market order",
+			cmdType: "place_order",
+			payload: map[string]interface{}{"account": "Sim101", "instrument": "ES 12-26", "action": "buy", "quantity": 1, "orderType": "market"},
+			want:    []string{"PLACE;Sim101;ES 12-26;BUY;1;MARKET;0;0;DAY;;cmd1;;"},
+		},
+		{
+			name:    "injected instrument",
+			cmdType: "place_order",
+			payload: map[string]interface{}{"account": "Sim101", "instrument": "ES 12-26\nFLATTENEVERYTHING", "action": "buy", "quantity": 1, "orderType": "market"},
+			wantErr: "must not contain",
+		},
+		{
+			name:    "ATM order",
+			cmdType: "place_atm_order",
+			payload: map[string]interface{}{"account": "Sim101", "instrument": "ES 12-26", "action": "buy", "quantity": 1, "orderType": "market", "strategy": "Scalp", "strategyId": "atm_1"},
+			want:    []string{"PLACE;Sim101;ES 12-26;BUY;1;MARKET;0;0;DAY;;cmd1;Scalp;atm_1"},
+		},
+		{
+			name:    "ATM order without a strategy id",
+			cmdType: "place_atm_order",
+			payload: map[string]interface{}{"account": "Sim101", "instrument": "ES 12-26", "action": "buy", "quantity": 1, "orderType": "market", "strategy": "Scalp"},
+			wantErr: "strategyId are required",
+		},
+		{
+			name:    "plain order naming a strategy",
+			cmdType: "place_order",
+			payload: map[string]interface{}{"account": "Sim101", "instrument": "ES 12-26", "action": "buy", "quantity": 1, "orderType": "market", "strategy": "Scalp"},
+			wantErr: "placed with place_atm_order",
+		},
+		{
+			name:    "close position",
+			cmdType: "close_position",
+			payload: ClosePositionPayload{Account: "Sim101", Instrument: "ES 12-26"},
+			want:    []string{"CLOSEPOSITION;Sim101;ES 12-26;;;;;;;;;;"},
+		},
+		{
+			name:    "cancel order",
+			cmdType: "cancel_order",
+			payload: CancelOrderPayload{Account: "Sim101", OrderId: "x"},
+			want:    []string{"CANCEL;;;;;;;;;;x;;"},
+		},
+		{
+			name:    "cancel all orders for an instrument",
+			cmdType: "cancel_all_orders",
+			payload: CancelAllOrdersPayload{Account: "Sim101", Instrument: "NQ 12-26"},
+			want:    []string{"CANCEL;;;;;;;;;;x;;"},
+		},
+		{
+			name:    "cancel all orders with none working",
+			cmdType: "cancel_all_orders",
+			payload: CancelAllOrdersPayload{Account: "Sim101", Instrument: "CL 12-26"},
+			want:    nil,
+		},
+		{
+			name:    "flatten account",
+			cmdType: "flatten_account",
+			payload: FlattenAccountPayload{Account: "Sim101"},
+			want: []string{
+				"CLOSEPOSITION;Sim101;ES 12-26;;;;;;;;;;",
+				"CLOSEPOSITION;Sim101;NQ 12-26;;;;;;;;;;",
+				"CANCEL;;;;;;;;;;b1_stop;;",
+				"CANCEL;;;;;;;;;;x;;",
+			},
+		},
+		{
+			name:    "flatten unknown account",
+			cmdType: "flatten_account",
+			payload: FlattenAccountPayload{Account: "Sim102"},
+			wantErr: "no instruments known",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, rec := newRecordingServer(t)
+			cs.latest[snap.Account] = snap
+			err := execute(t, cs, "cmd1", tt.cmdType, tt.payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("executeCommand() error = %v, want %q", err, tt.wantErr)
+				}
+				if lines := recordedLines(rec); len(lines) != 0 {
+					t.Fatalf("recorded %q after a failed command", lines)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("executeCommand() error = %v", err)
+			}
+			if got := recordedLines(rec); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("recorded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBracketExitsWaitForEntryFill(t *testing.T) {
+	cs, rec := newRecordingServer(t)
+	bracket := PlaceBracketPayload{Account: "Sim101", Instrument: "ES 12-26", Action: "BUY", Quantity: 2,
+		EntryType: "LIMIT", EntryPrice: 6000, StopPrice: 5990, TargetPrice: 6020, OcoId: "b9"}
+	if err := execute(t, cs, "cmd1", "place_bracket", bracket); err != nil {
+		t.Fatalf("executeCommand() error = %v", err)
+	}
+	want := []string{"PLACE;Sim101;ES 12-26;BUY;2;LIMIT;6000;0;DAY;;b9_entry;;"}
+	if got := recordedLines(rec); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after submit recorded %q, want %q", got, want)
+	}
+
+	cs.updateBracket("b9_entry", "PARTFILLED", 1)
+	want = append(want,
+		"PLACE;Sim101;ES 12-26;SELL;1;STOPMARKET;0;5990;DAY;b9;b9_stop;;",
+		"PLACE;Sim101;ES 12-26;SELL;1;LIMIT;6020;0;DAY;b9;b9_target;;")
+	if got := recordedLines(rec); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after partial fill recorded %q, want %q", got, want)
+	}
+
+	cs.updateBracket("b9_entry", "FILLED", 2)
+	want = append(want, "CHANGE;;;;2;;0;0;;;b9_stop;;", "CHANGE;;;;2;;0;0;;;b9_target;;")
+	if got := recordedLines(rec); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after fill recorded %q, want %q", got, want)
+	}
+
+	bracket.OcoId = "b8"
+	if err := execute(t, cs, "cmd2", "place_bracket", bracket); err != nil {
+		t.Fatalf("executeCommand() error = %v", err)
+	}
+	cs.updateBracket("b8_entry", "REJECTED", 0)
+	if got := recordedLines(rec); len(got) != len(want)+1 {
+		t.Fatalf("exits of a rejected entry were placed: %q", got[len(want):])
+	}
+}
+
+func TestBracketExitsPlacedFromSnapshot(t *testing.T) {
+	cs, rec := newRecordingServer(t)
+	cs.latest["Sim101"] = Snapshot{Account: "Sim101", Positions: []Position{
+		{Instrument: "ES 12-26", MarketPosition: "Short", Quantity: 1},
+	}}
+	bracket := PlaceBracketPayload{Account: "Sim101", Instrument: "ES 12-26", Action: "BUY", Quantity: 2,
+		EntryType: "MARKET", StopPrice: 5990, TargetPrice: 6020, OcoId: "b7"}
+	if err := execute(t, cs, "cmd1", "place_bracket", bracket); err != nil {
+		t.Fatalf("executeCommand() error = %v", err)
+	}
+
+	// The entry turned the short into a long of one: two contracts filled.
+	cs.checkBrackets(Snapshot{Account: "Sim101", Positions: []Position{
+		{Instrument: "ES 12-26", MarketPosition: "Long", Quantity: 1},
+	}})
+	want := []string{
+		"PLACE;Sim101;ES 12-26;BUY;2;MARKET;0;0;DAY;;b7_entry;;",
+		"PLACE;Sim101;ES 12-26;SELL;2;STOPMARKET;0;5990;DAY;b7;b7_stop;;",
+		"PLACE;Sim101;ES 12-26;SELL;2;LIMIT;6020;0;DAY;b7;b7_target;;",
+	}
+	if got := recordedLines(rec); !reflect.DeepEqual(got, want) {
+		t.Fatalf("recorded %q, want %q", got, want)
+	}
+	// The fill read from the outgoing folder afterwards changes nothing.
+	cs.updateBracket("b7_entry", "FILLED", 2)
+	if got := recordedLines(rec); len(got) != len(want) {
+		t.Fatalf("recorded %q after the outgoing fill, want %q", got, want)
+	}
+}
+
+func TestPlaceBracketNeedsOutgoingFolder(t *testing.T) {
+	cs, rec := newRecordingServer(t)
+	cs.outgoingDir = filepath.Join(t.TempDir(), "missing")
+	cs.scanOutgoing(true)
+	bracket := PlaceBracketPayload{Account: "Sim101", Instrument: "ES 12-26", Action: "BUY", Quantity: 1,
+		EntryType: "MARKET", StopPrice: 5990, TargetPrice: 6020}
+	if err := execute(t, cs, "cmd1", "place_bracket", bracket); err == nil {
+		t.Fatal("bracket placed without an outgoing folder")
+	}
+	if got := recordedLines(rec); len(got) != 0 {
+		t.Fatalf("recorded %q for a refused bracket", got)
+	}
+}
+
+func TestCheckPendingBrackets(t *testing.T) {
+	cs, _ := newRecordingServer(t)
+	bracket := PlaceBracketPayload{Account: "Sim101", Instrument: "ES 12-26", Action: "BUY", Quantity: 1,
+		EntryType: "LIMIT", EntryPrice: 6000, StopPrice: 5990, TargetPrice: 6020, OcoId: "b6"}
+	if err := execute(t, cs, "cmd1", "place_bracket", bracket); err != nil {
+		t.Fatalf("executeCommand() error = %v", err)
+	}
+	b := cs.brackets["b6_entry"]
+
+	cs.checkPendingBrackets()
+	if b.alerted {
+		t.Fatal("alerted on a bracket placed just now")
+	}
+	b.createdAt = time.Now().Add(-bracketPendingAlert)
+	cs.checkPendingBrackets()
+	if !b.alerted {
+		t.Fatal("no alert on a bracket pending past the bound")
+	}
+}
+
+func TestStopCoverage(t *testing.T) {
+	pos := Position{Instrument: "ES 12-26", MarketPosition: "Long", Quantity: 3}
+	snap := Snapshot{WorkingOrders: []WorkingOrder{
+		{OrderId: "atm_stop", Instrument: "ES 12-26", OrderType: "StopMarket", OrderAction: "Sell", Quantity: 2, IsStopLoss: true},
+		{OrderId: "manual", Instrument: "ES 12-26", OrderType: "StopLimit", OrderAction: "Sell", Quantity: 1},
+		{OrderId: "target", Instrument: "ES 12-26", OrderType: "Limit", OrderAction: "Sell", Quantity: 3, IsProfitTarget: true},
+		{OrderId: "add", Instrument: "ES 12-26", OrderType: "StopMarket", OrderAction: "Buy", Quantity: 1},
+		{OrderId: "other", Instrument: "NQ 12-26", OrderType: "StopMarket", OrderAction: "Sell", Quantity: 1},
+	}}
+	if got := stopCoverage(snap, pos); got != 3 {
+		t.Fatalf("stopCoverage() = %d, want 3", got)
+	}
+}
+
+func TestProtectiveStopRetriesUntilPlaced(t *testing.T) {
+	cs, rec := newRecordingServer(t)
+	cs.risk = &RiskConfig{Default: RiskLimits{NakedPositions: &NakedPolicy{AutoStopTicks: 4}}}
+	snap := Snapshot{Account: "Sim101", Positions: []Position{
+		{Instrument: "XYZ 12-26", MarketPosition: "Long", Quantity: 1, AveragePrice: 100},
+	}}
+	key := trailKey("Sim101", "XYZ 12-26")
+
+	// Without a tick size the stop cannot be placed, so it stays eligible.
+	cs.checkProtection(snap)
+	if np := cs.naked[key]; np == nil || !np.Alerted || np.StopPlaced {
+		t.Fatalf("after a failed stop naked = %+v, want alerted without a stop", np)
+	}
+	if lines := recordedLines(rec); len(lines) != 0 {
+		t.Fatalf("recorded %q for a failed stop", lines)
+	}
+
+	cs.tickSizes["XYZ"] = 0.5
+	cs.naked[key].lastStopAttempt = time.Time{}
+	cs.checkProtection(snap)
+	np := cs.naked[key]
+	if !np.StopPlaced || !strings.HasPrefix(np.StopOrderId, "stop_") {
+		t.Fatalf("after retry naked = %+v, want a placed stop", np)
+	}
+	want := []string{"PLACE;Sim101;XYZ 12-26;SELL;1;STOPMARKET;0;98;GTC;;" + np.StopOrderId + ";;"}
+	if got := recordedLines(rec); !reflect.DeepEqual(got, want) {
+		t.Fatalf("recorded %q, want %q", got, want)
+	}
+	if got := rec.Recorded()[0].CommandID; got != np.StopOrderId {
+		t.Fatalf("stop written under command id %q, want %q", got, np.StopOrderId)
+	}
+
+	// A placed stop is not duplicated, but one NinjaTrader rejects is retried.
+	np.lastStopAttempt = time.Time{}
+	cs.checkProtection(snap)
+	if got := len(rec.Recorded()); got != 1 {
+		t.Fatalf("recorded %d lines after the stop was placed, want 1", got)
+	}
+	cs.updateProtectiveStop(np.StopOrderId, "Rejected")
+	np.lastStopAttempt = time.Time{}
+	cs.checkProtection(snap)
+	if got := len(rec.Recorded()); got != 2 {
+		t.Fatalf("recorded %d lines after the stop was rejected, want 2", got)
+	}
+}
+
+func TestWatchEffect(t *testing.T) {
+	long := Snapshot{Account: "Sim101",
+		Positions:     []Position{{Instrument: "ES 12-26", MarketPosition: "Long", Quantity: 1}},
+		WorkingOrders: []WorkingOrder{{OrderId: "x", Instrument: "ES 12-26"}},
+	}
+	flat := Snapshot{Account: "Sim101"}
+
+	tests := []struct {
+		name    string
+		latest  *Snapshot
+		cmdType string
+		payload interface{}
+		// pending is whether the verification waits for a later snapshot
+		pending bool
+	}{
+		{"flatten of a flat account", &flat, "flatten_account", FlattenAccountPayload{Account: "Sim101"}, false},
+		{"flatten with a position", &long, "flatten_account", FlattenAccountPayload{Account: "Sim101"}, true},
+		{"flatten without a snapshot", nil, "flatten_account", FlattenAccountPayload{Account: "Sim101"}, true},
+		{"close of a closed position", &flat, "close_position", ClosePositionPayload{Account: "Sim101", Instrument: "ES 12-26"}, false},
+		{"cancel of a working order", &long, "cancel_order", CancelOrderPayload{Account: "Sim101", OrderId: "x"}, true},
+		{"cancel all without orders", &flat, "cancel_all_orders", CancelAllOrdersPayload{Account: "Sim101"}, false},
+		{"cancel all for another instrument", &long, "cancel_all_orders", CancelAllOrdersPayload{Account: "Sim101", Instrument: "NQ 12-26"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, _ := newRecordingServer(t)
+			if tt.latest != nil {
+				cs.latest["Sim101"] = *tt.latest
+			}
+			data, _ := json.Marshal(tt.payload)
+			cs.watchEffect(Command{ID: "cmd1", Type: tt.cmdType, Payload: data})
+			if got := len(cs.verifications) == 1; got != tt.pending {
+				t.Fatalf("pending = %v, want %v", got, tt.pending)
+			}
+			if !tt.pending {
+				return
+			}
+
+			// A snapshot showing the effect verifies the command before
+			// its deadline, so nothing is left to expire.
+			cs.checkVerifications(long)
+			if len(cs.verifications) != 1 {
+				t.Fatalf("verified before the effect was seen")
+			}
+			cs.checkVerifications(flat)
+			if len(cs.verifications) != 0 {
+				t.Fatalf("not verified by a snapshot showing the effect")
+			}
+			if expired := cs.takeExpiredVerifications(time.Now().Add(2 * cs.verifyWindow)); len(expired) != 0 {
+				t.Fatalf("expired %d verified commands", len(expired))
+			}
+		})
+	}
+}
+
+func TestVerificationExpires(t *testing.T) {
+	cs, _ := newRecordingServer(t)
+	cs.latest["Sim101"] = Snapshot{Account: "Sim101", WorkingOrders: []WorkingOrder{{OrderId: "x"}}}
+	data, _ := json.Marshal(CancelOrderPayload{Account: "Sim101", OrderId: "x"})
+	cs.watchEffect(Command{ID: "cmd1", Type: "cancel_order", Payload: data})
+
+	if expired := cs.takeExpiredVerifications(time.Now()); len(expired) != 0 {
+		t.Fatalf("expired %d verifications before the deadline", len(expired))
+	}
+	expired := cs.takeExpiredVerifications(time.Now().Add(cs.verifyWindow + time.Second))
+	if len(expired) != 1 || expired[0].commandID != "cmd1" {
+		t.Fatalf("expired = %v, want cmd1", expired)
+	}
+	if len(cs.verifications) != 0 {
+		t.Fatalf("%d verifications left after expiry", len(cs.verifications))
+	}
+}
+
+func TestCheckDrawdownFlattensOnBreach(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer float64
+		equity float64
+		want   bool
+	}{
+		{name: "above the threshold", equity: 49500},
+		{name: "breach without a buffer", equity: 48900, want: true},
+		{name: "within the buffer", buffer: 250, equity: 49200, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, rec := newRecordingServer(t)
+			cs.risk = &RiskConfig{location: time.UTC, startHour: 17, Default: RiskLimits{
+				TrailingDrawdown: &DrawdownLimits{Amount: 1000, Mode: "intraday", FlattenBuffer: tt.buffer, StartingBalance: 50000},
+			}}
+			snap := Snapshot{Account: "Sim101", Balance: tt.equity, Positions: []Position{
+				{Instrument: "ES 12-26", MarketPosition: "Long", Quantity: 1, AveragePrice: 6000},
+			}}
+			cs.latest[snap.Account] = snap
+
+			cs.checkDrawdown(snap)
+			flattened := len(recordedLines(rec)) > 0
+			if flattened != tt.want {
+				t.Fatalf("flattened = %v (%q), want %v", flattened, recordedLines(rec), tt.want)
+			}
+			if flattened {
+				if got := recordedLines(rec)[0]; got != "CLOSEPOSITION;Sim101;ES 12-26;;;;;;;;;;" {
+					t.Fatalf("first line = %q, want a CLOSEPOSITION", got)
+				}
+			}
+		})
+	}
+}
+
+func TestRatchetTrail(t *testing.T) {
+	tests := []struct {
+		name  string
+		trail Trail
+		pos   Position
+		stop  float64
+		// prices are the position's current prices on successive
+		// snapshots; NinjaTrader is assumed to apply each change
+		prices []float64
+		want   []string
+	}{
+		{
+			name:   "long moves in steps",
+			trail:  Trail{Mode: "ticks", Distance: 8, StepTicks: 4},
+			pos:    Position{MarketPosition: "Long", Quantity: 1, AveragePrice: 6000},
+			stop:   5990,
+			prices: []float64{6000, 6000.5, 6001, 5999.5, 6003.25},
+			want: []string{
+				"CHANGE;;;;0;;0;5998;;;t_stop;;",
+				"CHANGE;;;;0;;0;5999;;;t_stop;;",
+				"CHANGE;;;;0;;0;6001.25;;;t_stop;;",
+			},
+		},
+		{
+			name:   "short moves down only",
+			trail:  Trail{Mode: "ticks", Distance: 8, StepTicks: 1},
+			pos:    Position{MarketPosition: "Short", Quantity: 1, AveragePrice: 6000},
+			stop:   6010,
+			prices: []float64{6000, 6001, 5999.75},
+			want: []string{
+				"CHANGE;;;;0;;0;6002;;;t_stop;;",
+				"CHANGE;;;;0;;0;6001.75;;;t_stop;;",
+			},
+		},
+		{
+			name:   "percent distance",
+			trail:  Trail{Mode: "percent", Distance: 0.1, StepTicks: 1},
+			pos:    Position{MarketPosition: "Long", Quantity: 1, AveragePrice: 6000},
+			stop:   5990,
+			prices: []float64{6000},
+			want:   []string{"CHANGE;;;;0;;0;5994;;;t_stop;;"},
+		},
+		{
+			name:   "never loosens a tighter stop",
+			trail:  Trail{Mode: "ticks", Distance: 8, StepTicks: 1},
+			pos:    Position{MarketPosition: "Long", Quantity: 1, AveragePrice: 6000},
+			stop:   5999,
+			prices: []float64{6000, 6000.25},
+		},
+		{
+			name:   "never through the market",
+			trail:  Trail{Mode: "ticks", Distance: 8, StepTicks: 1, BestPrice: 6010},
+			pos:    Position{MarketPosition: "Long", Quantity: 1, AveragePrice: 6000},
+			stop:   5990,
+			prices: []float64{6007},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, rec := newRecordingServer(t)
+			trail := tt.trail
+			trail.Account, trail.Instrument, trail.Status = "Sim101", "ES 12-26", "armed"
+			pos := tt.pos
+			pos.Instrument = "ES 12-26"
+			stop := tt.stop
+			for _, price := range tt.prices {
+				pos.CurrentPrice = price
+				snap := Snapshot{Account: "Sim101", Positions: []Position{pos}, WorkingOrders: []WorkingOrder{
+					{OrderId: "t_stop", Instrument: "ES 12-26", OrderType: "StopMarket", OrderAction: "Sell", Quantity: 1, StopPrice: stop},
+				}}
+				if pos.MarketPosition == "Short" {
+					snap.WorkingOrders[0].OrderAction = "Buy"
+				}
+				cs.ratchetTrail(&trail, snap, pos)
+				stop = trail.StopPrice
+			}
+			if got := recordedLines(rec); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("recorded %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("no stop", func(t *testing.T) {
+		cs, rec := newRecordingServer(t)
+		trail := Trail{Account: "Sim101", Instrument: "ES 12-26", Mode: "ticks", Distance: 8, StepTicks: 1, Status: "armed"}
+		pos := Position{Instrument: "ES 12-26", MarketPosition: "Long", Quantity: 1, AveragePrice: 6000, CurrentPrice: 6010}
+		cs.ratchetTrail(&trail, Snapshot{Account: "Sim101", Positions: []Position{pos}}, pos)
+		if trail.Status != "no stop" || len(recordedLines(rec)) != 0 {
+			t.Fatalf("trail = %+v with %q recorded, want it waiting for a stop", trail, recordedLines(rec))
+		}
+	})
+}
+
+func TestTradingDay(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Skip(err)
+	}
+	rc := &RiskConfig{location: chicago, startHour: 17}
+	tests := []struct {
+		at       string
+		wantDay  string
+		wantNext string
+	}{
+		{at: "2026-10-14 09:30", wantDay: "2026-10-14", wantNext: "2026-10-14 17:00"},
+		{at: "2026-10-14 16:59", wantDay: "2026-10-14", wantNext: "2026-10-14 17:00"},
+		{at: "2026-10-14 17:00", wantDay: "2026-10-15", wantNext: "2026-10-15 17:00"},
+		// Friday evening and Saturday belong to the session opening on
+		// Sunday evening.
+		{at: "2026-10-16 18:00", wantDay: "2026-10-18", wantNext: "2026-10-18 17:00"},
+		{at: "2026-10-17 12:00", wantDay: "2026-10-18", wantNext: "2026-10-18 17:00"},
+		{at: "2026-10-18 18:00", wantDay: "2026-10-19", wantNext: "2026-10-19 17:00"},
+		// The session start stays at 17:00 local across the end of DST.
+		{at: "2026-10-31 18:00", wantDay: "2026-11-01", wantNext: "2026-11-01 17:00"},
+	}
+	for _, tt := range tests {
+		at, err := time.ParseInLocation("2006-01-02 15:04", tt.at, chicago)
+		if err != nil {
+			t.Fatal(err)
+		}
+		day, next := rc.tradingDay(at)
+		if got := next.Format("2006-01-02 15:04"); day != tt.wantDay || got != tt.wantNext {
+			t.Errorf("tradingDay(%s) = %s, %s; want %s, %s", tt.at, day, got, tt.wantDay, tt.wantNext)
+		}
+	}
+}
+
+func TestDailyLossLockout(t *testing.T) {
+	cs, rec := newRecordingServer(t)
+	cs.risk = &RiskConfig{location: time.UTC, startHour: 17, Default: RiskLimits{DailyLossLimit: 500}}
+	position := []Position{{Instrument: "ES 12-26", MarketPosition: "Long", Quantity: 1, AveragePrice: 6000}}
+	order := PlaceOrderPayload{Account: "Sim101", Instrument: "ES 12-26", Action: "BUY", Quantity: 1, OrderType: "MARKET"}
+
+	steps := []struct {
+		name       string
+		snap       Snapshot
+		newDay     bool
+		wantLines  int
+		wantLocked bool
+	}{
+		{name: "within the limit", snap: Snapshot{Realized: -200, Unrealized: -250, Positions: position}},
+		{name: "breach flattens", snap: Snapshot{Realized: -200, Unrealized: -350, Positions: position}, wantLines: 1, wantLocked: true},
+		{name: "flattened again only after the interval", snap: Snapshot{Realized: -600, Positions: position}, wantLocked: true},
+		{name: "flat account stays locked", snap: Snapshot{Realized: -600}, wantLocked: true},
+		{name: "next trading day lifts the lockout", snap: Snapshot{}, newDay: true},
+	}
+	for _, step := range steps {
+		if step.newDay {
+			cs.riskStates["Sim101"].TradingDay = "2000-01-01"
+		}
+		before := len(rec.Recorded())
+		step.snap.Account = "Sim101"
+		cs.latest["Sim101"] = step.snap
+		cs.checkLossLimit(step.snap)
+
+		if got := len(rec.Recorded()) - before; got != step.wantLines {
+			t.Errorf("%s: recorded %d lines, want %d", step.name, got, step.wantLines)
+		}
+		err := execute(t, cs, "order_"+step.name, "place_order", order)
+		if locked := errors.Is(err, errRiskLocked); locked != step.wantLocked {
+			t.Errorf("%s: place_order error = %v, want locked %v", step.name, err, step.wantLocked)
+		}
+	}
+	if st := cs.riskStates["Sim101"]; st.Breached || st.Headroom != 500 {
+		t.Errorf("state after reset = %+v, want a fresh day", st)
+	}
+}
+
+func TestAutoReduce(t *testing.T) {
+	cs, rec := newRecordingServer(t)
+	cs.risk = &RiskConfig{location: time.UTC, startHour: 17, Default: RiskLimits{
+		AutoReduce:  true,
+		Instruments: map[string]SizeLimits{"ES": {MaxPosition: 2}},
+	}}
+	key := trailKey("Sim101", "ES 12-26")
+	// backdate makes the last reduce old enough to be acted on again.
+	backdate := func() {
+		cs.oversize[key] = time.Now().Add(-riskReflattenInterval)
+		if r, ok := cs.reducing[key]; ok {
+			r.issuedAt = time.Now().Add(-riskReflattenInterval)
+			cs.reducing[key] = r
+		}
+	}
+	snap := func(market string, quantity int, orders ...WorkingOrder) Snapshot {
+		return Snapshot{Account: "Sim101", WorkingOrders: orders, Positions: []Position{
+			{Instrument: "ES 12-26", MarketPosition: market, Quantity: quantity},
+		}}
+	}
+
+	steps := []struct {
+		name     string
+		snap     Snapshot
+		backdate bool
+		// working lists the last reduce order in the snapshot
+		working bool
+		want    string
+	}{
+		{name: "oversize position", snap: snap("Long", 5), want: "PLACE;Sim101;ES 12-26;SELL;3;MARKET;0;0;DAY;;reduce_"},
+		{name: "reduce just written", snap: snap("Long", 5)},
+		{name: "reduce still working", snap: snap("Long", 5), backdate: true, working: true},
+		{name: "reduce gone, position still oversize", snap: snap("Long", 4), backdate: true, want: "PLACE;Sim101;ES 12-26;SELL;2;MARKET;0;0;DAY;;reduce_"},
+		{name: "at the limit", snap: snap("Long", 2), backdate: true},
+		{name: "oversize short", snap: snap("Short", 3), want: "PLACE;Sim101;ES 12-26;BUY;1;MARKET;0;0;DAY;;reduce_"},
+	}
+	for _, step := range steps {
+		if step.backdate {
+			backdate()
+		}
+		if step.working {
+			step.snap.WorkingOrders = append(step.snap.WorkingOrders, WorkingOrder{OrderId: cs.reducing[key].orderId, Instrument: "ES 12-26"})
+		}
+		before := len(rec.Recorded())
+		cs.checkPositionLimits(step.snap)
+		lines := recordedLines(rec)[before:]
+		switch {
+		case step.want == "" && len(lines) != 0:
+			t.Errorf("%s: recorded %q, want nothing", step.name, lines)
+		case step.want != "" && (len(lines) != 1 || !strings.HasPrefix(lines[0], step.want)):
+			t.Errorf("%s: recorded %q, want %s...", step.name, lines, step.want)
+		}
+	}
+}
+
+func TestCheckOrderLimits(t *testing.T) {
+	cs, _ := newRecordingServer(t)
+	cs.risk = &RiskConfig{location: time.UTC, startHour: 17, Default: RiskLimits{
+		SizeLimits:  SizeLimits{MaxPosition: 4, MaxOrderQuantity: 3, MaxWorkingOrders: 2},
+		Instruments: map[string]SizeLimits{"ES": {MaxPosition: 2}},
+	}}
+	cs.latest["Sim101"] = Snapshot{Account: "Sim101",
+		Positions: []Position{
+			{Instrument: "ES 12-26", MarketPosition: "Long", Quantity: 2},
+			{Instrument: "NQ 12-26", MarketPosition: "Short", Quantity: 1},
+		},
+		WorkingOrders: []WorkingOrder{{OrderId: "x", Instrument: "NQ 12-26"}},
+	}
+	tests := []struct {
+		name    string
+		order   PlaceOrderPayload
+		resting int
+		wantErr bool
+	}{
+		{name: "reducing ES", order: PlaceOrderPayload{Instrument: "ES 12-26", Action: "SELL", Quantity: 2}},
+		{name: "adding to ES at its limit", order: PlaceOrderPayload{Instrument: "ES 12-26", Action: "BUY", Quantity: 1}, wantErr: true},
+		{name: "adding to NQ within the account", order: PlaceOrderPayload{Instrument: "NQ 12-26", Action: "SELL", Quantity: 1}},
+		{name: "adding to NQ beyond the account", order: PlaceOrderPayload{Instrument: "NQ 12-26", Action: "SELL", Quantity: 2}, wantErr: true},
+		{name: "order too large", order: PlaceOrderPayload{Instrument: "NQ 12-26", Action: "BUY", Quantity: 4}, wantErr: true},
+		{name: "one more resting order", order: PlaceOrderPayload{Instrument: "NQ 12-26", Action: "BUY", Quantity: 1}, resting: 1},
+		{name: "too many resting orders", order: PlaceOrderPayload{Instrument: "NQ 12-26", Action: "BUY", Quantity: 1}, resting: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt.order.Account = "Sim101"
+		err := cs.checkOrderLimits("place_order", tt.order, tt.resting)
+		if (err != nil) != tt.wantErr || err != nil && !errors.Is(err, errRiskLimit) {
+			t.Errorf("%s: checkOrderLimits() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDuplicateCommandsReplayed(t *testing.T) {
+	cs, rec := newRecordingServer(t)
+	order, _ := json.Marshal(PlaceOrderPayload{Account: "Sim101", Instrument: "ES 12-26", Action: "BUY", Quantity: 1, OrderType: "MARKET"})
+	bad, _ := json.Marshal(PlaceOrderPayload{Account: "Sim101", Instrument: "ES 12-26", Action: "BUY", OrderType: "MARKET"})
+	for _, cmd := range []Command{
+		{ID: "cmd1", Type: "place_order", Payload: order},
+		{ID: "cmd1", Type: "place_order", Payload: order},
+		{ID: "cmd2", Type: "place_order", Payload: bad},
+		{ID: "cmd2", Type: "place_order", Payload: order},
+	} {
+		cs.commandChan <- cmd
+	}
+	close(cs.commandChan)
+	cs.processCommands()
+
+	want := []string{"PLACE;Sim101;ES 12-26;BUY;1;MARKET;0;0;DAY;;cmd1;;"}
+	if got := recordedLines(rec); !reflect.DeepEqual(got, want) {
+		t.Fatalf("recorded %q, want %q", got, want)
+	}
+	if r, ok := cs.executedResult("cmd2"); !ok || r.Error == "" {
+		t.Fatalf("result of cmd2 = %+v, want its original failure", r)
+	}
+
+	// Results survive a restart, so a redelivery after it is not executed.
+	restarted := NewConnectionServer()
+	restarted.stateDir = cs.stateDir
+	restarted.loadExecuted()
+	if r, ok := restarted.executedResult("cmd1"); !ok || r.Error != "" || r.Type != "place_order" {
+		t.Fatalf("restored result of cmd1 = %+v, %v", r, ok)
+	}
+}
+
+func TestCommandExpiry(t *testing.T) {
+	order, _ := json.Marshal(PlaceOrderPayload{Account: "Sim101", Instrument: "ES 12-26", Action: "BUY", Quantity: 1, OrderType: "MARKET"})
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		ttl      float64
+		expired  bool
+	}{
+		{name: "no TTL", issuedAt: time.Now().Add(-time.Hour)},
+		{name: "no issue time", ttl: 10},
+		{name: "within its TTL", issuedAt: time.Now().Add(-5 * time.Second), ttl: 10},
+		{name: "past its TTL", issuedAt: time.Now().Add(-11 * time.Second), ttl: 10, expired: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, rec := newRecordingServer(t)
+			err := cs.executeCommand(Command{ID: "cmd1", Type: "place_order", Payload: order, IssuedAt: tt.issuedAt, TTLSeconds: tt.ttl})
+			if got := errors.Is(err, errCommandExpired); got != tt.expired {
+				t.Fatalf("executeCommand() error = %v, want expired %v", err, tt.expired)
+			}
+			if written := len(rec.Recorded()) > 0; written == tt.expired {
+				t.Fatalf("recorded %q for a command with expired %v", recordedLines(rec), tt.expired)
+			}
+		})
+	}
+}